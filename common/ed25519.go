@@ -0,0 +1,156 @@
+package common
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	blindString          = "Derive temporary signing key\x00"
+	blindHashInputString = "Derive temporary signing key hash input"
+	keyBlindString       = "key-blind"
+	ed25519BasepointStr  = "(15112221349535400772501151409588531511454012693041857206046113283949847762202, " +
+		"46316835694926478169428394003475163141307993866256225615783033603165251855960)"
+)
+
+// The arithmetic on secret scalars, the identity key and the blinded keys derived from it, is done by
+// filippo.io/edwards25519 which is constant time
+
+// scalarFromExpanded returns the scalar of an expanded private key. The scalar is stored as is, a blinded scalar
+// is already reduced and a clamped one is reduced here, which doesn't change the points it multiplies.
+func scalarFromExpanded(expandedKey []byte) *edwards25519.Scalar {
+	wide := make([]byte, 64)
+	copy(wide, expandedKey[:32])
+
+	scalar, _ := edwards25519.NewScalar().SetUniformBytes(wide)
+	return scalar
+}
+
+// scalarFromHash reduces a 64 byte little endian hash modulo the group order
+func scalarFromHash(digest []byte) *edwards25519.Scalar {
+	scalar, _ := edwards25519.NewScalar().SetUniformBytes(digest)
+	return scalar
+}
+
+// ExpandEd25519PrivateKey returns the 64 byte expanded form (clamped scalar followed by the hash prefix) of an
+// ed25519 private key, which is the form tor stores onion service keys in
+func ExpandEd25519PrivateKey(privateKey ed25519.PrivateKey) []byte {
+	digest := sha512.Sum512(privateKey[:32])
+	digest[0] &= 248
+	digest[31] &= 63
+	digest[31] |= 64
+
+	return digest[:]
+}
+
+// Ed25519PublicKeyFromExpanded returns the public key for an expanded private key
+func Ed25519PublicKeyFromExpanded(expandedKey []byte) ed25519.PublicKey {
+	return new(edwards25519.Point).ScalarBaseMult(scalarFromExpanded(expandedKey)).Bytes()
+}
+
+// SignEd25519Expanded signs a message with an expanded private key, the signature can be verified with
+// ed25519.Verify as usual
+func SignEd25519Expanded(expandedKey []byte, publicKey ed25519.PublicKey, message []byte) []byte {
+	h := sha512.New()
+	h.Write(expandedKey[32:])
+	h.Write(message)
+	r := scalarFromHash(h.Sum(nil))
+
+	encodedR := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h = sha512.New()
+	h.Write(encodedR)
+	h.Write(publicKey)
+	h.Write(message)
+	k := scalarFromHash(h.Sum(nil))
+
+	s := edwards25519.NewScalar().MultiplyAdd(k, scalarFromExpanded(expandedKey), r)
+
+	signature := make([]byte, 0, ed25519.SignatureSize)
+	signature = append(signature, encodedR...)
+	signature = append(signature, s.Bytes()...)
+
+	return signature
+}
+
+// calculateBlindingParam computes the clamped blinding factor
+// h = SHA3_256(BLIND_STRING | A | B | N) where N = "key-blind" | INT_8(period-number) | INT_8(period_length)
+func calculateBlindingParam(publicKey ed25519.PublicKey, timePeriod, periodLength int64) *edwards25519.Scalar {
+	nonce := make([]byte, len(keyBlindString)+16)
+	copy(nonce, keyBlindString)
+	binary.BigEndian.PutUint64(nonce[len(keyBlindString):], uint64(timePeriod))
+	binary.BigEndian.PutUint64(nonce[len(keyBlindString)+8:], uint64(periodLength))
+
+	h := sha3.New256()
+	h.Write([]byte(blindString))
+	h.Write(publicKey)
+	h.Write([]byte(ed25519BasepointStr))
+	h.Write(nonce)
+
+	param, _ := edwards25519.NewScalar().SetBytesWithClamping(h.Sum(nil))
+	return param
+}
+
+// BlindEd25519PublicKey derives the blinded public key A' = h * A for the given time period
+func BlindEd25519PublicKey(publicKey ed25519.PublicKey, timePeriod, periodLength int64) (ed25519.PublicKey, error) {
+	point, err := new(edwards25519.Point).SetBytes(publicKey)
+	if err != nil {
+		return nil, errors.New("invalid public key")
+	}
+
+	param := calculateBlindingParam(publicKey, timePeriod, periodLength)
+
+	return new(edwards25519.Point).ScalarMult(param, point).Bytes(), nil
+}
+
+// BlindEd25519PrivateKey derives the expanded blinded private key for the given time period. The scalar is
+// a' = h * a mod l and the hash prefix is RH' = SHA-512(RH_BLIND_STRING | RH)[:32]
+func BlindEd25519PrivateKey(expandedKey []byte, publicKey ed25519.PublicKey, timePeriod, periodLength int64) ([]byte, error) {
+	if len(expandedKey) != 64 {
+		return nil, errors.New("invalid expanded private key length")
+	}
+
+	param := calculateBlindingParam(publicKey, timePeriod, periodLength)
+	scalar := edwards25519.NewScalar().Multiply(param, scalarFromExpanded(expandedKey))
+
+	h := sha512.New()
+	h.Write([]byte(blindHashInputString))
+	h.Write(expandedKey[32:])
+
+	blinded := make([]byte, 0, 64)
+	blinded = append(blinded, scalar.Bytes()...)
+	blinded = append(blinded, h.Sum(nil)[:32]...)
+
+	return blinded, nil
+}
+
+// Ed25519PublicKeyFromCurve25519 converts a curve25519 public key to the ed25519 public key with the sign bit
+// set to 0, as used for the enc-key-cert of v3 introduction points
+func Ed25519PublicKeyFromCurve25519(curveKey []byte) (ed25519.PublicKey, error) {
+	if len(curveKey) != 32 {
+		return nil, errors.New("invalid curve25519 key length")
+	}
+
+	// y = (u - 1) / (u + 1)
+	u, err := new(field.Element).SetBytes(curveKey)
+	if err != nil {
+		return nil, errors.New("invalid curve25519 key")
+	}
+
+	one := new(field.Element).One()
+	den := new(field.Element).Add(u, one)
+	if den.Equal(new(field.Element).Zero()) == 1 {
+		return nil, errors.New("invalid curve25519 key")
+	}
+
+	y := new(field.Element).Subtract(u, one)
+	y.Multiply(y, den.Invert(den))
+
+	return y.Bytes(), nil
+}
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// RFC 8032 test 1
+const (
+	testSeedHex      = "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"
+	testPublicKeyHex = "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+)
+
+func TestEd25519PublicKeyFromExpanded(t *testing.T) {
+	t.Parallel()
+
+	seed, _ := hex.DecodeString(testSeedHex)
+	expandedKey := ExpandEd25519PrivateKey(ed25519.NewKeyFromSeed(seed))
+
+	if got := hex.EncodeToString(Ed25519PublicKeyFromExpanded(expandedKey)); got != testPublicKeyHex {
+		t.Errorf("want %v got %v", testPublicKeyHex, got)
+	}
+}
+
+func TestSignEd25519Expanded(t *testing.T) {
+	t.Parallel()
+
+	seed, _ := hex.DecodeString(testSeedHex)
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	message := []byte("onionspread")
+
+	got := SignEd25519Expanded(ExpandEd25519PrivateKey(privateKey), publicKey, message)
+
+	// Signing is deterministic so an expanded key must produce the same signature as the seed
+	if want := ed25519.Sign(privateKey, message); !bytes.Equal(want, got) {
+		t.Errorf("want %x got %x", want, got)
+	}
+}
+
+func TestBlindEd25519Keys(t *testing.T) {
+	t.Parallel()
+
+	publicKey, expandedKey, err := LoadEd25519KeysFromFile("../testdata/ed25519Key")
+	if err != nil {
+		t.Fatalf("failed to load keys: %v", err)
+	}
+
+	testCases := []struct {
+		name         string
+		timePeriod   int64
+		periodLength int64
+	}{
+		{"time period 17756", 17756, TimePeriodLengthV3},
+		{"time period 17757", 17757, TimePeriodLengthV3},
+		{"short period length", 426144, 60},
+	}
+
+	var previous ed25519.PublicKey
+	for _, tt := range testCases {
+		blindedKey, err := BlindEd25519PublicKey(publicKey, tt.timePeriod, tt.periodLength)
+		if err != nil {
+			t.Fatalf("%v: failed to blind public key: %v", tt.name, err)
+		}
+
+		blindedPrivateKey, err := BlindEd25519PrivateKey(expandedKey, publicKey, tt.timePeriod, tt.periodLength)
+		if err != nil {
+			t.Fatalf("%v: failed to blind private key: %v", tt.name, err)
+		}
+
+		// The blinded private key must match the blinded public key and produce valid signatures for it
+		if got := Ed25519PublicKeyFromExpanded(blindedPrivateKey); !bytes.Equal(blindedKey, got) {
+			t.Errorf("%v: want %x got %x", tt.name, blindedKey, got)
+		}
+
+		message := []byte("onionspread")
+		signature := SignEd25519Expanded(blindedPrivateKey, blindedKey, message)
+		if !ed25519.Verify(blindedKey, message, signature) {
+			t.Errorf("%v: failed to verify signature with blinded key", tt.name)
+		}
+
+		if bytes.Equal(blindedKey, publicKey) || bytes.Equal(blindedKey, previous) {
+			t.Errorf("%v: blinded key was not changed", tt.name)
+		}
+		previous = blindedKey
+	}
+
+	// Key blinding used for the descriptor in desc-v3.txt
+	blindedKey, _ := BlindEd25519PublicKey(publicKey, 17756, TimePeriodLengthV3)
+	want := "e819f19877eabec5166e70439ed24b6fe33adc74bc830d0140b0796c5429092d"
+	if got := hex.EncodeToString(blindedKey); got != want {
+		t.Errorf("want %v got %v", want, got)
+	}
+}
+
+func TestBlindEd25519KeysVector(t *testing.T) {
+	t.Parallel()
+
+	// test_blinding_basics in tor's src/test/test_hs_common.c
+	expandedKey, _ := hex.DecodeString("d8c7ff0e31295b66540d789af3e3df992038a9592eea01d8b7cba06d6e66d159" +
+		"4d6167696320576f7264733a20737065697373636f62616c742062697669756d")
+	publicKeyHex := "833990b085c1a688c1d4c8b1f6b56afaf5a2eca674449e1d704f83765ccb7bc6"
+	blindedKeyHex := "3a50bf210e8f9ee955ae0014f7a6917fb65ebf098a86305abb508d1a7291b6d5"
+
+	publicKey := Ed25519PublicKeyFromExpanded(expandedKey)
+	if got := hex.EncodeToString(publicKey); got != publicKeyHex {
+		t.Fatalf("want public key %v got %v", publicKeyHex, got)
+	}
+
+	timePeriod := TimePeriodV3(time.Date(1973, 5, 20, 1, 50, 33, 0, time.UTC), TimePeriodLengthV3)
+	if timePeriod != 1234 {
+		t.Fatalf("want time period %v got %v", 1234, timePeriod)
+	}
+
+	blindedKey, err := BlindEd25519PublicKey(publicKey, timePeriod, TimePeriodLengthV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := hex.EncodeToString(blindedKey); got != blindedKeyHex {
+		t.Errorf("want blinded key %v got %v", blindedKeyHex, got)
+	}
+
+	blindedPrivateKey, err := BlindEd25519PrivateKey(expandedKey, publicKey, timePeriod, TimePeriodLengthV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := hex.EncodeToString(Ed25519PublicKeyFromExpanded(blindedPrivateKey)); got != blindedKeyHex {
+		t.Errorf("want blinded key %v from the blinded private key got %v", blindedKeyHex, got)
+	}
+}
+
+func TestEd25519PublicKeyFromCurve25519(t *testing.T) {
+	t.Parallel()
+
+	// Base point u = 9 maps to the ed25519 base point
+	curveKey := make([]byte, 32)
+	curveKey[0] = 9
+
+	got, err := Ed25519PublicKeyFromCurve25519(curveKey)
+	if err != nil {
+		t.Fatalf("failed to convert key: %v", err)
+	}
+
+	want := "5866666666666666666666666666666666666666666666666666666666666666"
+	if hex.EncodeToString(got) != want {
+		t.Errorf("want %v got %x", want, got)
+	}
+}
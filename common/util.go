@@ -14,9 +14,28 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
 )
 
-const rendTimePeriodV2descValidity = 86400
+const (
+	rendTimePeriodV2descValidity = 86400
+
+	// TimePeriodLengthV3 is the default v3 time period length in minutes
+	TimePeriodLengthV3       = 1440
+	timePeriodRotationOffset = 720
+
+	onionAddressV3Length   = 35
+	onionAddressV3Version  = 0x03
+	ed25519SecretKeyHeader = "== ed25519v1-secret: type0 ==\x00\x00\x00"
+
+	descriptorCookieLengthBase64 = 22
+
+	clientAuthKeyType = "descriptor:x25519:"
+	x25519KeyLength   = 32
+)
 
 // Base64ToHex decodes a base 64 string and returns its uppercase hex encoding
 func Base64ToHex(identity string) (string, error) {
@@ -105,6 +124,23 @@ func DescriptorIDValidUntil(permanentID []byte, time int64) int64 {
 		rendTimePeriodV2descValidity)
 }
 
+// ParseDescriptorCookie returns the 16 byte descriptor cookie of a v2 HidServAuth auth-cookie, the 22 character
+// base64 encoding used by tor, or of the padded base64 encoding used in tor's client_keys file
+func ParseDescriptorCookie(data string) ([]byte, error) {
+	data = strings.TrimRight(strings.TrimSpace(data), "=")
+	if len(data) != descriptorCookieLengthBase64 {
+		return nil, fmt.Errorf("invalid descriptor cookie length %d", len(data))
+	}
+
+	// The last 4 bits of the auth-cookie hold the auth type, which isn't needed
+	decoded, err := base64.StdEncoding.DecodeString(data + "A=")
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode descriptor cookie: %v", err)
+	}
+
+	return decoded[:16], nil
+}
+
 // LoadKeysFromFile returns an rsa public/private key pair given pem encoded private key
 func LoadKeysFromFile(filePath string) (*rsa.PublicKey, *rsa.PrivateKey, error) {
 	privateKeyPem, err := ioutil.ReadFile(filePath)
@@ -129,3 +165,151 @@ func LoadKeysFromFile(filePath string) (*rsa.PublicKey, *rsa.PrivateKey, error)
 
 	return publicKey, privateKey, nil
 }
+
+// CalculateCredential returns the v3 credential of an onion service
+// credential = SHA3_256("credential" | public-identity-key)
+func CalculateCredential(publicKey ed25519.PublicKey) []byte {
+	h := sha3.New256()
+	h.Write([]byte("credential"))
+	h.Write(publicKey)
+
+	return h.Sum(nil)
+}
+
+// CalculateSubcredential returns the v3 subcredential of an onion service for the blinded key of a time period
+// subcredential = SHA3_256("subcredential" | credential | blinded-public-key)
+func CalculateSubcredential(publicKey, blindedKey ed25519.PublicKey) []byte {
+	h := sha3.New256()
+	h.Write([]byte("subcredential"))
+	h.Write(CalculateCredential(publicKey))
+	h.Write(blindedKey)
+
+	return h.Sum(nil)
+}
+
+// TimePeriodV3 returns the v3 time period number for the given time, periods are offset by 12 hours so that they
+// start at 12:00 UTC when the period length is a day
+func TimePeriodV3(now time.Time, periodLength int64) int64 {
+	minutes := now.Unix() / 60
+	return (minutes - timePeriodRotationOffset) / periodLength
+}
+
+// TimePeriodStartV3 returns the time at which the given v3 time period starts
+func TimePeriodStartV3(timePeriod, periodLength int64) time.Time {
+	return time.Unix((timePeriod*periodLength+timePeriodRotationOffset)*60, 0).UTC()
+}
+
+// CalculateOnionAddressV3 returns the v3 onion address given the ed25519 identity public key
+// onion_address = base32(PUBKEY | CHECKSUM | VERSION)
+func CalculateOnionAddressV3(publicKey ed25519.PublicKey) string {
+	address := make([]byte, 0, onionAddressV3Length)
+	address = append(address, publicKey...)
+	address = append(address, calculateOnionAddressV3Checksum(publicKey)...)
+	address = append(address, onionAddressV3Version)
+
+	return strings.ToLower(base32.StdEncoding.EncodeToString(address))
+}
+
+// ParseOnionAddressV3 returns the ed25519 identity public key of a v3 onion address after validating its version
+// and checksum, the ".onion" suffix is optional
+func ParseOnionAddressV3(address string) (ed25519.PublicKey, error) {
+	address = strings.TrimSuffix(strings.ToLower(address), ".onion")
+	if len(address) != 56 {
+		return nil, fmt.Errorf("invalid v3 onion address length %d", len(address))
+	}
+
+	decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(address))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode onion address: %v", err)
+	}
+
+	if decoded[onionAddressV3Length-1] != onionAddressV3Version {
+		return nil, fmt.Errorf("unsupported onion address version %d", decoded[onionAddressV3Length-1])
+	}
+
+	publicKey := ed25519.PublicKey(decoded[:ed25519.PublicKeySize])
+	if !bytes.Equal(decoded[ed25519.PublicKeySize:ed25519.PublicKeySize+2],
+		calculateOnionAddressV3Checksum(publicKey)) {
+		return nil, fmt.Errorf("invalid onion address checksum")
+	}
+
+	return publicKey, nil
+}
+
+// CHECKSUM = SHA3_256(".onion checksum" | PUBKEY | VERSION)[:2]
+func calculateOnionAddressV3Checksum(publicKey ed25519.PublicKey) []byte {
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(publicKey)
+	h.Write([]byte{onionAddressV3Version})
+
+	return h.Sum(nil)[:2]
+}
+
+// LoadEd25519KeysFromFile returns the ed25519 public key and expanded private key given a tor
+// hs_ed25519_secret_key file
+func LoadEd25519KeysFromFile(filePath string) (ed25519.PublicKey, []byte, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(data) != len(ed25519SecretKeyHeader)+64 || !bytes.HasPrefix(data, []byte(ed25519SecretKeyHeader)) {
+		return nil, nil, fmt.Errorf("not a tor ed25519 secret key file")
+	}
+
+	expandedKey := data[len(ed25519SecretKeyHeader):]
+
+	return Ed25519PublicKeyFromExpanded(expandedKey), expandedKey, nil
+}
+
+// ParseClientAuthPublicKey returns the x25519 public key of an authorized client given the contents of a tor
+// authorized_clients .auth file, "descriptor:x25519:<base32-encoded-public-key>"
+func ParseClientAuthPublicKey(data string) ([]byte, error) {
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, clientAuthKeyType) {
+		return nil, fmt.Errorf("unsupported client auth key type")
+	}
+
+	return decodeClientAuthKey(strings.TrimPrefix(data, clientAuthKeyType))
+}
+
+// ParseClientAuthPrivateKey returns the onion address and x25519 private key given the contents of a tor
+// .auth_private file, "<onion-address>:descriptor:x25519:<base32-encoded-private-key>"
+func ParseClientAuthPrivateKey(data string) (string, []byte, error) {
+	data = strings.TrimSpace(data)
+	i := strings.Index(data, ":")
+	if i == -1 {
+		return "", nil, fmt.Errorf("missing onion address")
+	}
+
+	address := strings.TrimSuffix(strings.ToLower(data[:i]), ".onion")
+	if _, err := ParseOnionAddressV3(address); err != nil {
+		return "", nil, err
+	}
+
+	if !strings.HasPrefix(data[i+1:], clientAuthKeyType) {
+		return "", nil, fmt.Errorf("unsupported client auth key type")
+	}
+
+	key, err := decodeClientAuthKey(strings.TrimPrefix(data[i+1:], clientAuthKeyType))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return address, key, nil
+}
+
+// decodeClientAuthKey decodes an unpadded base32 encoded x25519 key
+func decodeClientAuthKey(data string) ([]byte, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode client auth key: %v", err)
+	}
+
+	if len(key) != x25519KeyLength {
+		return nil, fmt.Errorf("invalid client auth key length %d", len(key))
+	}
+
+	return key, nil
+}
@@ -1,13 +1,16 @@
 package common
 
 import (
+	"bytes"
 	"crypto/rsa"
 	"encoding/base32"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 var rsaKey *rsa.PublicKey
@@ -130,3 +133,227 @@ func TestDescriptorIDValidUntil(t *testing.T) {
 		t.Errorf("want %v got %v", 50079, got)
 	}
 }
+
+func TestTimePeriodV3(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		time time.Time
+		want int64
+	}{
+		{"before rotation", time.Date(2016, 4, 13, 11, 0, 0, 0, time.UTC), 16903},
+		{"at rotation", time.Date(2016, 4, 13, 12, 0, 0, 0, time.UTC), 16904},
+		{"after rotation", time.Date(2016, 4, 13, 13, 0, 0, 0, time.UTC), 16904},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := TimePeriodV3(tt.time, TimePeriodLengthV3); got != tt.want {
+				t.Errorf("want %v got %v", tt.want, got)
+			}
+
+			start := TimePeriodStartV3(tt.want, TimePeriodLengthV3)
+			if tt.time.Before(start) || !tt.time.Before(start.Add(24*time.Hour)) {
+				t.Errorf("time %v not within period starting %v", tt.time, start)
+			}
+		})
+	}
+}
+
+func TestCalculateOnionAddressV3(t *testing.T) {
+	t.Parallel()
+
+	// Test vector from rend-spec-v3 using the RFC 8032 test 1 key
+	publicKey, _ := hex.DecodeString("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+	want := "25njqamcweflpvkl73j4szahhihoc4xt3ktcgjnpaingr5yhkenl5sid"
+
+	if got := CalculateOnionAddressV3(publicKey); got != want {
+		t.Errorf("want %v got %v", want, got)
+	}
+}
+
+func TestParseOnionAddressV3(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		address string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			address: "25njqamcweflpvkl73j4szahhihoc4xt3ktcgjnpaingr5yhkenl5sid",
+			want:    "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+		},
+		{
+			name:    "valid with suffix",
+			address: "25NJQAMCWEFLPVKL73J4SZAHHIHOC4XT3KTCGJNPAINGR5YHKENL5SID.onion",
+			want:    "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+		},
+		{
+			name:    "bad checksum",
+			address: "25njqamcweflpvkl73j4szahhihoc4xt3ktcgjnpaingr5yhkenl6sid",
+			wantErr: true,
+		},
+		{
+			name:    "bad version",
+			address: "25njqamcweflpvkl73j4szahhihoc4xt3ktcgjnpaingr5yhkenl5sic",
+			wantErr: true,
+		},
+		{
+			name:    "v2 address",
+			address: "7ctbljpgkiayaita",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseOnionAddressV3(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %v got %v", tt.wantErr, err)
+			}
+
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("want %v got %x", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadEd25519KeysFromFile(t *testing.T) {
+	t.Parallel()
+
+	publicKey, expandedKey, err := LoadEd25519KeysFromFile("../testdata/ed25519Key")
+	if err != nil {
+		t.Fatalf("failed to load keys: %v", err)
+	}
+
+	want := "xnbyhg3trrk2ti5y6pufov64vv2qqczmkczza4mnrobbuiyjbyu3tgid"
+	if got := CalculateOnionAddressV3(publicKey); got != want {
+		t.Errorf("want %v got %v", want, got)
+	}
+
+	if len(expandedKey) != 64 {
+		t.Errorf("want 64 byte expanded key got %v", len(expandedKey))
+	}
+
+	if _, _, err := LoadEd25519KeysFromFile("../testdata/rsaKey"); err == nil {
+		t.Errorf("expected error loading rsa key")
+	}
+}
+
+func TestParseClientAuthPublicKey(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		input string
+
+		expectedKey []byte
+		expectedErr bool
+	}{
+		{
+			"OK",
+			"descriptor:x25519:AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQTCQKRMFYYDENBWHA5DYPQ\n",
+			[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27,
+				28, 29, 30, 31},
+			false,
+		},
+		{
+			"unsupported key type",
+			"descriptor:ed25519:AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQTCQKRMFYYDENBWHA5DYPQ",
+			nil,
+			true,
+		},
+		{
+			"short key",
+			"descriptor:x25519:AAAQEAYEAUDAOCAJ",
+			nil,
+			true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseClientAuthPublicKey(tt.input)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("expected error %v got %v", tt.expectedErr, err)
+			}
+
+			if !bytes.Equal(got, tt.expectedKey) {
+				t.Errorf("expected %x got %x", tt.expectedKey, got)
+			}
+		})
+	}
+}
+
+func TestParseClientAuthPrivateKey(t *testing.T) {
+	t.Parallel()
+
+	address, key, err := ParseClientAuthPrivateKey(
+		"xnbyhg3trrk2ti5y6pufov64vv2qqczmkczza4mnrobbuiyjbyu3tgid:descriptor:x25519:" +
+			"AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQTCQKRMFYYDENBWHA5DYPQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if address != "xnbyhg3trrk2ti5y6pufov64vv2qqczmkczza4mnrobbuiyjbyu3tgid" {
+		t.Errorf("unexpected address %s", address)
+	}
+
+	if len(key) != 32 || key[31] != 31 {
+		t.Errorf("unexpected key %x", key)
+	}
+
+	if _, _, err := ParseClientAuthPrivateKey("descriptor:x25519:AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQTCQKRMFYYDENBWHA5DYPQ"); err == nil {
+		t.Error("expected missing onion address to fail")
+	}
+}
+
+func TestParseDescriptorCookie(t *testing.T) {
+	t.Parallel()
+
+	want := []byte{0x46, 0x2d, 0x5e, 0x48, 0xf3, 0x09, 0xe0, 0x18, 0xfc, 0x12, 0xf4, 0x64, 0x0f, 0x26, 0x7d, 0x68}
+
+	testCases := []struct {
+		name  string
+		input string
+
+		expected    []byte
+		expectedErr bool
+	}{
+		{"HidServAuth basic", "Ri1eSPMJ4Bj8EvRkDyZ9aA", want, false},
+		{"HidServAuth stealth", "Ri1eSPMJ4Bj8EvRkDyZ9aB", want, false},
+		{"client_keys", "Ri1eSPMJ4Bj8EvRkDyZ9aA==", want, false},
+		{"too short", "Ri1eSPMJ4Bj8EvRkDy", nil, true},
+		{"invalid base64", "Ri1eSPMJ4Bj8EvRkDyZ9a!", nil, true},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseDescriptorCookie(tt.input)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("expected error %v got %v", tt.expectedErr, err)
+			}
+
+			if !bytes.Equal(got, tt.expected) {
+				t.Errorf("expected %x got %x", tt.expected, got)
+			}
+		})
+	}
+}
@@ -3,30 +3,517 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+	"github.com/csucu/onionspread/descriptor"
+	"github.com/csucu/onionspread/onion"
 )
 
 // Config holds the configuration for the application
 type Config struct {
-	Address             string    `json:"Address"`
-	ControlPortPassword string    `json:"ControlPortPassword"`
-	Services            []Service `json:"Services"`
-	LogFilePath         string    `json:"LogFilePath"`
+	// Address is the control port as host:port or a unix socket as unix:/path
+	Address string `json:"Address"`
+	// Addresses are the control ports of more tor instances, fetches fail over between all of them
+	Addresses []string `json:"Addresses"`
+	// PublishMode is "spread" to post every descriptor through one of the tor instances or "mirror" to post it
+	// through all of them, it defaults to "spread"
+	PublishMode         string `json:"PublishMode"`
+	ControlPortPassword string `json:"ControlPortPassword"`
+	// ControlPortAuth is "null", "password", "cookie" or "safecookie", the best method tor offers is used by
+	// default
+	ControlPortAuth string `json:"ControlPortAuth"`
+	// ControlPortCookiePath overrides the path of the cookie file tor reports
+	ControlPortCookiePath string    `json:"ControlPortCookiePath"`
+	Services              []Service `json:"Services"`
+	LogFilePath           string    `json:"LogFilePath"`
+	StateFilePath         string    `json:"StateFilePath"`
+	// SocksAddress is the tor SOCKS port used for health checks
+	SocksAddress string `json:"SocksAddress"`
+	// MaxConcurrentFetches limits the backend descriptors that are fetched at once, it defaults to 8
+	MaxConcurrentFetches int `json:"MaxConcurrentFetches"`
+	// HighAvailability lets only the leader of several onionspread instances publish descriptors
+	HighAvailability *HighAvailability `json:"HighAvailability"`
+}
+
+// HighAvailability configures the lease the instances elect their leader with, either LeaseFile or LeaseURL is set
+type HighAvailability struct {
+	// Holder identifies the instance, it defaults to the hostname
+	Holder string `json:"Holder"`
+	// LeaseFile is the path of the lease on a file system shared by the instances
+	LeaseFile string `json:"LeaseFile"`
+	// LeaseURL is the URL of an HTTP lease server
+	LeaseURL string `json:"LeaseURL"`
+	// FailoverTime is a duration such as "1m" within which a standby takes over, it defaults to 1 minute
+	FailoverTime string `json:"FailoverTime"`
+}
+
+// maxConcurrentFetches returns the limit of descriptor fetches that are in flight at once
+func (c *Config) maxConcurrentFetches() int {
+	if c.MaxConcurrentFetches == 0 {
+		return onion.DefaultMaxConcurrentFetches
+	}
+
+	return c.MaxConcurrentFetches
+}
+
+// controlAddresses returns the addresses of the control ports of all the tor instances
+func (c *Config) controlAddresses() []string {
+	var addresses []string
+	if c.Address != "" {
+		addresses = append(addresses, c.Address)
+	}
+
+	return append(addresses, c.Addresses...)
+}
+
+// publishMode returns how descriptors are published through the tor instances
+func (c *Config) publishMode() string {
+	if c.PublishMode == "" {
+		return onion.PublishSpread
+	}
+
+	return c.PublishMode
+}
+
+// controlAuth returns how the controller authenticates to tor
+func (c *Config) controlAuth() onion.ControlAuth {
+	return onion.ControlAuth{
+		Method:     c.ControlPortAuth,
+		Password:   c.ControlPortPassword,
+		CookiePath: c.ControlPortCookiePath,
+	}
 }
 
 // Service represents a hidden service that will be balanced
 type Service struct {
 	PrivateKeyPath   string   `json:"PrivateKeyPath"`
 	BackendAddresses []string `json:"BackendAddresses"`
+	// Version is 2 or 3, when it is left out isValid sets it from the private key
+	Version int `json:"Version"`
+
+	// AuthorizedClients are the contents of tor authorized_clients .auth files, one per client
+	AuthorizedClients []string `json:"AuthorizedClients"`
+	// BackendClientAuthKeys are the contents of tor .auth_private files for auth protected backends
+	BackendClientAuthKeys []string `json:"BackendClientAuthKeys"`
+
+	// ClientAuthType is "basic" or "stealth" to restrict a v2 service to Clients
+	ClientAuthType string   `json:"ClientAuthType"`
+	Clients        []Client `json:"Clients"`
+
+	// MaxDescriptorAge is a duration such as "3h", v2 backends with older descriptors are left out
+	MaxDescriptorAge string `json:"MaxDescriptorAge"`
+
+	// HealthCheck enables checking that the backends are reachable
+	HealthCheck *HealthCheck `json:"HealthCheck"`
+
+	// IntroductionPointSelection is the strategy used to pick the introduction points of the descriptors, one of
+	// "round-robin", "shuffle", "weighted", "max-per-backend" or "diversity"
+	IntroductionPointSelection string `json:"IntroductionPointSelection"`
+	// BackendWeights are the weights of the "weighted" strategy, backends that are left out have a weight of 1
+	BackendWeights map[string]int `json:"BackendWeights"`
+	// MaxIntroductionPointsPerBackend is the limit of the "max-per-backend" strategy
+	MaxIntroductionPointsPerBackend int `json:"MaxIntroductionPointsPerBackend"`
+
+	// PublishRetry configures how uploads the hsdirs didn't accept are retried
+	PublishRetry *PublishRetry `json:"PublishRetry"`
+}
+
+// PublishRetry configures the retries of descriptor uploads, values that are left out keep their defaults
+type PublishRetry struct {
+	// MaxAttempts is how often a descriptor is uploaded to an hsdir at most, 1 disables retries
+	MaxAttempts int `json:"MaxAttempts"`
+	// InitialBackoff and MaxBackoff are durations such as "30s", the backoff doubles with every retry up to
+	// MaxBackoff
+	InitialBackoff string `json:"InitialBackoff"`
+	MaxBackoff     string `json:"MaxBackoff"`
+	// Jitter is the fraction by which the backoff is randomly changed, between 0 and 1
+	Jitter *float64 `json:"Jitter"`
+}
+
+// HealthCheck configures how the backends of a service are checked through tor
+type HealthCheck struct {
+	// Type is "tcp" to only connect to Port or "http" to also GET Path, it defaults to "tcp"
+	Type string `json:"Type"`
+	Port int    `json:"Port"`
+	Path string `json:"Path"`
+	// Interval and Timeout are durations such as "1m", they default to 1 minute and 30 seconds
+	Interval string `json:"Interval"`
+	Timeout  string `json:"Timeout"`
+}
+
+// Client is a client authorized to use a v2 service
+type Client struct {
+	Name string `json:"Name"`
+	// DescriptorCookie is the auth-cookie of the client's HidServAuth line
+	DescriptorCookie string `json:"DescriptorCookie"`
+	// PrivateKeyPath is the client specific service key used with stealth authorization
+	PrivateKeyPath string `json:"PrivateKeyPath"`
+}
+
+// clientAuthV2 returns the v2 client authorization of the service
+func (s *Service) clientAuthV2() (onion.ClientAuthV2, error) {
+	var clientAuth onion.ClientAuthV2
+	switch s.ClientAuthType {
+	case "":
+		return clientAuth, nil
+	case "basic":
+		clientAuth.Type = descriptor.ClientAuthBasic
+		if len(s.Clients) > descriptor.MaxClientsBasic {
+			return clientAuth, fmt.Errorf("only a maximum of %d basic auth clients is allowed", descriptor.MaxClientsBasic)
+		}
+	case "stealth":
+		clientAuth.Type = descriptor.ClientAuthStealth
+		if len(s.Clients) > descriptor.MaxClientsStealth {
+			return clientAuth, fmt.Errorf("only a maximum of %d stealth auth clients is allowed",
+				descriptor.MaxClientsStealth)
+		}
+	default:
+		return clientAuth, fmt.Errorf("unknown client auth type %s", s.ClientAuthType)
+	}
+
+	if len(s.Clients) == 0 {
+		return clientAuth, errors.New("client auth requires at least one client")
+	}
+
+	for _, client := range s.Clients {
+		descriptorCookie, err := common.ParseDescriptorCookie(client.DescriptorCookie)
+		if err != nil {
+			return clientAuth, fmt.Errorf("client %s: %v", client.Name, err)
+		}
+
+		clientV2 := onion.ClientV2{
+			Name:             client.Name,
+			DescriptorCookie: descriptorCookie,
+		}
+
+		if clientAuth.Type == descriptor.ClientAuthStealth {
+			if client.PrivateKeyPath == "" {
+				return clientAuth, fmt.Errorf("client %s: missing private key path", client.Name)
+			}
+
+			clientV2.PublicKey, clientV2.PrivateKey, err = common.LoadKeysFromFile(client.PrivateKeyPath)
+			if err != nil {
+				return clientAuth, fmt.Errorf("client %s: failed to load keys from file: %v", client.Name, err)
+			}
+		}
+
+		clientAuth.Clients = append(clientAuth.Clients, clientV2)
+	}
+
+	return clientAuth, nil
+}
+
+// clientAuthV3 returns the v3 client authorization keys of the service
+func (s *Service) clientAuthV3() (onion.ClientAuthV3, error) {
+	clientAuth := onion.ClientAuthV3{
+		BackendKeys: make(map[string][]byte),
+	}
+
+	for _, authorizedClient := range s.AuthorizedClients {
+		key, err := common.ParseClientAuthPublicKey(authorizedClient)
+		if err != nil {
+			return onion.ClientAuthV3{}, fmt.Errorf("invalid authorized client: %v", err)
+		}
+
+		clientAuth.AuthorizedClients = append(clientAuth.AuthorizedClients, key)
+	}
+
+	for _, backendKey := range s.BackendClientAuthKeys {
+		address, key, err := common.ParseClientAuthPrivateKey(backendKey)
+		if err != nil {
+			return onion.ClientAuthV3{}, fmt.Errorf("invalid backend client auth key: %v", err)
+		}
+
+		clientAuth.BackendKeys[address] = key
+	}
+
+	return clientAuth, nil
+}
+
+// backendWeights returns the configured backend weights keyed by the address without the .onion suffix
+func (s *Service) backendWeights() (map[string]int, error) {
+	if len(s.BackendWeights) == 0 {
+		return nil, nil
+	}
+
+	backends := make(map[string]bool)
+	for _, address := range s.BackendAddresses {
+		backends[strings.TrimSuffix(strings.ToLower(address), ".onion")] = true
+	}
+
+	weights := make(map[string]int)
+	for address, weight := range s.BackendWeights {
+		address = strings.TrimSuffix(strings.ToLower(address), ".onion")
+		if !backends[address] {
+			return nil, fmt.Errorf("weighted backend %s is not one of the backend addresses", address)
+		}
+
+		if weight < 1 {
+			return nil, fmt.Errorf("weight of backend %s must be positive", address)
+		}
+
+		weights[address] = weight
+	}
+
+	return weights, nil
+}
+
+// selector returns the introduction point selection strategy of the service, weighted when only backend weights
+// are configured and round robin otherwise. families is used by the diversity selection and may be nil.
+func (s *Service) selector(families descriptor.RelayFamilies) (descriptor.IntroductionPointSelector, error) {
+	selection := s.IntroductionPointSelection
+	if selection == "" && len(s.BackendWeights) > 0 {
+		selection = descriptor.SelectionWeighted
+	}
+
+	switch selection {
+	case "", descriptor.SelectionRoundRobin:
+		return &descriptor.RoundRobinSelector{}, nil
+	case descriptor.SelectionShuffle:
+		return descriptor.NewShuffleSelector(), nil
+	case descriptor.SelectionWeighted:
+		weights, err := s.backendWeights()
+		if err != nil {
+			return nil, err
+		}
+
+		return descriptor.NewWeightedSelector(weights), nil
+	case descriptor.SelectionMaxPerBackend:
+		if s.MaxIntroductionPointsPerBackend < 1 {
+			return nil, errors.New("max-per-backend selection requires a positive MaxIntroductionPointsPerBackend")
+		}
+
+		return descriptor.NewMaxPerBackendSelector(s.MaxIntroductionPointsPerBackend), nil
+	case descriptor.SelectionDiversity:
+		return descriptor.NewDiversitySelector(families), nil
+	}
+
+	return nil, fmt.Errorf("unknown introduction point selection %s", selection)
+}
+
+// maxDescriptorAge returns the parsed MaxDescriptorAge of the service, zero if it isn't configured
+func (s *Service) maxDescriptorAge() (time.Duration, error) {
+	if s.MaxDescriptorAge == "" {
+		return 0, nil
+	}
+
+	maxAge, err := time.ParseDuration(s.MaxDescriptorAge)
+	if err != nil {
+		return 0, fmt.Errorf("invalid max descriptor age: %v", err)
+	}
+
+	if maxAge <= 0 {
+		return 0, errors.New("max descriptor age must be positive")
+	}
+
+	return maxAge, nil
+}
+
+// retryPolicy returns the retry policy of the service's uploads, the default one if it isn't configured
+func (s *Service) retryPolicy() (onion.RetryPolicy, error) {
+	policy := onion.DefaultRetryPolicy()
+	if s.PublishRetry == nil {
+		return policy, nil
+	}
+
+	var err error
+	retry := s.PublishRetry
+	if retry.MaxAttempts != 0 {
+		policy.MaxAttempts = retry.MaxAttempts
+	}
+
+	if retry.InitialBackoff != "" {
+		if policy.InitialBackoff, err = time.ParseDuration(retry.InitialBackoff); err != nil {
+			return policy, fmt.Errorf("invalid publish retry initial backoff: %v", err)
+		}
+	}
+
+	if retry.MaxBackoff != "" {
+		if policy.MaxBackoff, err = time.ParseDuration(retry.MaxBackoff); err != nil {
+			return policy, fmt.Errorf("invalid publish retry max backoff: %v", err)
+		}
+	}
+
+	if retry.Jitter != nil {
+		policy.Jitter = *retry.Jitter
+	}
+
+	if policy.MaxAttempts < 1 {
+		return policy, errors.New("publish retry max attempts must be positive")
+	}
+
+	if policy.InitialBackoff <= 0 || policy.MaxBackoff < policy.InitialBackoff {
+		return policy, errors.New("publish retry backoffs must be positive and the max backoff at least the " +
+			"initial one")
+	}
+
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return policy, errors.New("publish retry jitter must be between 0 and 1")
+	}
+
+	return policy, nil
+}
+
+// checkType returns the configured health check type or the default
+func (h *HealthCheck) checkType() string {
+	if h.Type == "" {
+		return onion.HealthCheckTCP
+	}
+
+	return h.Type
+}
+
+// intervalAndTimeout returns the parsed Interval and Timeout of the health check or their defaults
+func (h *HealthCheck) intervalAndTimeout() (time.Duration, time.Duration, error) {
+	interval, timeout := time.Minute, 30*time.Second
+
+	var err error
+	if h.Interval != "" {
+		if interval, err = time.ParseDuration(h.Interval); err != nil {
+			return 0, 0, fmt.Errorf("invalid health check interval: %v", err)
+		}
+	}
+
+	if h.Timeout != "" {
+		if timeout, err = time.ParseDuration(h.Timeout); err != nil {
+			return 0, 0, fmt.Errorf("invalid health check timeout: %v", err)
+		}
+	}
+
+	if interval <= 0 || timeout <= 0 {
+		return 0, 0, errors.New("health check interval and timeout must be positive")
+	}
+
+	return interval, timeout, nil
+}
+
+// isValid verifies the values of the health check
+func (h *HealthCheck) isValid() error {
+	if h.checkType() != onion.HealthCheckTCP && h.checkType() != onion.HealthCheckHTTP {
+		return fmt.Errorf("unknown health check type %s", h.Type)
+	}
+
+	if h.Port <= 0 || h.Port > 65535 {
+		return fmt.Errorf("invalid health check port %d", h.Port)
+	}
+
+	_, _, err := h.intervalAndTimeout()
+
+	return err
+}
+
+// holder returns the configured lease holder or the hostname
+func (h *HighAvailability) holder() (string, error) {
+	if h.Holder != "" {
+		return h.Holder, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname for the lease holder: %v", err)
+	}
+
+	return hostname, nil
+}
+
+// failoverTime returns the parsed FailoverTime or its default
+func (h *HighAvailability) failoverTime() (time.Duration, error) {
+	if h.FailoverTime == "" {
+		return time.Minute, nil
+	}
+
+	failoverTime, err := time.ParseDuration(h.FailoverTime)
+	if err != nil {
+		return 0, fmt.Errorf("invalid failover time: %v", err)
+	}
+
+	if failoverTime <= 0 {
+		return 0, errors.New("failover time must be positive")
+	}
+
+	return failoverTime, nil
+}
+
+// lease returns the configured lease, requests to a lease server time out before the next renewal is due
+func (h *HighAvailability) lease(failoverTime time.Duration) onion.Lease {
+	if h.LeaseFile != "" {
+		return onion.NewFileLease(h.LeaseFile)
+	}
+
+	return onion.NewHTTPLease(h.LeaseURL, failoverTime/4)
+}
+
+// isValid verifies the values of the high availability configuration
+func (h *HighAvailability) isValid() error {
+	if (h.LeaseFile == "") == (h.LeaseURL == "") {
+		return errors.New("high availability requires either a lease file or a lease URL")
+	}
+
+	if h.LeaseURL != "" && !strings.HasPrefix(h.LeaseURL, "http://") && !strings.HasPrefix(h.LeaseURL, "https://") {
+		return fmt.Errorf("invalid lease URL %s", h.LeaseURL)
+	}
+
+	if _, err := h.holder(); err != nil {
+		return err
+	}
+
+	_, err := h.failoverTime()
+
+	return err
+}
+
+// detectVersion returns the onion service version of the private key of the service, 3 when it is an ed25519 key
+// and 2 otherwise
+func (s *Service) detectVersion() int {
+	if _, _, err := common.LoadEd25519KeysFromFile(s.PrivateKeyPath); err == nil {
+		return 3
+	}
+
+	return 2
 }
 
 // isValid verifies the values in the config
 func (c *Config) isValid() error {
-	if c.Address == "" {
+	if len(c.controlAddresses()) == 0 {
 		return errors.New("missing address")
 	}
 
-	for _, onion := range c.Services {
+	for _, address := range c.controlAddresses() {
+		if address == "" || address == "unix:" {
+			return errors.New("empty control port address")
+		}
+	}
+
+	if c.publishMode() != onion.PublishSpread && c.publishMode() != onion.PublishMirror {
+		return fmt.Errorf("unknown publish mode %s", c.PublishMode)
+	}
+
+	switch c.ControlPortAuth {
+	case "", onion.AuthNull, onion.AuthCookie, onion.AuthSafeCookie:
+	case onion.AuthPassword:
+		if c.ControlPortPassword == "" {
+			return errors.New("password authentication requires a control port password")
+		}
+	default:
+		return fmt.Errorf("unknown control port authentication %s", c.ControlPortAuth)
+	}
+
+	if c.MaxConcurrentFetches < 0 {
+		return errors.New("MaxConcurrentFetches can't be negative")
+	}
+
+	if c.HighAvailability != nil {
+		if err := c.HighAvailability.isValid(); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.Services {
+		onion := &c.Services[i]
 		if onion.PrivateKeyPath == "" {
 			return errors.New("missing private key path")
 		}
@@ -34,6 +521,73 @@ func (c *Config) isValid() error {
 		if len(onion.BackendAddresses) > 60 {
 			return errors.New("only a maximum of 60 backend instances is allowed")
 		}
+
+		if onion.Version != 0 && onion.Version != 2 && onion.Version != 3 {
+			return fmt.Errorf("unsupported service version %d", onion.Version)
+		}
+
+		// the key file is only loaded once to detect the version
+		if onion.Version == 0 {
+			onion.Version = onion.detectVersion()
+		}
+
+		addressLength := 16
+		if onion.Version == 3 {
+			addressLength = 56
+		}
+
+		if onion.Version != 3 && (len(onion.AuthorizedClients) > 0 || len(onion.BackendClientAuthKeys) > 0) {
+			return errors.New("x25519 client authorization is only supported by v3 services")
+		}
+
+		if onion.Version == 3 && onion.ClientAuthType != "" {
+			return errors.New("basic and stealth client authorization is only supported by v2 services")
+		}
+
+		// v3 descriptors don't carry a publication time
+		if onion.Version == 3 && onion.MaxDescriptorAge != "" {
+			return errors.New("max descriptor age is only supported by v2 services")
+		}
+
+		if _, err := onion.backendWeights(); err != nil {
+			return err
+		}
+
+		if _, err := onion.selector(nil); err != nil {
+			return err
+		}
+
+		if _, err := onion.maxDescriptorAge(); err != nil {
+			return err
+		}
+
+		if _, err := onion.retryPolicy(); err != nil {
+			return err
+		}
+
+		if onion.HealthCheck != nil {
+			if c.SocksAddress == "" {
+				return errors.New("health checks require a socks address")
+			}
+
+			if err := onion.HealthCheck.isValid(); err != nil {
+				return err
+			}
+		}
+
+		if _, err := onion.clientAuthV3(); err != nil {
+			return err
+		}
+
+		if _, err := onion.clientAuthV2(); err != nil {
+			return err
+		}
+
+		for _, address := range onion.BackendAddresses {
+			if len(strings.TrimSuffix(address, ".onion")) != addressLength {
+				return fmt.Errorf("backend address %s is not a v%d address", address, onion.Version)
+			}
+		}
 	}
 
 	return nil
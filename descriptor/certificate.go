@@ -0,0 +1,154 @@
+package descriptor
+
+import (
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Certificate types as defined in https://github.com/torproject/torspec/blob/master/cert-spec.txt
+const (
+	CertTypeSigningKey   byte = 0x08
+	CertTypeAuthKey      byte = 0x09
+	CertTypeEncKey       byte = 0x0B
+	certVersion          byte = 0x01
+	certKeyTypeEd25519   byte = 0x01
+	certExtSignedWithKey byte = 0x04
+)
+
+// Ed25519Certificate represents an ed25519 certificate as defined in
+// https://github.com/torproject/torspec/blob/master/cert-spec.txt
+type Ed25519Certificate struct {
+	Version        byte
+	Type           byte
+	ExpirationDate time.Time
+	KeyType        byte
+	CertifiedKey   ed25519.PublicKey
+	Extensions     []Ed25519CertificateExtension
+	Signature      []byte
+	Raw            []byte
+}
+
+// Ed25519CertificateExtension represents a single certificate extension
+type Ed25519CertificateExtension struct {
+	Type  byte
+	Flags byte
+	Data  []byte
+}
+
+// ParseEd25519Certificate parses a binary encoded ed25519 certificate
+func ParseEd25519Certificate(data []byte) (*Ed25519Certificate, error) {
+	// VERSION | CERT_TYPE | EXPIRATION_DATE | CERT_KEY_TYPE | CERTIFIED_KEY | N_EXTENSIONS
+	if len(data) < 40 {
+		return nil, errors.New("certificate is too short")
+	}
+
+	cert := &Ed25519Certificate{
+		Version:        data[0],
+		Type:           data[1],
+		ExpirationDate: time.Unix(int64(binary.BigEndian.Uint32(data[2:6]))*3600, 0).UTC(),
+		KeyType:        data[6],
+		CertifiedKey:   ed25519.PublicKey(data[7:39]),
+		Raw:            data,
+	}
+
+	if cert.Version != certVersion {
+		return nil, fmt.Errorf("unknown certificate version %d", cert.Version)
+	}
+
+	nExtensions := int(data[39])
+	rest := data[40:]
+	for i := 0; i < nExtensions; i++ {
+		if len(rest) < 4 {
+			return nil, errors.New("certificate extension is truncated")
+		}
+
+		extLength := int(binary.BigEndian.Uint16(rest[0:2]))
+		if len(rest) < 4+extLength {
+			return nil, errors.New("certificate extension data is truncated")
+		}
+
+		cert.Extensions = append(cert.Extensions, Ed25519CertificateExtension{
+			Type:  rest[2],
+			Flags: rest[3],
+			Data:  rest[4 : 4+extLength],
+		})
+		rest = rest[4+extLength:]
+	}
+
+	if len(rest) != ed25519.SignatureSize {
+		return nil, errors.New("invalid certificate signature length")
+	}
+	cert.Signature = rest
+
+	return cert, nil
+}
+
+// parseEd25519CertificatePEM parses a PEM encoded ed25519 certificate
+func parseEd25519CertificatePEM(data string) (*Ed25519Certificate, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "ED25519 CERT" {
+		return nil, errors.New("failed to decode ed25519 certificate PEM")
+	}
+
+	return ParseEd25519Certificate(block.Bytes)
+}
+
+// SigningKey returns the key contained in the signed-with-ed25519-key extension, nil if the extension is missing
+func (c *Ed25519Certificate) SigningKey() ed25519.PublicKey {
+	for _, ext := range c.Extensions {
+		if ext.Type == certExtSignedWithKey && len(ext.Data) == ed25519.PublicKeySize {
+			return ed25519.PublicKey(ext.Data)
+		}
+	}
+
+	return nil
+}
+
+// Verify checks the certificate signature against the given key, if the key is nil the key from the
+// signed-with-ed25519-key extension is used
+func (c *Ed25519Certificate) Verify(signingKey ed25519.PublicKey) error {
+	if signingKey == nil {
+		signingKey = c.SigningKey()
+		if signingKey == nil {
+			return errors.New("certificate has no signing key")
+		}
+	}
+
+	if !ed25519.Verify(signingKey, c.Raw[:len(c.Raw)-ed25519.SignatureSize], c.Signature) {
+		return errors.New("invalid certificate signature")
+	}
+
+	return nil
+}
+
+// newEd25519Certificate creates a certificate of certType for certifiedKey that includes the
+// signed-with-ed25519-key extension, sign is called with the encoded certificate to produce its signature
+func newEd25519Certificate(certType byte, certifiedKey, signingKey ed25519.PublicKey, expiration time.Time,
+	sign func([]byte) []byte) (*Ed25519Certificate, error) {
+	// Expiration is in hours since the epoch, round up so the certificate is valid for at least the given time
+	expirationHours := (expiration.Unix() + 3599) / 3600
+
+	encoded := make([]byte, 0, 40+4+ed25519.PublicKeySize+ed25519.SignatureSize)
+	encoded = append(encoded, certVersion, certType)
+	encoded = append(encoded, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(encoded[2:6], uint32(expirationHours))
+	encoded = append(encoded, certKeyTypeEd25519)
+	encoded = append(encoded, certifiedKey...)
+
+	// One extension, the key the certificate is signed with
+	encoded = append(encoded, 1, 0, ed25519.PublicKeySize, certExtSignedWithKey, 0)
+	encoded = append(encoded, signingKey...)
+	encoded = append(encoded, sign(encoded)...)
+
+	return ParseEd25519Certificate(encoded)
+}
+
+// encodePEM returns the PEM encoding of the certificate
+func (c *Ed25519Certificate) encodePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "ED25519 CERT", Bytes: c.Raw})
+}
@@ -0,0 +1,119 @@
+package descriptor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consensus represents a network status consensus document as defined in
+// https://gitweb.torproject.org/torspec.git/plain/dir-spec.txt
+type Consensus struct {
+	ValidAfter              time.Time
+	FreshUntil              time.Time
+	ValidUntil              time.Time
+	SharedRandCurrentValue  []byte
+	SharedRandPreviousValue []byte
+	Params                  map[string]int
+	RouterStatusEntries     []RouterStatusEntry
+}
+
+// Param returns the value of a consensus parameter or defaultValue if it isn't set
+func (c *Consensus) Param(name string, defaultValue int) int {
+	if value, ok := c.Params[name]; ok {
+		return value
+	}
+
+	return defaultValue
+}
+
+// ParseConsensus parses a ns or microdesc flavoured consensus document, returning the header together with the
+// router status entries
+func ParseConsensus(data string) (*Consensus, error) {
+	data = strings.Replace(data, "\r\n", "\n", -1)
+
+	header := data
+	routerStatusEntriesRaw := ""
+	if start := strings.Index(data, "\nr "); start >= 0 {
+		header = data[:start+1]
+		routerStatusEntriesRaw = data[start+1:]
+	}
+
+	if end := strings.Index(routerStatusEntriesRaw, "\ndirectory-footer"); end >= 0 {
+		routerStatusEntriesRaw = routerStatusEntriesRaw[:end+1]
+	}
+
+	consensus := &Consensus{
+		Params: make(map[string]int),
+	}
+
+	var err error
+	for _, line := range strings.Split(header, "\n") {
+		words := strings.Split(strings.TrimSpace(line), " ")
+		switch words[0] {
+		case "network-status-version":
+			if len(words) < 2 || words[1] != "3" {
+				return nil, errors.New("unsupported consensus version")
+			}
+		case "valid-after":
+			consensus.ValidAfter, err = parseConsensusTime(words)
+		case "fresh-until":
+			consensus.FreshUntil, err = parseConsensusTime(words)
+		case "valid-until":
+			consensus.ValidUntil, err = parseConsensusTime(words)
+		case "shared-rand-current-value":
+			consensus.SharedRandCurrentValue, err = parseSharedRandomValue(words)
+		case "shared-rand-previous-value":
+			consensus.SharedRandPreviousValue, err = parseSharedRandomValue(words)
+		case "params":
+			for _, param := range words[1:] {
+				keyValue := strings.SplitN(param, "=", 2)
+				if len(keyValue) != 2 {
+					return nil, fmt.Errorf("malformed consensus param %v", param)
+				}
+
+				consensus.Params[keyValue[0]], err = strconv.Atoi(keyValue[1])
+				if err != nil {
+					return nil, fmt.Errorf("malformed consensus param %v", param)
+				}
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if consensus.ValidAfter.IsZero() || consensus.ValidUntil.IsZero() {
+		return nil, errors.New("consensus is missing required fields")
+	}
+
+	if routerStatusEntriesRaw != "" {
+		consensus.RouterStatusEntries, err = ParseRouterStatusEntriesRaw(routerStatusEntriesRaw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse router status entries: %v", err)
+		}
+	}
+
+	return consensus, nil
+}
+
+// parseConsensusTime parses a "keyword YYYY-MM-DD HH:MM:SS" line
+func parseConsensusTime(words []string) (time.Time, error) {
+	if len(words) < 3 {
+		return time.Time{}, fmt.Errorf("missing time for %v", words[0])
+	}
+
+	return time.Parse("2006-01-02 15:04:05", strings.Join(words[1:3], " "))
+}
+
+// parseSharedRandomValue parses a "keyword NumReveals Value" line
+func parseSharedRandomValue(words []string) ([]byte, error) {
+	if len(words) < 3 {
+		return nil, fmt.Errorf("missing shared random value for %v", words[0])
+	}
+
+	return decodeBase64(words[2])
+}
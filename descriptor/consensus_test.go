@@ -0,0 +1,127 @@
+package descriptor
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConsensus(t *testing.T) {
+	t.Parallel()
+
+	consensusRaw, err := ioutil.ReadFile("../testdata/consensus-microdesc.txt")
+	if err != nil {
+		t.Fatalf("failed to read consensus: %v", err)
+	}
+
+	got, err := ParseConsensus(string(consensusRaw))
+	if err != nil {
+		t.Fatalf("failed to parse consensus: %v", err)
+	}
+
+	if want := time.Date(2018, 8, 14, 9, 0, 0, 0, time.UTC); !got.ValidAfter.Equal(want) {
+		t.Errorf("expected valid-after %v got %v", want, got.ValidAfter)
+	}
+
+	if want := time.Date(2018, 8, 14, 10, 0, 0, 0, time.UTC); !got.FreshUntil.Equal(want) {
+		t.Errorf("expected fresh-until %v got %v", want, got.FreshUntil)
+	}
+
+	if want := time.Date(2018, 8, 14, 12, 0, 0, 0, time.UTC); !got.ValidUntil.Equal(want) {
+		t.Errorf("expected valid-until %v got %v", want, got.ValidUntil)
+	}
+
+	wantPreviousSRV, _ := base64.StdEncoding.DecodeString("yhcXvIftYhtP6ZoHYQLHy8JjW2t3KcGlMSP1CWsYVhU=")
+	if !reflect.DeepEqual(wantPreviousSRV, got.SharedRandPreviousValue) {
+		t.Errorf("expected previous srv %x got %x", wantPreviousSRV, got.SharedRandPreviousValue)
+	}
+
+	wantCurrentSRV, _ := base64.StdEncoding.DecodeString("3D9zQ7DcZ5Yt0qnm9I0s7E5d/SmWVgoDjEHeIcAtRoY=")
+	if !reflect.DeepEqual(wantCurrentSRV, got.SharedRandCurrentValue) {
+		t.Errorf("expected current srv %x got %x", wantCurrentSRV, got.SharedRandCurrentValue)
+	}
+
+	if got.Param("hsdir_spread_store", 0) != 4 {
+		t.Errorf("expected hsdir_spread_store 4 got %v", got.Param("hsdir_spread_store", 0))
+	}
+
+	if got.Param("hsdir_n_replicas", 2) != 2 {
+		t.Errorf("expected default hsdir_n_replicas 2 got %v", got.Param("hsdir_n_replicas", 2))
+	}
+
+	if len(got.RouterStatusEntries) != 8 {
+		t.Fatalf("expected 8 router status entries got %v", len(got.RouterStatusEntries))
+	}
+
+	wantEntry := RouterStatusEntry{
+		Nickname:    "moria1",
+		Fingerprint: "424B97F6C9589C0E90CBF4F9E568ADDDF7422085",
+		Published:   time.Date(2018, 8, 14, 0, 0, 0, 0, time.UTC),
+		Address:     net.ParseIP("128.31.0.34"),
+		ORPort:      9101,
+		DirPort:     9131,
+		Flags: RouterFlags{
+			Authority: true,
+			Fast:      true,
+			HSDir:     true,
+			Running:   true,
+			Stable:    true,
+			V2Dir:     true,
+			Valid:     true,
+		},
+		Version:               "0.3.3.9",
+		Bandwidth:             1000,
+		MicrodescriptorDigest: "mXoKsBXr5CsIv+bGRLLaJkTIR4HFGplAmyU+C90D9bc",
+	}
+
+	if !reflect.DeepEqual(wantEntry, got.RouterStatusEntries[0]) {
+		t.Errorf("expected %#v got %#v", wantEntry, got.RouterStatusEntries[0])
+	}
+}
+
+func TestParseConsensusErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		input string
+	}{
+		{
+			name:  "unsupported version",
+			input: "network-status-version 2\nvalid-after 2018-08-14 09:00:00\nvalid-until 2018-08-14 12:00:00\n",
+		},
+		{
+			name:  "missing valid-until",
+			input: "network-status-version 3 microdesc\nvalid-after 2018-08-14 09:00:00\n",
+		},
+		{
+			name: "malformed param",
+			input: "network-status-version 3\nvalid-after 2018-08-14 09:00:00\nvalid-until 2018-08-14 12:00:00\n" +
+				"params hsdir_spread_store\n",
+		},
+		{
+			name: "malformed shared random value",
+			input: "network-status-version 3\nvalid-after 2018-08-14 09:00:00\nvalid-until 2018-08-14 12:00:00\n" +
+				"shared-rand-current-value 9\n",
+		},
+		{
+			name: "malformed router status entry",
+			input: "network-status-version 3\nvalid-after 2018-08-14 09:00:00\nvalid-until 2018-08-14 12:00:00\n" +
+				"r moria1 QkuX9slYnA6Qy/T55Wit3fdCIIU 2018-08-14\n",
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := ParseConsensus(tt.input); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/x509"
 	"encoding/asn1"
 	"encoding/pem"
 	"errors"
@@ -18,6 +19,9 @@ import (
 	"github.com/csucu/onionspread/common"
 )
 
+// replicaSetSize is the number of replicas a v2 descriptor is published under
+const replicaSetSize = 2
+
 // HiddenServiceDescriptor represents a v2 hidden service descriptor as defined in
 // https://github.com/torproject/torspec/blob/master/rend-spec-v2.txt
 type HiddenServiceDescriptor struct {
@@ -30,6 +34,7 @@ type HiddenServiceDescriptor struct {
 	IntroductionPointsRaw string
 	IntroductionPoints    []IntroductionPoint
 	Signature             string
+	Raw                   string
 }
 
 // IntroductionPoint represents a introduction point
@@ -81,9 +86,90 @@ func ParseHiddenServiceDescriptor(descriptorRaw string) (*HiddenServiceDescripto
 		}
 	}
 
+	descriptor.Raw = descriptorRaw
+
 	return descriptor, nil
 }
 
+// permanentPublicKey parses the permanent key of the descriptor
+func (d *HiddenServiceDescriptor) permanentPublicKey() (*rsa.PublicKey, error) {
+	keyBlock, _ := pem.Decode([]byte(d.PermanentKey))
+	if keyBlock == nil {
+		return nil, errors.New("failed to decode permanent key PEM")
+	}
+
+	permanentKey, err := x509.ParsePKCS1PublicKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse permanent key: %v", err)
+	}
+
+	return permanentKey, nil
+}
+
+// Address returns the onion address of the service the descriptor belongs to, without the .onion suffix
+func (d *HiddenServiceDescriptor) Address() (string, error) {
+	permanentKey, err := d.permanentPublicKey()
+	if err != nil {
+		return "", err
+	}
+
+	permID, err := common.CalculatePermanentID(*permanentKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to calculate permanent id: %v", err)
+	}
+
+	return common.CalculateOnionAddress(permID), nil
+}
+
+// Verify checks that the descriptor is signed by its permanent key, that the permanent key belongs to address
+// and that the descriptor ID is one of the service's descriptor IDs for the time period of now
+func (d *HiddenServiceDescriptor) Verify(address string, now time.Time) error {
+	permanentKey, err := d.permanentPublicKey()
+	if err != nil {
+		return err
+	}
+
+	signatureBlock, _ := pem.Decode([]byte(d.Signature))
+	if signatureBlock == nil {
+		return errors.New("failed to decode signature PEM")
+	}
+
+	end := strings.Index(d.Raw, "\nsignature\n")
+	if end < 0 {
+		return errors.New("descriptor has no signature")
+	}
+
+	h := sha1.New()
+	h.Write([]byte(d.Raw[:end+len("\nsignature\n")]))
+
+	if err = rsa.VerifyPKCS1v15(permanentKey, crypto.Hash(0), h.Sum(nil), signatureBlock.Bytes); err != nil {
+		return fmt.Errorf("invalid descriptor signature: %v", err)
+	}
+
+	permID, err := common.CalculatePermanentID(*permanentKey)
+	if err != nil {
+		return fmt.Errorf("failed to calculate permanent id: %v", err)
+	}
+
+	if common.CalculateOnionAddress(permID) != strings.TrimSuffix(strings.ToLower(address), ".onion") {
+		return fmt.Errorf("permanent key does not belong to %s", address)
+	}
+
+	var replica byte
+	for replica = 0; replica < replicaSetSize; replica++ {
+		descriptorID, err := common.CalculateDescriptorID(permID, now.Unix(), replica, 0, "")
+		if err != nil {
+			return err
+		}
+
+		if strings.EqualFold(string(descriptorID), d.DescriptorID) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("descriptor id %s is not valid for the current time period", d.DescriptorID)
+}
+
 // parseIntroductionPoints parses the introduction points block given in a descriptor
 func parseIntroductionPoints(data string) ([]IntroductionPoint, error) {
 	var introductionPoints []IntroductionPoint
@@ -93,6 +179,15 @@ func parseIntroductionPoints(data string) ([]IntroductionPoint, error) {
 		return introductionPoints, errors.New("trailing bytes when decoding introduction points PEM")
 	}
 
+	if block == nil {
+		return introductionPoints, errors.New("failed to decode introduction points PEM")
+	}
+
+	// Introduction points encrypted for authorized clients are decrypted with DecryptIntroductionPoints
+	if isEncryptedIntroductionPoints(block.Bytes) {
+		return nil, nil
+	}
+
 	raw := string(block.Bytes)
 	for {
 		var EOF bool
@@ -180,6 +275,28 @@ func parseIntroductionPoint(data string) (*IntroductionPoint, error) {
 	return introductionPoint, nil
 }
 
+// DecryptIntroductionPoints decrypts and parses introduction points that are encrypted for authorized clients
+func (d *HiddenServiceDescriptor) DecryptIntroductionPoints(descriptorCookie []byte) error {
+	block, _ := pem.Decode([]byte(d.IntroductionPointsRaw))
+	if block == nil {
+		return errors.New("failed to decode introduction points PEM")
+	}
+
+	if !isEncryptedIntroductionPoints(block.Bytes) {
+		return errors.New("introduction points are not encrypted")
+	}
+
+	plaintext, err := decryptIntroductionPoints(block.Bytes, descriptorCookie)
+	if err != nil {
+		return err
+	}
+
+	d.IntroductionPoints, err = parseIntroductionPoints(string(pem.EncodeToMemory(&pem.Block{Type: "MESSAGE",
+		Bytes: plaintext})))
+
+	return err
+}
+
 func extractEntry(end string, lines []string) (string, error) {
 	entry := ""
 	for _, line := range lines[1:] {
@@ -198,9 +315,11 @@ func extractEntry(end string, lines []string) (string, error) {
 	return entry, nil
 }
 
-// GenerateDescriptorRaw generates a raw signed hidden service descriptor
+// GenerateDescriptorRaw generates a raw signed hidden service descriptor, the introduction points are encrypted
+// for the authorized clients if clientAuth is not nil
 func GenerateDescriptorRaw(introductionPoints []IntroductionPoint, publishedTime time.Time, replica byte,
-	deviation uint8, descriptorCookie string, permanentKey *rsa.PublicKey, privateKey *rsa.PrivateKey, permID []byte, descriptorID []byte) ([]byte, error) {
+	deviation uint8, descriptorCookie string, permanentKey *rsa.PublicKey, privateKey *rsa.PrivateKey, permID []byte, descriptorID []byte,
+	clientAuth *ClientAuth) ([]byte, error) {
 	var err error
 	if permID == nil {
 		permID, err = common.CalculatePermanentID(*permanentKey)
@@ -227,7 +346,10 @@ func GenerateDescriptorRaw(introductionPoints []IntroductionPoint, publishedTime
 	secretIDPart := common.GetSecretID(permID, timeUnix, descriptorCookie, replica)
 
 	// Introduction point block
-	introBlock := createIntroductionPointsBloc(introductionPoints)
+	introBlock, err := createIntroductionPointsBloc(introductionPoints, clientAuth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt introduction points: %v", err)
+	}
 
 	// Published time
 	formattedTime := time.Unix(timeUnix-timeUnix%(60*60), 0).Format("2006-01-02 15:04:05")
@@ -257,13 +379,21 @@ func GenerateDescriptorRaw(introductionPoints []IntroductionPoint, publishedTime
 	return b.Bytes(), nil
 }
 
-func createIntroductionPointsBloc(introductionPoints []IntroductionPoint) []byte {
+func createIntroductionPointsBloc(introductionPoints []IntroductionPoint, clientAuth *ClientAuth) ([]byte, error) {
 	var introductionPointsRaw []byte
 	for _, IntroductionPoint := range introductionPoints {
 		introductionPointsRaw = append(introductionPointsRaw, []byte(IntroductionPoint.Raw)...)
 	}
 
-	return pem.EncodeToMemory(&pem.Block{Type: "MESSAGE", Bytes: introductionPointsRaw})
+	if clientAuth != nil {
+		var err error
+		introductionPointsRaw, err = encryptIntroductionPoints(introductionPointsRaw, clientAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "MESSAGE", Bytes: introductionPointsRaw}), nil
 }
 
 func createPublicKeyBloc(permanentKey *rsa.PublicKey) ([]byte, error) {
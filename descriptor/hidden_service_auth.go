@@ -0,0 +1,226 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Client authorization types of v2 descriptors as defined in
+// https://github.com/torproject/torspec/blob/master/rend-spec-v2.txt
+const (
+	ClientAuthBasic   byte = 1
+	ClientAuthStealth byte = 2
+)
+
+const (
+	// DescriptorCookieLengthV2 is the length of a v2 descriptor cookie
+	DescriptorCookieLengthV2 = 16
+	// MaxClientsBasic and MaxClientsStealth are the most clients tor allows per service for each auth type
+	MaxClientsBasic   = 512
+	MaxClientsStealth = 16
+
+	clientIDLengthV2     = 4
+	sessionKeyLength     = 16
+	clientEntryLengthV2  = clientIDLengthV2 + sessionKeyLength
+	clientsPerBlockBasic = 16
+	introPointsIVLength  = 16
+)
+
+// ClientAuth describes how the introduction points of a v2 descriptor are encrypted. Basic authorization
+// encrypts for every cookie in DescriptorCookies, stealth authorization for exactly one
+type ClientAuth struct {
+	Type              byte
+	DescriptorCookies [][]byte
+}
+
+// aesCTR encrypts or decrypts data with AES-128-CTR
+func aesCTR(key, iv, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(out, data)
+
+	return out, nil
+}
+
+// calculateClientIDV2 computes CLIENT_ID = H(descriptor-cookie | IV)[:4]
+func calculateClientIDV2(descriptorCookie, iv []byte) []byte {
+	h := sha1.New()
+	h.Write(descriptorCookie)
+	h.Write(iv)
+
+	return h.Sum(nil)[:clientIDLengthV2]
+}
+
+// encryptIntroductionPoints encrypts the introduction points block for the clients of clientAuth
+func encryptIntroductionPoints(plaintext []byte, clientAuth *ClientAuth) ([]byte, error) {
+	for _, descriptorCookie := range clientAuth.DescriptorCookies {
+		if len(descriptorCookie) != DescriptorCookieLengthV2 {
+			return nil, errors.New("invalid descriptor cookie length")
+		}
+	}
+
+	switch clientAuth.Type {
+	case ClientAuthBasic:
+		return encryptIntroductionPointsBasic(plaintext, clientAuth.DescriptorCookies)
+	case ClientAuthStealth:
+		if len(clientAuth.DescriptorCookies) != 1 {
+			return nil, errors.New("stealth authorization requires exactly one descriptor cookie")
+		}
+
+		return encryptIntroductionPointsStealth(plaintext, clientAuth.DescriptorCookies[0])
+	}
+
+	return nil, fmt.Errorf("unknown client authorization type %d", clientAuth.Type)
+}
+
+// encryptIntroductionPointsBasic encrypts the introduction points with a session key that is itself encrypted
+// for each client, the client entries are padded with random ones to a multiple of 16
+// ATYPE | ALEN | (CLIENT_ID | SESSION_KEY) * 16 * ALEN | IV | ENCRYPTED_INTRODUCTION_POINTS
+func encryptIntroductionPointsBasic(plaintext []byte, descriptorCookies [][]byte) ([]byte, error) {
+	if len(descriptorCookies) == 0 || len(descriptorCookies) > MaxClientsBasic {
+		return nil, fmt.Errorf("basic authorization requires between 1 and %d clients", MaxClientsBasic)
+	}
+
+	random := make([]byte, sessionKeyLength+introPointsIVLength)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	sessionKey, iv := random[:sessionKeyLength], random[sessionKeyLength:]
+
+	clientBlocks := (len(descriptorCookies)-1)/clientsPerBlockBasic + 1
+	var clientEntries [][]byte
+	for _, descriptorCookie := range descriptorCookies {
+		encryptedSessionKey, err := aesCTR(descriptorCookie, make([]byte, aes.BlockSize), sessionKey)
+		if err != nil {
+			return nil, err
+		}
+
+		clientEntries = append(clientEntries, append(calculateClientIDV2(descriptorCookie, iv), encryptedSessionKey...))
+	}
+
+	for len(clientEntries) < clientBlocks*clientsPerBlockBasic {
+		fake := make([]byte, clientEntryLengthV2)
+		if _, err := rand.Read(fake); err != nil {
+			return nil, err
+		}
+
+		clientEntries = append(clientEntries, fake)
+	}
+
+	// Sorted so the position of an entry doesn't reveal the order clients were configured in
+	sort.Slice(clientEntries, func(i, j int) bool {
+		return bytes.Compare(clientEntries[i], clientEntries[j]) < 0
+	})
+
+	encrypted, err := aesCTR(sessionKey, iv, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []byte{ClientAuthBasic, byte(clientBlocks)}
+	for _, clientEntry := range clientEntries {
+		out = append(out, clientEntry...)
+	}
+	out = append(out, iv...)
+
+	return append(out, encrypted...), nil
+}
+
+// encryptIntroductionPointsStealth encrypts the introduction points with the descriptor cookie
+// ATYPE | IV | ENCRYPTED_INTRODUCTION_POINTS
+func encryptIntroductionPointsStealth(plaintext, descriptorCookie []byte) ([]byte, error) {
+	iv := make([]byte, introPointsIVLength)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	encrypted, err := aesCTR(descriptorCookie, iv, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{ClientAuthStealth}, iv...)
+
+	return append(out, encrypted...), nil
+}
+
+// decryptIntroductionPoints decrypts an encrypted introduction points block with the descriptor cookie of a client
+func decryptIntroductionPoints(data, descriptorCookie []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errors.New("introduction points block is empty")
+	}
+
+	if len(descriptorCookie) != DescriptorCookieLengthV2 {
+		return nil, errors.New("invalid descriptor cookie length")
+	}
+
+	var plaintext []byte
+	var err error
+	switch data[0] {
+	case ClientAuthBasic:
+		if len(data) < 2 {
+			return nil, errors.New("introduction points block is truncated")
+		}
+
+		entriesEnd := 2 + int(data[1])*clientsPerBlockBasic*clientEntryLengthV2
+		if len(data) < entriesEnd+introPointsIVLength {
+			return nil, errors.New("introduction points block is truncated")
+		}
+
+		iv := data[entriesEnd : entriesEnd+introPointsIVLength]
+		clientID := calculateClientIDV2(descriptorCookie, iv)
+
+		var sessionKey []byte
+		for pos := 2; pos < entriesEnd; pos += clientEntryLengthV2 {
+			if !bytes.Equal(data[pos:pos+clientIDLengthV2], clientID) {
+				continue
+			}
+
+			sessionKey, err = aesCTR(descriptorCookie, make([]byte, aes.BlockSize),
+				data[pos+clientIDLengthV2:pos+clientEntryLengthV2])
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		if sessionKey == nil {
+			return nil, errors.New("client is not authorized")
+		}
+
+		plaintext, err = aesCTR(sessionKey, iv, data[entriesEnd+introPointsIVLength:])
+	case ClientAuthStealth:
+		if len(data) < 1+introPointsIVLength {
+			return nil, errors.New("introduction points block is truncated")
+		}
+
+		plaintext, err = aesCTR(descriptorCookie, data[1:1+introPointsIVLength], data[1+introPointsIVLength:])
+	default:
+		return nil, fmt.Errorf("unknown client authorization type %d", data[0])
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(plaintext, []byte("introduction-point ")) {
+		return nil, errors.New("failed to decrypt introduction points, wrong descriptor cookie")
+	}
+
+	return plaintext, nil
+}
+
+// isEncryptedIntroductionPoints returns true if the decoded introduction points block is encrypted
+func isEncryptedIntroductionPoints(data []byte) bool {
+	return len(data) > 0 && (data[0] == ClientAuthBasic || data[0] == ClientAuthStealth)
+}
@@ -0,0 +1,146 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/pem"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newDescriptorCookies(t *testing.T, n int) [][]byte {
+	var descriptorCookies [][]byte
+	for i := 0; i < n; i++ {
+		descriptorCookie := make([]byte, DescriptorCookieLengthV2)
+		if _, err := rand.Read(descriptorCookie); err != nil {
+			t.Fatal(err)
+		}
+
+		descriptorCookies = append(descriptorCookies, descriptorCookie)
+	}
+
+	return descriptorCookies
+}
+
+func TestEncryptIntroductionPoints(t *testing.T) {
+	t.Parallel()
+
+	plaintext := []byte("introduction-point 6zmzbqr2wal2ynzcn2zk2pnfvdvokxim\nip-address 91.221.119.33\n")
+	descriptorCookies := newDescriptorCookies(t, 18)
+	unauthorizedCookie := newDescriptorCookies(t, 1)[0]
+
+	testCases := []struct {
+		name       string
+		clientAuth *ClientAuth
+
+		expectedLen int
+	}{
+		{
+			"basic one client",
+			&ClientAuth{Type: ClientAuthBasic, DescriptorCookies: descriptorCookies[:1]},
+			2 + 16*clientEntryLengthV2 + introPointsIVLength + len(plaintext),
+		},
+		{
+			"basic padded to two blocks",
+			&ClientAuth{Type: ClientAuthBasic, DescriptorCookies: descriptorCookies},
+			2 + 32*clientEntryLengthV2 + introPointsIVLength + len(plaintext),
+		},
+		{
+			"stealth",
+			&ClientAuth{Type: ClientAuthStealth, DescriptorCookies: descriptorCookies[:1]},
+			1 + introPointsIVLength + len(plaintext),
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			encrypted, err := encryptIntroductionPoints(plaintext, tt.clientAuth)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(encrypted) != tt.expectedLen || encrypted[0] != tt.clientAuth.Type {
+				t.Errorf("expected %d bytes of type %d got %d bytes of type %d", tt.expectedLen,
+					tt.clientAuth.Type, len(encrypted), encrypted[0])
+			}
+
+			for _, descriptorCookie := range tt.clientAuth.DescriptorCookies {
+				got, err := decryptIntroductionPoints(encrypted, descriptorCookie)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(got, plaintext) {
+					t.Errorf("expected %s got %s", plaintext, got)
+				}
+			}
+
+			if _, err := decryptIntroductionPoints(encrypted, unauthorizedCookie); err == nil {
+				t.Error("expected unauthorized cookie to fail")
+			}
+		})
+	}
+}
+
+func TestEncryptIntroductionPointsErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name       string
+		clientAuth *ClientAuth
+	}{
+		{"no clients", &ClientAuth{Type: ClientAuthBasic}},
+		{"stealth with two cookies", &ClientAuth{Type: ClientAuthStealth, DescriptorCookies: newDescriptorCookies(t, 2)}},
+		{"short cookie", &ClientAuth{Type: ClientAuthBasic, DescriptorCookies: [][]byte{{1, 2, 3}}}},
+		{"unknown type", &ClientAuth{Type: 3, DescriptorCookies: newDescriptorCookies(t, 1)}},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := encryptIntroductionPoints([]byte("introduction-point "), tt.clientAuth); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestGenerateDescriptorRawClientAuth(t *testing.T) {
+	t.Parallel()
+
+	descriptorCookies := newDescriptorCookies(t, 2)
+	pubTime := time.Unix(time.Now().Unix()%(60*60), 0)
+	descRaw, err := GenerateDescriptorRaw(descriptor.IntroductionPoints, pubTime, 1, 0, "", pubKey, priKey, nil,
+		nil, &ClientAuth{Type: ClientAuthBasic, DescriptorCookies: descriptorCookies})
+	if err != nil {
+		t.Fatalf("failed to generate descriptor: %v", err)
+	}
+
+	desc, err := ParseHiddenServiceDescriptor(string(descRaw))
+	if err != nil {
+		t.Fatalf("failed to parse descriptor: %v", err)
+	}
+
+	if desc.IntroductionPoints != nil {
+		t.Errorf("expected encrypted introduction points to not be parsed")
+	}
+
+	block, _ := pem.Decode([]byte(desc.IntroductionPointsRaw))
+	if block == nil || block.Bytes[0] != ClientAuthBasic {
+		t.Fatal("expected introduction points encrypted with basic auth")
+	}
+
+	if err := desc.DecryptIntroductionPoints(descriptorCookies[1]); err != nil {
+		t.Fatalf("failed to decrypt introduction points: %v", err)
+	}
+
+	if !reflect.DeepEqual(desc.IntroductionPoints, descriptor.IntroductionPoints) {
+		t.Errorf("expected introduction points %#v got %#v", descriptor.IntroductionPoints, desc.IntroductionPoints)
+	}
+}
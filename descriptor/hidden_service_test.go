@@ -11,16 +11,20 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/csucu/onionspread/common"
+	"golang.org/x/crypto/ed25519"
 )
 
 var (
 	pubKey                     *rsa.PublicKey
 	priKey                     *rsa.PrivateKey
 	testDescriptorRaw          string
+	testDescriptorV3Raw        string
+	testIdentityKeyV3          ed25519.PublicKey
 	testRouterStatusEntriesRaw string
 
 	descriptor = &HiddenServiceDescriptor{
@@ -139,6 +143,15 @@ func TestMain(m *testing.M) {
 	}
 
 	testDescriptorRaw = string(descriptorBytes)
+	descriptor.Raw = testDescriptorRaw
+
+	descriptorV3Bytes, err := ioutil.ReadFile("../testdata/desc-v3.txt")
+	if err != nil {
+		fmt.Printf("TestMain: %v\n", err.Error())
+		os.Exit(1)
+	}
+
+	testDescriptorV3Raw = string(descriptorV3Bytes)
 
 	routerStatusesBytes, err := ioutil.ReadFile("../testdata/routerEntriesLong.txt")
 	if err != nil {
@@ -162,6 +175,13 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	// desc-v3.txt was generated with this identity key
+	testIdentityKeyV3, _, err = common.LoadEd25519KeysFromFile("../testdata/ed25519Key")
+	if err != nil {
+		fmt.Printf("TestMain: failed to load ed25519 keys from file: %v\n", err.Error())
+		os.Exit(1)
+	}
+
 	os.Exit(m.Run())
 }
 
@@ -328,7 +348,11 @@ func TestParseIntroductionPoint(t *testing.T) {
 }
 
 func TestCreateIntroductionPointsBloc(t *testing.T) {
-	gotBytes := createIntroductionPointsBloc(descriptor.IntroductionPoints)
+	gotBytes, err := createIntroductionPointsBloc(descriptor.IntroductionPoints, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	if got := string(gotBytes); !reflect.DeepEqual(descriptor.IntroductionPointsRaw, got) {
 		t.Errorf("expected %#v got %#v", descriptor.IntroductionPointsRaw, got)
 	}
@@ -348,7 +372,7 @@ func TestCreatePublicKeyBloc(t *testing.T) {
 func TestGenerateDescriptorRaw(t *testing.T) {
 	pubTime := time.Unix(time.Now().Unix()%(60*60), 0)
 	descRaw, err := GenerateDescriptorRaw(descriptor.IntroductionPoints, pubTime, 1, 0,
-		"", pubKey, priKey, nil, nil)
+		"", pubKey, priKey, nil, nil, nil)
 	if err != nil {
 		t.Fatalf("failed to generate descriptor: %v", err)
 	}
@@ -382,6 +406,91 @@ func TestGenerateDescriptorRaw(t *testing.T) {
 	}
 }
 
+func TestHiddenServiceDescriptor_Address(t *testing.T) {
+	t.Parallel()
+
+	desc, err := ParseHiddenServiceDescriptor(testDescriptorRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address, err := desc.Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if address != "7ctbljpgkiayaita" {
+		t.Errorf("expected 7ctbljpgkiayaita got %s", address)
+	}
+}
+
+func TestHiddenServiceDescriptor_Verify(t *testing.T) {
+	t.Parallel()
+
+	published := time.Date(2018, time.August, 13, 13, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name    string
+		raw     string
+		address string
+		now     time.Time
+
+		expectedErr bool
+	}{
+		{
+			"OK",
+			testDescriptorRaw,
+			"7ctbljpgkiayaita",
+			published,
+			false,
+		},
+		{
+			"OK - address with suffix",
+			testDescriptorRaw,
+			"7CTBLJPGKIAYAITA.onion",
+			published.Add(time.Hour),
+			false,
+		},
+		{
+			"fail - tampered descriptor",
+			strings.Replace(testDescriptorRaw, "protocol-versions 2,3", "protocol-versions 2", 1),
+			"7ctbljpgkiayaita",
+			published,
+			true,
+		},
+		{
+			"fail - wrong address",
+			testDescriptorRaw,
+			"irthspr2nebf7x5i",
+			published,
+			true,
+		},
+		{
+			"fail - wrong time period",
+			testDescriptorRaw,
+			"7ctbljpgkiayaita",
+			published.Add(48 * time.Hour),
+			true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			desc, err := ParseHiddenServiceDescriptor(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = desc.Verify(tt.address, tt.now); (err != nil) != tt.expectedErr {
+				t.Errorf("expected error %v got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
 //func TestFetchHiddenServiceDescriptor(t *testing.T) {
 //	var conn, err = textproto.Dial("tcp", "localhost:9054")
 //	if err != nil {
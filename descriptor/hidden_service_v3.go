@@ -0,0 +1,280 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	descriptorLifetime     = 180
+	descriptorCertLifetime = 54 * time.Hour
+	signaturePrefix        = "Tor onion service descriptor sig v3"
+)
+
+// HiddenServiceDescriptorV3 represents the outer plaintext layer of a v3 onion service descriptor as defined in
+// https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+type HiddenServiceDescriptorV3 struct {
+	Version           int
+	Lifetime          int
+	SigningKeyCertRaw string
+	SigningKeyCert    *Ed25519Certificate
+	RevisionCounter   uint64
+	SuperencryptedRaw string
+	Superencrypted    []byte
+	Signature         []byte
+	Raw               string
+}
+
+// ParseHiddenServiceDescriptorV3 parses the outer layer of a v3 onion service descriptor
+func ParseHiddenServiceDescriptorV3(descriptorRaw string) (*HiddenServiceDescriptorV3, error) {
+	descriptor := &HiddenServiceDescriptorV3{
+		Raw: descriptorRaw,
+	}
+	lines := strings.Split(descriptorRaw, "\n")
+
+	var err error
+	for i, line := range lines {
+		words := strings.Split(line, " ")
+		switch words[0] {
+		case "hs-descriptor":
+			if len(words) < 2 {
+				return nil, errors.New("missing descriptor version")
+			}
+
+			descriptor.Version, err = strconv.Atoi(words[1])
+			if err == nil && descriptor.Version != 3 {
+				err = fmt.Errorf("unsupported descriptor version %d", descriptor.Version)
+			}
+		case "descriptor-lifetime":
+			if len(words) < 2 {
+				return nil, errors.New("missing descriptor lifetime")
+			}
+
+			descriptor.Lifetime, err = strconv.Atoi(words[1])
+		case "descriptor-signing-key-cert":
+			descriptor.SigningKeyCertRaw, err = extractEntry("-----END ED25519 CERT-----", lines[i:])
+			if err != nil {
+				return nil, err
+			}
+
+			descriptor.SigningKeyCert, err = parseEd25519CertificatePEM(descriptor.SigningKeyCertRaw)
+		case "revision-counter":
+			if len(words) < 2 {
+				return nil, errors.New("missing revision counter")
+			}
+
+			descriptor.RevisionCounter, err = strconv.ParseUint(words[1], 10, 64)
+		case "superencrypted":
+			descriptor.SuperencryptedRaw, err = extractEntry("-----END MESSAGE-----", lines[i:])
+			if err != nil {
+				return nil, err
+			}
+
+			descriptor.Superencrypted, err = decodeMessageBlock(descriptor.SuperencryptedRaw)
+		case "signature":
+			if len(words) < 2 {
+				return nil, errors.New("missing signature")
+			}
+
+			descriptor.Signature, err = decodeBase64(words[1])
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if descriptor.Version != 3 {
+		return nil, errors.New("not a v3 descriptor")
+	}
+
+	if descriptor.SigningKeyCert == nil || descriptor.Superencrypted == nil || descriptor.Signature == nil {
+		return nil, errors.New("descriptor is missing required fields")
+	}
+
+	return descriptor, nil
+}
+
+// Verify checks that the descriptor signing key is certified by the key blinded from identityKey for the time
+// period of now or one next to it, as tor serves both around the rotation, that the certificate hasn't expired
+// and that the descriptor is signed by the descriptor signing key. periodLength is the length of a time period in
+// minutes, the one the descriptors are published with.
+func (d *HiddenServiceDescriptorV3) Verify(identityKey ed25519.PublicKey, now time.Time, periodLength int64) error {
+	cert := d.SigningKeyCert
+	if cert.Type != CertTypeSigningKey {
+		return fmt.Errorf("unexpected descriptor signing key certificate type %d", cert.Type)
+	}
+
+	blindedKey := cert.SigningKey()
+	if blindedKey == nil {
+		return errors.New("descriptor signing key certificate has no blinded key")
+	}
+
+	if err := cert.Verify(blindedKey); err != nil {
+		return fmt.Errorf("invalid descriptor signing key certificate: %v", err)
+	}
+
+	if !now.Before(cert.ExpirationDate) {
+		return fmt.Errorf("descriptor signing key certificate expired at %v", cert.ExpirationDate)
+	}
+
+	blinded := false
+	timePeriod := common.TimePeriodV3(now, periodLength)
+	for _, period := range []int64{timePeriod, timePeriod - 1, timePeriod + 1} {
+		key, err := common.BlindEd25519PublicKey(identityKey, period, periodLength)
+		if err != nil {
+			return fmt.Errorf("failed to blind identity key: %v", err)
+		}
+
+		if bytes.Equal(key, blindedKey) {
+			blinded = true
+			break
+		}
+	}
+
+	if !blinded {
+		return errors.New("blinded key does not belong to the identity key for the current time period")
+	}
+
+	end := strings.Index(d.Raw, "\nsignature ")
+	if end < 0 {
+		return errors.New("descriptor has no signature")
+	}
+
+	message := append([]byte(signaturePrefix), d.Raw[:end+1]...)
+	if !ed25519.Verify(cert.CertifiedKey, message, d.Signature) {
+		return errors.New("invalid descriptor signature")
+	}
+
+	return nil
+}
+
+// decodeMessageBlock returns the contents of a PEM encoded MESSAGE block
+func decodeMessageBlock(data string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "MESSAGE" {
+		return nil, errors.New("failed to decode MESSAGE PEM")
+	}
+
+	return block.Bytes, nil
+}
+
+// decodeBase64 decodes a base64 string that may have had its padding stripped, as tor does for keys and
+// signatures in v3 descriptors
+func decodeBase64(data string) ([]byte, error) {
+	if missingPadding := len(data) % 4; missingPadding != 0 {
+		data += strings.Repeat("=", 4-missingPadding)
+	}
+
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// encodeBase64 encodes data as base64 without padding
+func encodeBase64(data []byte) string {
+	return base64.RawStdEncoding.EncodeToString(data)
+}
+
+// GenerateDescriptorRawV3 generates a raw signed v3 onion service descriptor for the given time period.
+// expandedPrivateKey is the 64 byte expanded identity key of the service. A zero revision counter is replaced by
+// the publication time in seconds, which keeps it increasing between publishes. If authorizedClientKeys, the
+// x25519 public keys of the clients, is not empty the introduction points can only be decrypted by those clients
+func GenerateDescriptorRawV3(introductionPoints []IntroductionPointV3, publishedTime time.Time, timePeriod,
+	periodLength int64, revisionCounter uint64, publicKey ed25519.PublicKey, expandedPrivateKey []byte,
+	authorizedClientKeys [][]byte) ([]byte, error) {
+	blindedKey, err := common.BlindEd25519PublicKey(publicKey, timePeriod, periodLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to blind public key: %v", err)
+	}
+
+	blindedPrivateKey, err := common.BlindEd25519PrivateKey(expandedPrivateKey, publicKey, timePeriod, periodLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to blind private key: %v", err)
+	}
+
+	if revisionCounter == 0 {
+		revisionCounter = uint64(publishedTime.Unix())
+	}
+
+	// Short term descriptor signing key, certified by the blinded key
+	signingKey, signingPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate descriptor signing key: %v", err)
+	}
+
+	expiration := publishedTime.Add(descriptorCertLifetime)
+	signingKeyCert, err := newEd25519Certificate(CertTypeSigningKey, signingKey, blindedKey, expiration,
+		func(message []byte) []byte {
+			return common.SignEd25519Expanded(blindedPrivateKey, blindedKey, message)
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create descriptor signing key certificate: %v", err)
+	}
+
+	subcredential := common.CalculateSubcredential(publicKey, blindedKey)
+
+	// Client authorization, the descriptor cookie is encrypted for each client with a key derived from the
+	// ephemeral key. Without it the ephemeral key is random and only fake clients are listed
+	ephemeralKey, ephemeralPrivateKey, err := newX25519Key()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %v", err)
+	}
+
+	descriptorCookie := make([]byte, descriptorCookieLength)
+	if _, err = rand.Read(descriptorCookie); err != nil {
+		return nil, fmt.Errorf("failed to generate descriptor cookie: %v", err)
+	}
+
+	authClients, err := createAuthClients(subcredential, ephemeralPrivateKey, descriptorCookie, authorizedClientKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create auth-client entries: %v", err)
+	}
+
+	secretData := []byte(blindedKey)
+	if len(authorizedClientKeys) > 0 {
+		secretData = append(append([]byte{}, blindedKey...), descriptorCookie...)
+	}
+
+	// Second layer
+	encryptedPlaintext, err := createEncryptedLayer(introductionPoints, signingKey, signingPrivateKey, expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := encryptLayer(encryptedPlaintext, secretData, subcredential, revisionCounter, encryptedConstant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt encrypted layer: %v", err)
+	}
+
+	// First layer
+	superencryptedPlaintext := createSuperencryptedLayer(encrypted, ephemeralKey, authClients)
+
+	superencrypted, err := encryptLayer(superencryptedPlaintext, blindedKey, subcredential, revisionCounter,
+		superencryptedConstant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt superencrypted layer: %v", err)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("hs-descriptor 3\n")
+	b.WriteString("descriptor-lifetime " + strconv.Itoa(descriptorLifetime) + "\n")
+	b.WriteString("descriptor-signing-key-cert\n")
+	b.Write(signingKeyCert.encodePEM())
+	b.WriteString("revision-counter " + strconv.FormatUint(revisionCounter, 10) + "\n")
+	b.WriteString("superencrypted\n")
+	b.Write(pem.EncodeToMemory(&pem.Block{Type: "MESSAGE", Bytes: superencrypted}))
+
+	signature := ed25519.Sign(signingPrivateKey, append([]byte(signaturePrefix), b.Bytes()...))
+	b.WriteString("signature " + encodeBase64(signature) + "\n")
+
+	return b.Bytes(), nil
+}
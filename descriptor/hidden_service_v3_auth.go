@@ -0,0 +1,190 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	clientIDLength         = 8
+	clientIVLength         = 16
+	cookieKeyLength        = 32
+	descriptorCookieLength = 32
+	x25519KeyLength        = 32
+)
+
+// x25519 returns the shared secret of privateKey and publicKey, it fails if the result is all zeros which happens
+// when publicKey is a low order point
+func x25519(privateKey, publicKey []byte) ([]byte, error) {
+	if len(privateKey) != x25519KeyLength || len(publicKey) != x25519KeyLength {
+		return nil, errors.New("invalid x25519 key length")
+	}
+
+	var dst, in, base [32]byte
+	copy(in[:], privateKey)
+	copy(base[:], publicKey)
+	curve25519.ScalarMult(&dst, &in, &base)
+
+	if subtle.ConstantTimeCompare(dst[:], make([]byte, 32)) == 1 {
+		return nil, errors.New("invalid x25519 public key")
+	}
+
+	return dst[:], nil
+}
+
+// newX25519Key returns a new random x25519 key pair
+func newX25519Key() ([]byte, []byte, error) {
+	var publicKey, privateKey [32]byte
+	if _, err := rand.Read(privateKey[:]); err != nil {
+		return nil, nil, err
+	}
+
+	curve25519.ScalarBaseMult(&publicKey, &privateKey)
+
+	return publicKey[:], privateKey[:], nil
+}
+
+// deriveClientAuthKeys derives the client ID and cookie key of an authorized client
+// KEYS = SHAKE256(subcredential | SECRET_SEED), CLIENT-ID = KEYS[:8], COOKIE-KEY = KEYS[8:40]
+func deriveClientAuthKeys(subcredential, secretSeed []byte) ([]byte, []byte) {
+	kdf := sha3.NewShake256()
+	kdf.Write(subcredential)
+	kdf.Write(secretSeed)
+
+	keys := make([]byte, clientIDLength+cookieKeyLength)
+	kdf.Read(keys)
+
+	return keys[:clientIDLength], keys[clientIDLength:]
+}
+
+// cookieCipher encrypts or decrypts a descriptor cookie with AES-256-CTR
+func cookieCipher(cookieKey, iv, in []byte) ([]byte, error) {
+	block, err := aes.NewCipher(cookieKey)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(in))
+	cipher.NewCTR(block, iv).XORKeyStream(out, in)
+
+	return out, nil
+}
+
+// newAuthClient creates the auth-client entry that lets the owner of clientPublicKey decrypt descriptorCookie
+func newAuthClient(subcredential, ephemeralPrivateKey, clientPublicKey, descriptorCookie []byte) (AuthClient, error) {
+	secretSeed, err := x25519(ephemeralPrivateKey, clientPublicKey)
+	if err != nil {
+		return AuthClient{}, err
+	}
+
+	clientID, cookieKey := deriveClientAuthKeys(subcredential, secretSeed)
+
+	iv := make([]byte, clientIVLength)
+	if _, err = rand.Read(iv); err != nil {
+		return AuthClient{}, err
+	}
+
+	encryptedCookie, err := cookieCipher(cookieKey, iv, descriptorCookie)
+	if err != nil {
+		return AuthClient{}, err
+	}
+
+	return AuthClient{
+		ClientID:        clientID,
+		IV:              iv,
+		EncryptedCookie: encryptedCookie,
+	}, nil
+}
+
+// newFakeAuthClient creates a random auth-client entry
+func newFakeAuthClient() (AuthClient, error) {
+	fake := make([]byte, clientIDLength+clientIVLength+descriptorCookieLength)
+	if _, err := rand.Read(fake); err != nil {
+		return AuthClient{}, err
+	}
+
+	return AuthClient{
+		ClientID:        fake[:clientIDLength],
+		IV:              fake[clientIDLength : clientIDLength+clientIVLength],
+		EncryptedCookie: fake[clientIDLength+clientIVLength:],
+	}, nil
+}
+
+// createAuthClients creates the auth-client entries for the authorized client keys. The entries are padded with
+// fake ones to a multiple of fakeAuthClients and shuffled so the number of clients isn't revealed, without
+// authorized clients only fake entries are returned
+func createAuthClients(subcredential, ephemeralPrivateKey, descriptorCookie []byte,
+	authorizedClientKeys [][]byte) ([]AuthClient, error) {
+	var authClients []AuthClient
+	for _, clientKey := range authorizedClientKeys {
+		authClient, err := newAuthClient(subcredential, ephemeralPrivateKey, clientKey, descriptorCookie)
+		if err != nil {
+			return nil, err
+		}
+
+		authClients = append(authClients, authClient)
+	}
+
+	for len(authClients) == 0 || len(authClients)%fakeAuthClients != 0 {
+		authClient, err := newFakeAuthClient()
+		if err != nil {
+			return nil, err
+		}
+
+		authClients = append(authClients, authClient)
+	}
+
+	if err := shuffleAuthClients(authClients); err != nil {
+		return nil, fmt.Errorf("failed to shuffle auth-client entries: %v", err)
+	}
+
+	return authClients, nil
+}
+
+// shuffleAuthClients shuffles the entries with crypto/rand like tor does, their order is what hides the real
+// clients among the fake ones
+func shuffleAuthClients(authClients []AuthClient) error {
+	for i := len(authClients) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return err
+		}
+
+		authClients[i], authClients[j.Int64()] = authClients[j.Int64()], authClients[i]
+	}
+
+	return nil
+}
+
+// DescriptorCookie returns the descriptor cookie of the layer that is encrypted for the client owning
+// clientPrivateKey, an error is returned if the client isn't one of the authorized clients
+func (l *SuperencryptedLayer) DescriptorCookie(subcredential, clientPrivateKey []byte) ([]byte, error) {
+	secretSeed, err := x25519(clientPrivateKey, l.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID, cookieKey := deriveClientAuthKeys(subcredential, secretSeed)
+	for _, authClient := range l.AuthClients {
+		if !bytes.Equal(authClient.ClientID, clientID) {
+			continue
+		}
+
+		if len(authClient.IV) != clientIVLength || len(authClient.EncryptedCookie) != descriptorCookieLength {
+			return nil, errors.New("malformed auth-client entry")
+		}
+
+		return cookieCipher(cookieKey, authClient.IV, authClient.EncryptedCookie)
+	}
+
+	return nil, errors.New("client is not authorized")
+}
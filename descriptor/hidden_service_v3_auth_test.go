@@ -0,0 +1,184 @@
+package descriptor
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestGenerateDescriptorRawV3ClientAuth(t *testing.T) {
+	t.Parallel()
+
+	backendDescriptor, err := ParseHiddenServiceDescriptorV3(testDescriptorV3Raw)
+	if err != nil {
+		t.Fatalf("failed to parse v3 hidden service descriptor: %v", err)
+	}
+
+	introductionPoints, err := backendDescriptor.IntroductionPoints(testIdentityKeyV3, nil)
+	if err != nil {
+		t.Fatalf("failed to get introduction points: %v", err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	var clientPublicKeys, clientPrivateKeys [][]byte
+	for i := 0; i < 3; i++ {
+		clientPublicKey, clientPrivateKey, err := newX25519Key()
+		if err != nil {
+			t.Fatalf("failed to generate client key: %v", err)
+		}
+
+		clientPublicKeys = append(clientPublicKeys, clientPublicKey)
+		clientPrivateKeys = append(clientPrivateKeys, clientPrivateKey)
+	}
+
+	_, unauthorizedPrivateKey, err := newX25519Key()
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+
+	publishedTime := time.Date(2018, 8, 14, 9, 30, 0, 0, time.UTC)
+	timePeriod := common.TimePeriodV3(publishedTime, common.TimePeriodLengthV3)
+
+	descriptorRaw, err := GenerateDescriptorRawV3(introductionPoints, publishedTime, timePeriod,
+		common.TimePeriodLengthV3, 0, publicKey, common.ExpandEd25519PrivateKey(privateKey), clientPublicKeys)
+	if err != nil {
+		t.Fatalf("failed to generate descriptor: %v", err)
+	}
+
+	desc, err := ParseHiddenServiceDescriptorV3(string(descriptorRaw))
+	if err != nil {
+		t.Fatalf("failed to parse generated descriptor: %v", err)
+	}
+
+	for i, clientPrivateKey := range clientPrivateKeys {
+		superencryptedLayer, encryptedLayer, err := desc.Decrypt(
+			common.CalculateSubcredential(publicKey, desc.SigningKeyCert.SigningKey()), clientPrivateKey)
+		if err != nil {
+			t.Fatalf("client %d failed to decrypt descriptor: %v", i, err)
+		}
+
+		if len(encryptedLayer.IntroductionPoints) != len(introductionPoints) {
+			t.Errorf("expected %d introduction points got %d", len(introductionPoints),
+				len(encryptedLayer.IntroductionPoints))
+		}
+
+		if len(superencryptedLayer.AuthClients) != fakeAuthClients {
+			t.Errorf("expected %d auth-client entries got %d", fakeAuthClients, len(superencryptedLayer.AuthClients))
+		}
+	}
+
+	if _, err := desc.IntroductionPoints(publicKey, unauthorizedPrivateKey); err == nil {
+		t.Error("expected unauthorized client to fail to decrypt descriptor")
+	}
+
+	if _, err := desc.IntroductionPoints(publicKey, nil); err == nil {
+		t.Error("expected decrypting without a client key to fail")
+	}
+}
+
+func TestCreateAuthClients(t *testing.T) {
+	t.Parallel()
+
+	clientPublicKey, clientPrivateKey, err := newX25519Key()
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+
+	ephemeralKey, ephemeralPrivateKey, err := newX25519Key()
+	if err != nil {
+		t.Fatalf("failed to generate ephemeral key: %v", err)
+	}
+
+	subcredential := make([]byte, 32)
+	descriptorCookie := make([]byte, descriptorCookieLength)
+	rand.Read(descriptorCookie)
+
+	var manyClientKeys [][]byte
+	for i := 0; i < fakeAuthClients+1; i++ {
+		manyClientKeys = append(manyClientKeys, clientPublicKey)
+	}
+
+	testCases := []struct {
+		name       string
+		clientKeys [][]byte
+
+		expectedLen int
+	}{
+		{"no clients", nil, fakeAuthClients},
+		{"one client", [][]byte{clientPublicKey}, fakeAuthClients},
+		{"padded to a multiple", manyClientKeys, 2 * fakeAuthClients},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			authClients, err := createAuthClients(subcredential, ephemeralPrivateKey, descriptorCookie, tt.clientKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(authClients) != tt.expectedLen {
+				t.Errorf("expected %d auth-client entries got %d", tt.expectedLen, len(authClients))
+			}
+
+			layer := SuperencryptedLayer{EphemeralKey: ephemeralKey, AuthClients: authClients}
+			cookie, err := layer.DescriptorCookie(subcredential, clientPrivateKey)
+			if tt.clientKeys == nil {
+				if err == nil {
+					t.Error("expected client to not be authorized")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(cookie) != string(descriptorCookie) {
+				t.Errorf("expected cookie %x got %x", descriptorCookie, cookie)
+			}
+		})
+	}
+}
+
+func TestShuffleAuthClients(t *testing.T) {
+	t.Parallel()
+
+	// the real client ends up in every position sooner or later and no entry is lost
+	positions := make(map[int]bool)
+	for attempt := 0; attempt < 1000 && len(positions) < fakeAuthClients; attempt++ {
+		authClients := make([]AuthClient, fakeAuthClients)
+		for i := range authClients {
+			authClients[i].ClientID = []byte{byte(i)}
+		}
+
+		if err := shuffleAuthClients(authClients); err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make(map[byte]bool)
+		for i, authClient := range authClients {
+			seen[authClient.ClientID[0]] = true
+			if authClient.ClientID[0] == 0 {
+				positions[i] = true
+			}
+		}
+
+		if len(seen) != fakeAuthClients {
+			t.Fatalf("expected %d different entries got %d", fakeAuthClients, len(seen))
+		}
+	}
+
+	if len(positions) != fakeAuthClients {
+		t.Errorf("expected the entry in all %d positions got %d", fakeAuthClients, len(positions))
+	}
+}
@@ -0,0 +1,554 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	superencryptedConstant = "hsdir-superencrypted-data"
+	encryptedConstant      = "hsdir-encrypted-data"
+	saltLength             = 16
+	macLength              = 32
+	secretKeyLength        = 32
+	secretIVLength         = 16
+	macKeyLength           = 32
+
+	fakeAuthClients          = 16
+	plaintextPaddingMultiple = 10000
+)
+
+// Link specifier types as defined in https://github.com/torproject/torspec/blob/master/tor-spec.txt
+const (
+	LinkSpecifierIPv4      byte = 0x00
+	LinkSpecifierIPv6      byte = 0x01
+	LinkSpecifierLegacyID  byte = 0x02
+	LinkSpecifierEd25519ID byte = 0x03
+)
+
+// SuperencryptedLayer represents the decrypted first layer of a v3 descriptor
+type SuperencryptedLayer struct {
+	AuthType     string
+	EphemeralKey []byte
+	AuthClients  []AuthClient
+	EncryptedRaw string
+	Encrypted    []byte
+}
+
+// AuthClient represents an auth-client entry of the first layer
+type AuthClient struct {
+	ClientID        []byte
+	IV              []byte
+	EncryptedCookie []byte
+}
+
+// EncryptedLayer represents the decrypted second layer of a v3 descriptor
+type EncryptedLayer struct {
+	CreateFormats      []int
+	IntroAuthRequired  []string
+	SingleOnionService bool
+	IntroductionPoints []IntroductionPointV3
+}
+
+// IntroductionPointV3 represents a v3 introduction point
+type IntroductionPointV3 struct {
+	LinkSpecifiersRaw string
+	LinkSpecifiers    []LinkSpecifier
+	OnionKey          []byte
+	AuthKeyCertRaw    string
+	AuthKeyCert       *Ed25519Certificate
+	EncKey            []byte
+	EncKeyCertRaw     string
+	EncKeyCert        *Ed25519Certificate
+	Raw               string
+}
+
+// LinkSpecifier represents a single link specifier of an introduction point
+type LinkSpecifier struct {
+	Type byte
+	Data []byte
+}
+
+// Address returns the IP address and port of the introduction point relay
+func (ip *IntroductionPointV3) Address() (net.IP, int) {
+	for _, ls := range ip.LinkSpecifiers {
+		switch {
+		case ls.Type == LinkSpecifierIPv4 && len(ls.Data) == 6:
+			return net.IP(ls.Data[:4]), int(binary.BigEndian.Uint16(ls.Data[4:]))
+		case ls.Type == LinkSpecifierIPv6 && len(ls.Data) == 18:
+			return net.IP(ls.Data[:16]), int(binary.BigEndian.Uint16(ls.Data[16:]))
+		}
+	}
+
+	return nil, 0
+}
+
+// Fingerprint returns the uppercase hex encoded RSA identity of the introduction point relay
+func (ip *IntroductionPointV3) Fingerprint() string {
+	for _, ls := range ip.LinkSpecifiers {
+		if ls.Type == LinkSpecifierLegacyID {
+			return strings.ToUpper(fmt.Sprintf("%x", ls.Data))
+		}
+	}
+
+	return ""
+}
+
+// Decrypt decrypts both encrypted layers of the descriptor using the subcredential of the service, the blinded
+// key used is the one the descriptor signing key certificate was signed with. clientPrivateKey is the x25519 key
+// of an authorized client and is only needed if the descriptor uses client authorization, nil otherwise
+func (d *HiddenServiceDescriptorV3) Decrypt(subcredential, clientPrivateKey []byte) (*SuperencryptedLayer,
+	*EncryptedLayer, error) {
+	blindedKey := d.SigningKeyCert.SigningKey()
+	if blindedKey == nil {
+		return nil, nil, errors.New("descriptor signing key certificate has no blinded key")
+	}
+
+	plaintext, err := decryptLayer(d.Superencrypted, blindedKey, subcredential, d.RevisionCounter,
+		superencryptedConstant)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt superencrypted layer: %v", err)
+	}
+
+	superencryptedLayer, err := parseSuperencryptedLayer(string(plaintext))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse superencrypted layer: %v", err)
+	}
+
+	// With client authorization the second layer is also keyed with the descriptor cookie
+	secretData := []byte(blindedKey)
+	if clientPrivateKey != nil {
+		descriptorCookie, err := superencryptedLayer.DescriptorCookie(subcredential, clientPrivateKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt descriptor cookie: %v", err)
+		}
+
+		secretData = append(append([]byte{}, blindedKey...), descriptorCookie...)
+	}
+
+	plaintext, err = decryptLayer(superencryptedLayer.Encrypted, secretData, subcredential, d.RevisionCounter,
+		encryptedConstant)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt encrypted layer: %v", err)
+	}
+
+	encryptedLayer, err := parseEncryptedLayer(string(plaintext))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse encrypted layer: %v", err)
+	}
+
+	return superencryptedLayer, encryptedLayer, nil
+}
+
+// deriveLayerKeys derives the secret key, iv and mac key for a layer
+// keys = SHAKE256(SECRET_DATA | subcredential | INT_8(revision_counter) | salt | STRING_CONSTANT)
+func deriveLayerKeys(secretData, subcredential []byte, revisionCounter uint64, salt []byte,
+	constant string) ([]byte, []byte, []byte) {
+	revisionCounterBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(revisionCounterBytes, revisionCounter)
+
+	kdf := sha3.NewShake256()
+	kdf.Write(secretData)
+	kdf.Write(subcredential)
+	kdf.Write(revisionCounterBytes)
+	kdf.Write(salt)
+	kdf.Write([]byte(constant))
+
+	keys := make([]byte, secretKeyLength+secretIVLength+macKeyLength)
+	kdf.Read(keys)
+
+	return keys[:secretKeyLength], keys[secretKeyLength : secretKeyLength+secretIVLength],
+		keys[secretKeyLength+secretIVLength:]
+}
+
+// calculateLayerMAC computes MAC = SHA3_256(INT_8(len(mac_key)) | mac_key | salt | encrypted)
+func calculateLayerMAC(macKey, salt, encrypted []byte) []byte {
+	macKeyLen := make([]byte, 8)
+	binary.BigEndian.PutUint64(macKeyLen, uint64(len(macKey)))
+
+	h := sha3.New256()
+	h.Write(macKeyLen)
+	h.Write(macKey)
+	h.Write(salt)
+	h.Write(encrypted)
+
+	return h.Sum(nil)
+}
+
+// decryptLayer decrypts a descriptor layer blob of the form salt | encrypted | mac
+func decryptLayer(blob, secretData, subcredential []byte, revisionCounter uint64, constant string) ([]byte, error) {
+	if len(blob) < saltLength+macLength {
+		return nil, errors.New("encrypted blob is too short")
+	}
+
+	salt := blob[:saltLength]
+	encrypted := blob[saltLength : len(blob)-macLength]
+	mac := blob[len(blob)-macLength:]
+
+	secretKey, secretIV, macKey := deriveLayerKeys(secretData, subcredential, revisionCounter, salt, constant)
+	if subtle.ConstantTimeCompare(mac, calculateLayerMAC(macKey, salt, encrypted)) != 1 {
+		return nil, errors.New("MAC mismatch")
+	}
+
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(encrypted))
+	cipher.NewCTR(block, secretIV).XORKeyStream(plaintext, encrypted)
+
+	// Strip any NUL padding
+	return bytes.TrimRight(plaintext, "\x00"), nil
+}
+
+// parseSuperencryptedLayer parses the plaintext of the first layer
+func parseSuperencryptedLayer(data string) (*SuperencryptedLayer, error) {
+	layer := &SuperencryptedLayer{}
+	lines := strings.Split(data, "\n")
+
+	var err error
+	for i, line := range lines {
+		words := strings.Split(line, " ")
+		switch words[0] {
+		case "desc-auth-type":
+			if len(words) < 2 {
+				return nil, errors.New("missing auth type")
+			}
+
+			layer.AuthType = words[1]
+		case "desc-auth-ephemeral-key":
+			if len(words) < 2 {
+				return nil, errors.New("missing ephemeral key")
+			}
+
+			layer.EphemeralKey, err = decodeBase64(words[1])
+		case "auth-client":
+			if len(words) < 4 {
+				return nil, errors.New("malformed auth-client entry")
+			}
+
+			var authClient AuthClient
+			if authClient.ClientID, err = decodeBase64(words[1]); err != nil {
+				return nil, err
+			}
+
+			if authClient.IV, err = decodeBase64(words[2]); err != nil {
+				return nil, err
+			}
+
+			if authClient.EncryptedCookie, err = decodeBase64(words[3]); err != nil {
+				return nil, err
+			}
+
+			layer.AuthClients = append(layer.AuthClients, authClient)
+		case "encrypted":
+			layer.EncryptedRaw, err = extractEntry("-----END MESSAGE-----", lines[i:])
+			if err != nil {
+				return nil, err
+			}
+
+			layer.Encrypted, err = decodeMessageBlock(layer.EncryptedRaw)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if layer.Encrypted == nil {
+		return nil, errors.New("missing encrypted section")
+	}
+
+	return layer, nil
+}
+
+// parseEncryptedLayer parses the plaintext of the second layer
+func parseEncryptedLayer(data string) (*EncryptedLayer, error) {
+	layer := &EncryptedLayer{}
+
+	start := strings.Index(data, "introduction-point ")
+	header := data
+	if start >= 0 {
+		header = data[:start]
+	}
+
+	for _, line := range strings.Split(header, "\n") {
+		words := strings.Split(line, " ")
+		switch words[0] {
+		case "create2-formats":
+			for _, formatStr := range words[1:] {
+				format, err := strconv.Atoi(formatStr)
+				if err != nil {
+					return nil, err
+				}
+
+				layer.CreateFormats = append(layer.CreateFormats, format)
+			}
+		case "intro-auth-required":
+			layer.IntroAuthRequired = words[1:]
+		case "single-onion-service":
+			layer.SingleOnionService = true
+		}
+	}
+
+	if start < 0 {
+		return layer, nil
+	}
+
+	raw := data[start:]
+	for raw != "" {
+		end := strings.Index(raw, "\nintroduction-point ")
+
+		var introductionPointRaw string
+		if end >= 0 {
+			introductionPointRaw, raw = raw[:end+1], raw[end+1:]
+		} else {
+			introductionPointRaw, raw = raw, ""
+		}
+
+		introductionPoint, err := parseIntroductionPointV3(introductionPointRaw)
+		if err != nil {
+			return nil, err
+		}
+
+		layer.IntroductionPoints = append(layer.IntroductionPoints, *introductionPoint)
+	}
+
+	return layer, nil
+}
+
+// parseIntroductionPointV3 returns a v3 introduction point given its raw representation
+func parseIntroductionPointV3(data string) (*IntroductionPointV3, error) {
+	introductionPoint := &IntroductionPointV3{Raw: data}
+	lines := strings.Split(data, "\n")
+
+	var err error
+	for i, line := range lines {
+		words := strings.Split(line, " ")
+		switch words[0] {
+		case "introduction-point":
+			if len(words) < 2 {
+				return nil, errors.New("missing link specifiers")
+			}
+
+			introductionPoint.LinkSpecifiersRaw = words[1]
+			introductionPoint.LinkSpecifiers, err = parseLinkSpecifiers(words[1])
+		case "onion-key":
+			if len(words) < 3 || words[1] != "ntor" {
+				return nil, errors.New("unsupported onion-key")
+			}
+
+			introductionPoint.OnionKey, err = decodeBase64(words[2])
+		case "auth-key":
+			introductionPoint.AuthKeyCertRaw, err = extractEntry("-----END ED25519 CERT-----", lines[i:])
+			if err != nil {
+				return nil, err
+			}
+
+			introductionPoint.AuthKeyCert, err = parseEd25519CertificatePEM(introductionPoint.AuthKeyCertRaw)
+		case "enc-key":
+			if len(words) < 3 || words[1] != "ntor" {
+				return nil, errors.New("unsupported enc-key")
+			}
+
+			introductionPoint.EncKey, err = decodeBase64(words[2])
+		case "enc-key-cert":
+			introductionPoint.EncKeyCertRaw, err = extractEntry("-----END ED25519 CERT-----", lines[i:])
+			if err != nil {
+				return nil, err
+			}
+
+			introductionPoint.EncKeyCert, err = parseEd25519CertificatePEM(introductionPoint.EncKeyCertRaw)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if introductionPoint.LinkSpecifiers == nil || introductionPoint.OnionKey == nil ||
+		introductionPoint.AuthKeyCert == nil || introductionPoint.EncKey == nil {
+		return nil, errors.New("introduction point is missing required fields")
+	}
+
+	return introductionPoint, nil
+}
+
+// parseLinkSpecifiers decodes the base64 encoded link specifiers block
+// NSPEC | NSPEC * (LSTYPE | LSLEN | LSPEC)
+func parseLinkSpecifiers(data string) ([]LinkSpecifier, error) {
+	decoded, err := decodeBase64(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decoded) < 1 {
+		return nil, errors.New("empty link specifiers")
+	}
+
+	nSpec := int(decoded[0])
+	rest := decoded[1:]
+
+	var linkSpecifiers []LinkSpecifier
+	for i := 0; i < nSpec; i++ {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, errors.New("truncated link specifier")
+		}
+
+		linkSpecifiers = append(linkSpecifiers, LinkSpecifier{
+			Type: rest[0],
+			Data: rest[2 : 2+int(rest[1])],
+		})
+		rest = rest[2+int(rest[1]):]
+	}
+
+	return linkSpecifiers, nil
+}
+
+// encodeLinkSpecifiers is the inverse of parseLinkSpecifiers
+func encodeLinkSpecifiers(linkSpecifiers []LinkSpecifier) string {
+	encoded := []byte{byte(len(linkSpecifiers))}
+	for _, ls := range linkSpecifiers {
+		encoded = append(encoded, ls.Type, byte(len(ls.Data)))
+		encoded = append(encoded, ls.Data...)
+	}
+
+	return base64.StdEncoding.EncodeToString(encoded)
+}
+
+// IntroductionPoints decrypts the descriptor and returns its introduction points, identityKey is the public key
+// the onion address of the service is derived from and clientPrivateKey is as for Decrypt
+func (d *HiddenServiceDescriptorV3) IntroductionPoints(identityKey ed25519.PublicKey,
+	clientPrivateKey []byte) ([]IntroductionPointV3, error) {
+	subcredential := common.CalculateSubcredential(identityKey, d.SigningKeyCert.SigningKey())
+
+	_, encryptedLayer, err := d.Decrypt(subcredential, clientPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptedLayer.IntroductionPoints, nil
+}
+
+// encryptLayer encrypts a descriptor layer and returns the blob salt | encrypted | mac
+func encryptLayer(plaintext, secretData, subcredential []byte, revisionCounter uint64, constant string) ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	secretKey, secretIV, macKey := deriveLayerKeys(secretData, subcredential, revisionCounter, salt, constant)
+
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, len(plaintext))
+	cipher.NewCTR(block, secretIV).XORKeyStream(encrypted, plaintext)
+
+	blob := make([]byte, 0, saltLength+len(encrypted)+macLength)
+	blob = append(blob, salt...)
+	blob = append(blob, encrypted...)
+	blob = append(blob, calculateLayerMAC(macKey, salt, encrypted)...)
+
+	return blob, nil
+}
+
+// createEncryptedLayer builds the plaintext of the second layer. The auth-key and enc-key certificates of each
+// introduction point are reissued so that they are signed by the new descriptor signing key
+func createEncryptedLayer(introductionPoints []IntroductionPointV3, signingKey ed25519.PublicKey,
+	signingPrivateKey ed25519.PrivateKey, expiration time.Time) ([]byte, error) {
+	sign := func(message []byte) []byte {
+		return ed25519.Sign(signingPrivateKey, message)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("create2-formats 2\n")
+
+	for _, introductionPoint := range introductionPoints {
+		if introductionPoint.AuthKeyCert == nil {
+			return nil, errors.New("introduction point is missing its auth-key certificate")
+		}
+
+		authKeyCert, err := newEd25519Certificate(CertTypeAuthKey, introductionPoint.AuthKeyCert.CertifiedKey,
+			signingKey, expiration, sign)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create auth-key certificate: %v", err)
+		}
+
+		encKeyEd25519, err := common.Ed25519PublicKeyFromCurve25519(introductionPoint.EncKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert enc-key: %v", err)
+		}
+
+		encKeyCert, err := newEd25519Certificate(CertTypeEncKey, encKeyEd25519, signingKey, expiration, sign)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create enc-key certificate: %v", err)
+		}
+
+		linkSpecifiersRaw := introductionPoint.LinkSpecifiersRaw
+		if linkSpecifiersRaw == "" {
+			linkSpecifiersRaw = encodeLinkSpecifiers(introductionPoint.LinkSpecifiers)
+		}
+
+		b.WriteString("introduction-point " + linkSpecifiersRaw + "\n")
+		b.WriteString("onion-key ntor " + encodeBase64(introductionPoint.OnionKey) + "\n")
+		b.WriteString("auth-key\n")
+		b.Write(authKeyCert.encodePEM())
+		b.WriteString("enc-key ntor " + encodeBase64(introductionPoint.EncKey) + "\n")
+		b.WriteString("enc-key-cert\n")
+		b.Write(encKeyCert.encodePEM())
+	}
+
+	return b.Bytes(), nil
+}
+
+// createSuperencryptedLayer builds the plaintext of the first layer. Without client authorization the
+// ephemeral key and auth-client entries are random so that descriptors look the same either way
+func createSuperencryptedLayer(encrypted, ephemeralKey []byte, authClients []AuthClient) []byte {
+	var b bytes.Buffer
+	b.WriteString("desc-auth-type x25519\n")
+	b.WriteString("desc-auth-ephemeral-key " + encodeBase64(ephemeralKey) + "\n")
+
+	for _, authClient := range authClients {
+		b.WriteString("auth-client " + encodeBase64(authClient.ClientID) + " " + encodeBase64(authClient.IV) + " " +
+			encodeBase64(authClient.EncryptedCookie) + "\n")
+	}
+
+	b.WriteString("encrypted\n")
+	b.Write(pem.EncodeToMemory(&pem.Block{Type: "MESSAGE", Bytes: encrypted}))
+
+	return padPlaintext(b.Bytes())
+}
+
+// padPlaintext pads with NUL bytes up to a multiple of plaintextPaddingMultiple to hide the number of
+// introduction points
+func padPlaintext(plaintext []byte) []byte {
+	paddedLength := (len(plaintext)/plaintextPaddingMultiple + 1) * plaintextPaddingMultiple
+	if len(plaintext)%plaintextPaddingMultiple == 0 {
+		paddedLength = len(plaintext)
+	}
+
+	padded := make([]byte, paddedLength)
+	copy(padded, plaintext)
+
+	return padded
+}
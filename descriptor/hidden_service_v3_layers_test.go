@@ -0,0 +1,155 @@
+package descriptor
+
+import (
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/csucu/onionspread/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestHiddenServiceDescriptorV3Decrypt(t *testing.T) {
+	t.Parallel()
+
+	desc, err := ParseHiddenServiceDescriptorV3(testDescriptorV3Raw)
+	if err != nil {
+		t.Fatalf("failed to parse v3 hidden service descriptor: %v", err)
+	}
+
+	subcredential := common.CalculateSubcredential(testIdentityKeyV3, desc.SigningKeyCert.SigningKey())
+	superencryptedLayer, encryptedLayer, err := desc.Decrypt(subcredential, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt descriptor: %v", err)
+	}
+
+	if superencryptedLayer.AuthType != "x25519" {
+		t.Errorf("expected auth type x25519 got %v", superencryptedLayer.AuthType)
+	}
+
+	if len(superencryptedLayer.AuthClients) != 16 {
+		t.Errorf("expected 16 auth clients got %v", len(superencryptedLayer.AuthClients))
+	}
+
+	if !reflect.DeepEqual(encryptedLayer.CreateFormats, []int{2}) {
+		t.Errorf("expected create2 formats [2] got %v", encryptedLayer.CreateFormats)
+	}
+
+	wantIntroductionPoints := []struct {
+		address     string
+		port        int
+		fingerprint string
+		onionKey    string
+	}{
+		{"91.221.119.33", 443, "19D0CC7A5B977320BAB01F7B202F94C91BA95066",
+			"d78bcd7d493aefa00703f5a8265932916d1811fa7aada2377f348d6834b9800c"},
+		{"185.220.101.7", 444, "068D76CF4687EFD92C6A80ABDA95403FADC05F23",
+			"188a07bc6d37947a92f1ed22ce8270b19c260c1dcad61ada30f36e3726164cee"},
+		{"5.9.158.75", 445, "84AC4FBF6953C88D5E09388CD0779C2066AA7782",
+			"c2fc2e58d5a4da61273cd1cc5ad0ccdeba6fcf0a8b08af8e2b804d4243f77cde"},
+	}
+
+	if len(encryptedLayer.IntroductionPoints) != len(wantIntroductionPoints) {
+		t.Fatalf("expected %v introduction points got %v", len(wantIntroductionPoints),
+			len(encryptedLayer.IntroductionPoints))
+	}
+
+	for i, want := range wantIntroductionPoints {
+		got := encryptedLayer.IntroductionPoints[i]
+
+		address, port := got.Address()
+		if !address.Equal(net.ParseIP(want.address)) || port != want.port {
+			t.Errorf("expected %v:%v got %v:%v", want.address, want.port, address, port)
+		}
+
+		if got.Fingerprint() != want.fingerprint {
+			t.Errorf("expected fingerprint %v got %v", want.fingerprint, got.Fingerprint())
+		}
+
+		if hex.EncodeToString(got.OnionKey) != want.onionKey {
+			t.Errorf("expected onion key %v got %x", want.onionKey, got.OnionKey)
+		}
+
+		if len(got.EncKey) != 32 {
+			t.Errorf("expected 32 byte enc key got %v", len(got.EncKey))
+		}
+
+		if err := got.AuthKeyCert.Verify(desc.SigningKeyCert.CertifiedKey); err != nil {
+			t.Errorf("failed to verify auth key cert: %v", err)
+		}
+
+		if err := got.EncKeyCert.Verify(desc.SigningKeyCert.CertifiedKey); err != nil {
+			t.Errorf("failed to verify enc key cert: %v", err)
+		}
+	}
+
+	introductionPoints, err := desc.IntroductionPoints(testIdentityKeyV3, nil)
+	if err != nil {
+		t.Fatalf("failed to get introduction points: %v", err)
+	}
+
+	if !reflect.DeepEqual(encryptedLayer.IntroductionPoints, introductionPoints) {
+		t.Errorf("expected %#v got %#v", encryptedLayer.IntroductionPoints, introductionPoints)
+	}
+}
+
+func TestHiddenServiceDescriptorV3DecryptWrongKey(t *testing.T) {
+	t.Parallel()
+
+	desc, err := ParseHiddenServiceDescriptorV3(testDescriptorV3Raw)
+	if err != nil {
+		t.Fatalf("failed to parse v3 hidden service descriptor: %v", err)
+	}
+
+	wrongKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	if _, err := desc.IntroductionPoints(wrongKey, nil); err == nil {
+		t.Errorf("expected MAC mismatch error")
+	}
+}
+
+func TestParseLinkSpecifiers(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		input   string
+		want    []LinkSpecifier
+		wantErr bool
+	}{
+		{
+			name:  "ipv4 and legacy id",
+			input: "AgAGfwAAAQG7AgQBAgME",
+			want: []LinkSpecifier{
+				{Type: LinkSpecifierIPv4, Data: []byte{127, 0, 0, 1, 1, 187}},
+				{Type: LinkSpecifierLegacyID, Data: []byte{1, 2, 3, 4}},
+			},
+		},
+		{
+			name:    "truncated",
+			input:   "AgAGfwAAAQG7AgQBAg",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			input:   "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseLinkSpecifiers(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v got %v", tt.wantErr, err)
+			}
+
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("expected %#v got %#v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestParseHiddenServiceDescriptorV3(t *testing.T) {
+	t.Parallel()
+
+	got, err := ParseHiddenServiceDescriptorV3(testDescriptorV3Raw)
+	if err != nil {
+		t.Fatalf("failed to parse v3 hidden service descriptor: %v", err)
+	}
+
+	if got.Version != 3 {
+		t.Errorf("expected version 3 got %v", got.Version)
+	}
+
+	if got.Lifetime != 180 {
+		t.Errorf("expected lifetime 180 got %v", got.Lifetime)
+	}
+
+	if got.RevisionCounter != 1534165200 {
+		t.Errorf("expected revision counter 1534165200 got %v", got.RevisionCounter)
+	}
+
+	if got.Raw != testDescriptorV3Raw {
+		t.Errorf("expected raw descriptor to be kept")
+	}
+
+	wantSigningKeyCertRaw := "-----BEGIN ED25519 CERT-----\n" +
+		"AQgABoDjAcWqGWrJKtofGedYF11GjB8Is3QT55F16P5AdlNhUNvWAQAgBADoGfGY\n" +
+		"d+q+xRZucEOe0ktv4zrcdLyDDQFAsHlsVCkJLW253AV2uRQYDsKUxbQjwQUYMPMA\n" +
+		"HgF9a1TQuTINBHcIFLwZJKLqBZXUuVbAuETu/8dPAOHgHUTsc/ixtpfeAA0=\n" +
+		"-----END ED25519 CERT-----\n"
+	if got.SigningKeyCertRaw != wantSigningKeyCertRaw {
+		t.Errorf("expected signing key cert %v got %v", wantSigningKeyCertRaw, got.SigningKeyCertRaw)
+	}
+
+	if got.SigningKeyCert.Type != CertTypeSigningKey {
+		t.Errorf("expected cert type %v got %v", CertTypeSigningKey, got.SigningKeyCert.Type)
+	}
+
+	wantExpiration := time.Date(2018, 8, 15, 19, 0, 0, 0, time.UTC)
+	if !got.SigningKeyCert.ExpirationDate.Equal(wantExpiration) {
+		t.Errorf("expected expiration %v got %v", wantExpiration, got.SigningKeyCert.ExpirationDate)
+	}
+
+	wantCertifiedKey := "c5aa196ac92ada1f19e758175d468c1f08b37413e79175e8fe4076536150dbd6"
+	if gotCertifiedKey := hex.EncodeToString(got.SigningKeyCert.CertifiedKey); gotCertifiedKey != wantCertifiedKey {
+		t.Errorf("expected certified key %v got %v", wantCertifiedKey, gotCertifiedKey)
+	}
+
+	wantBlindedKey := "e819f19877eabec5166e70439ed24b6fe33adc74bc830d0140b0796c5429092d"
+	if gotBlindedKey := hex.EncodeToString(got.SigningKeyCert.SigningKey()); gotBlindedKey != wantBlindedKey {
+		t.Errorf("expected blinded key %v got %v", wantBlindedKey, gotBlindedKey)
+	}
+
+	if err := got.SigningKeyCert.Verify(nil); err != nil {
+		t.Errorf("failed to verify signing key cert: %v", err)
+	}
+
+	wantSignature := "4e3480425d61f4f484811d075fd08bab3b2a8ba1b7b21b8c86a930c53168bf1f" +
+		"7866f11fe6a08a0bb1fca30ba47aa932c68b7719bd61b39e9298adcf90f33109"
+	if gotSignature := hex.EncodeToString(got.Signature); gotSignature != wantSignature {
+		t.Errorf("expected signature %v got %v", wantSignature, gotSignature)
+	}
+
+	if len(got.Superencrypted) != 10048 {
+		t.Errorf("expected 10048 bytes of superencrypted data got %v", len(got.Superencrypted))
+	}
+}
+
+func TestParseHiddenServiceDescriptorV3Errors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		input string
+	}{
+		{
+			name:  "v2 descriptor",
+			input: testDescriptorRaw,
+		},
+		{
+			name:  "unsupported version",
+			input: strings.Replace(testDescriptorV3Raw, "hs-descriptor 3", "hs-descriptor 4", 1),
+		},
+		{
+			name:  "bad revision counter",
+			input: strings.Replace(testDescriptorV3Raw, "revision-counter 1534165200", "revision-counter abc", 1),
+		},
+		{
+			name:  "missing signature",
+			input: testDescriptorV3Raw[:strings.Index(testDescriptorV3Raw, "signature ")],
+		},
+		{
+			name:  "bad certificate",
+			input: strings.Replace(testDescriptorV3Raw, "AQgABoDjAcWqGWrJ", "AggABoDjAcWqGWrJ", 1),
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := ParseHiddenServiceDescriptorV3(tt.input); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestHiddenServiceDescriptorV3_Verify(t *testing.T) {
+	t.Parallel()
+
+	published := time.Date(2018, time.August, 13, 13, 0, 0, 0, time.UTC)
+
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name         string
+		raw          string
+		identityKey  ed25519.PublicKey
+		now          time.Time
+		periodLength int64
+
+		expectedErr bool
+	}{
+		{
+			"OK",
+			testDescriptorV3Raw,
+			testIdentityKeyV3,
+			published,
+			common.TimePeriodLengthV3,
+			false,
+		},
+		{
+			"OK - next time period",
+			testDescriptorV3Raw,
+			testIdentityKeyV3,
+			published.Add(24 * time.Hour),
+			common.TimePeriodLengthV3,
+			false,
+		},
+		{
+			"fail - tampered descriptor",
+			strings.Replace(testDescriptorV3Raw, "descriptor-lifetime 180", "descriptor-lifetime 181", 1),
+			testIdentityKeyV3,
+			published,
+			common.TimePeriodLengthV3,
+			true,
+		},
+		{
+			"fail - wrong identity key",
+			testDescriptorV3Raw,
+			otherKey,
+			published,
+			common.TimePeriodLengthV3,
+			true,
+		},
+		{
+			"fail - wrong time period",
+			testDescriptorV3Raw,
+			testIdentityKeyV3,
+			published.Add(-72 * time.Hour),
+			common.TimePeriodLengthV3,
+			true,
+		},
+		{
+			"fail - expired certificate",
+			testDescriptorV3Raw,
+			testIdentityKeyV3,
+			published.Add(54 * time.Hour),
+			common.TimePeriodLengthV3,
+			true,
+		},
+		{
+			"fail - other period length",
+			testDescriptorV3Raw,
+			testIdentityKeyV3,
+			published,
+			60,
+			true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			desc, err := ParseHiddenServiceDescriptorV3(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = desc.Verify(tt.identityKey, tt.now, tt.periodLength); (err != nil) != tt.expectedErr {
+				t.Errorf("expected error %v got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestGenerateDescriptorRawV3(t *testing.T) {
+	t.Parallel()
+
+	backendDescriptor, err := ParseHiddenServiceDescriptorV3(testDescriptorV3Raw)
+	if err != nil {
+		t.Fatalf("failed to parse v3 hidden service descriptor: %v", err)
+	}
+
+	introductionPoints, err := backendDescriptor.IntroductionPoints(testIdentityKeyV3, nil)
+	if err != nil {
+		t.Fatalf("failed to get introduction points: %v", err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	publishedTime := time.Date(2018, 8, 14, 9, 30, 0, 0, time.UTC)
+	timePeriod := common.TimePeriodV3(publishedTime, common.TimePeriodLengthV3)
+
+	descriptorRaw, err := GenerateDescriptorRawV3(introductionPoints, publishedTime, timePeriod,
+		common.TimePeriodLengthV3, 0, publicKey, common.ExpandEd25519PrivateKey(privateKey), nil)
+	if err != nil {
+		t.Fatalf("failed to generate descriptor: %v", err)
+	}
+
+	got, err := ParseHiddenServiceDescriptorV3(string(descriptorRaw))
+	if err != nil {
+		t.Fatalf("failed to parse generated descriptor: %v", err)
+	}
+
+	if got.RevisionCounter != uint64(publishedTime.Unix()) {
+		t.Errorf("expected revision counter %v got %v", publishedTime.Unix(), got.RevisionCounter)
+	}
+
+	blindedKey, err := common.BlindEd25519PublicKey(publicKey, timePeriod, common.TimePeriodLengthV3)
+	if err != nil {
+		t.Fatalf("failed to blind key: %v", err)
+	}
+
+	if !bytes.Equal(blindedKey, got.SigningKeyCert.SigningKey()) {
+		t.Errorf("expected blinded key %x got %x", blindedKey, got.SigningKeyCert.SigningKey())
+	}
+
+	if err := got.SigningKeyCert.Verify(blindedKey); err != nil {
+		t.Errorf("failed to verify signing key cert: %v", err)
+	}
+
+	if err := got.Verify(publicKey, publishedTime, common.TimePeriodLengthV3); err != nil {
+		t.Errorf("failed to verify generated descriptor: %v", err)
+	}
+
+	gotIntroductionPoints, err := got.IntroductionPoints(publicKey, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt generated descriptor: %v", err)
+	}
+
+	if len(gotIntroductionPoints) != len(introductionPoints) {
+		t.Fatalf("expected %v introduction points got %v", len(introductionPoints), len(gotIntroductionPoints))
+	}
+
+	for i, gotIntroductionPoint := range gotIntroductionPoints {
+		want := introductionPoints[i]
+		if !reflect.DeepEqual(want.LinkSpecifiers, gotIntroductionPoint.LinkSpecifiers) ||
+			!bytes.Equal(want.OnionKey, gotIntroductionPoint.OnionKey) ||
+			!bytes.Equal(want.EncKey, gotIntroductionPoint.EncKey) ||
+			!bytes.Equal(want.AuthKeyCert.CertifiedKey, gotIntroductionPoint.AuthKeyCert.CertifiedKey) {
+			t.Errorf("expected %#v got %#v", want, gotIntroductionPoint)
+		}
+
+		// Certificates are reissued by the new descriptor signing key
+		if err := gotIntroductionPoint.AuthKeyCert.Verify(got.SigningKeyCert.CertifiedKey); err != nil {
+			t.Errorf("failed to verify auth key cert: %v", err)
+		}
+
+		if err := gotIntroductionPoint.EncKeyCert.Verify(got.SigningKeyCert.CertifiedKey); err != nil {
+			t.Errorf("failed to verify enc key cert: %v", err)
+		}
+	}
+}
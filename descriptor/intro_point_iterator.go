@@ -1,32 +1,65 @@
 package descriptor
 
-// IntroductionPointsIterator is a stateful iterator for introduction points
-type IntroductionPointsIterator struct {
-	introductionPoints []IntroductionPoint
+// IntroductionPointRef refers to an introduction point by the index of its backend instance and its index among
+// the introduction points of that backend, so the iterators and selectors work for v2 and v3 introduction points
+type IntroductionPointRef struct {
+	Backend int
+	Index   int
+}
 
-	currentPos int
+// IntroductionPointsIterator returns the introduction points of each of the descriptors published to the hsdirs
+type IntroductionPointsIterator interface {
+	Next() []IntroductionPointRef
 }
 
-// sortIntroductionPoints sorts introduction points in a round robin fashion given a set of
-// introduction points per backend instance.
-func sortIntroductionPoints(backendIntroductionPoints [][]IntroductionPoint) []IntroductionPoint {
+// IntroductionPointsAt returns the v2 introduction points the refs refer to
+func IntroductionPointsAt(backendIntroductionPoints [][]IntroductionPoint,
+	refs []IntroductionPointRef) []IntroductionPoint {
 	var introductionPoints []IntroductionPoint
+	for _, ref := range refs {
+		introductionPoints = append(introductionPoints, backendIntroductionPoints[ref.Backend][ref.Index])
+	}
+
+	return introductionPoints
+}
+
+// IntroductionPointsV3At returns the v3 introduction points the refs refer to
+func IntroductionPointsV3At(backendIntroductionPoints [][]IntroductionPointV3,
+	refs []IntroductionPointRef) []IntroductionPointV3 {
+	var introductionPoints []IntroductionPointV3
+	for _, ref := range refs {
+		introductionPoints = append(introductionPoints, backendIntroductionPoints[ref.Backend][ref.Index])
+	}
+
+	return introductionPoints
+}
+
+// roundRobinIterator is a stateful iterator for introduction points
+type roundRobinIterator struct {
+	introductionPoints []IntroductionPointRef
+	size               int
+
+	currentPos int
+}
+
+// sortIntroductionPoints sorts introduction points in a round robin fashion given the number of introduction
+// points of each backend instance.
+func sortIntroductionPoints(counts []int) []IntroductionPointRef {
+	var introductionPoints []IntroductionPointRef
 
 	// get max len
 	maxLen := 0
-	for _, introductionPoints := range backendIntroductionPoints {
-		len := len(introductionPoints)
-		if len > maxLen {
-			maxLen = len
+	for _, count := range counts {
+		if count > maxLen {
+			maxLen = count
 		}
-
 	}
 
 	// sort all the introduction points from the diffrent backend instances in a round robin fashioned
 	for i := 0; i < maxLen; i++ {
-		for j := 0; j < len(backendIntroductionPoints); j++ {
-			if len(backendIntroductionPoints[j]) > i {
-				introductionPoints = append(introductionPoints, backendIntroductionPoints[j][i])
+		for j, count := range counts {
+			if count > i {
+				introductionPoints = append(introductionPoints, IntroductionPointRef{Backend: j, Index: i})
 			}
 		}
 	}
@@ -35,16 +68,19 @@ func sortIntroductionPoints(backendIntroductionPoints [][]IntroductionPoint) []I
 }
 
 // Next returns the next IntroductionPoint in the cycle
-func (ips *IntroductionPointsIterator) Next() []IntroductionPoint {
+func (ips *roundRobinIterator) Next() []IntroductionPointRef {
 	start := ips.currentPos
 	len := len(ips.introductionPoints)
+	if len <= ips.size {
+		return ips.introductionPoints
+	}
 
-	ips.currentPos = ips.currentPos + 10
+	ips.currentPos = ips.currentPos + ips.size
 	if ips.currentPos <= len {
 		return ips.introductionPoints[start:ips.currentPos]
 	}
 
-	next := ips.introductionPoints[start:len]
+	next := append([]IntroductionPointRef{}, ips.introductionPoints[start:len]...)
 
 	ips.currentPos = ips.currentPos % len
 	next = append(next, ips.introductionPoints[0:ips.currentPos]...)
@@ -52,10 +88,119 @@ func (ips *IntroductionPointsIterator) Next() []IntroductionPoint {
 	return next
 }
 
-// NewIntroductionPointsIterator returns a new NewIntroductionPointsIterator
-func NewIntroductionPointsIterator(introductionPoints [][]IntroductionPoint) *IntroductionPointsIterator {
-	return &IntroductionPointsIterator{
+// NewIntroductionPointsIterator returns a new round robin IntroductionPointsIterator over backend instances with
+// counts introduction points each, that returns size introduction points at a time
+func NewIntroductionPointsIterator(counts []int, size int) IntroductionPointsIterator {
+	return &roundRobinIterator{
 		currentPos:         0,
-		introductionPoints: sortIntroductionPoints(introductionPoints),
+		size:               size,
+		introductionPoints: sortIntroductionPoints(counts),
+	}
+}
+
+// WeightedIntroductionPointsIterator is a stateful iterator for introduction points that gives every backend
+// instance a share of the slots proportional to its weight. Slots are handed out with smooth weighted round robin
+// which carries over between sets, so backends with a small weight still show up in some of the sets.
+type WeightedIntroductionPointsIterator struct {
+	counts  []int
+	weights []int
+	size    int
+	// maxPerBackend limits the slots of a backend in a set, zero means no limit
+	maxPerBackend int
+
+	currentWeights []int
+	positions      []int
+}
+
+// Next returns the next set of introduction points, a backend never has more slots in a set than introduction points
+func (ips *WeightedIntroductionPointsIterator) Next() []IntroductionPointRef {
+	slots := make([]int, len(ips.counts))
+	for n := 0; n < ips.size; n++ {
+		selected, totalWeight := -1, 0
+		for i, count := range ips.counts {
+			if slots[i] >= count || (ips.maxPerBackend > 0 && slots[i] >= ips.maxPerBackend) {
+				continue
+			}
+
+			ips.currentWeights[i] += ips.weights[i]
+			totalWeight += ips.weights[i]
+			if selected < 0 || ips.currentWeights[i] > ips.currentWeights[selected] {
+				selected = i
+			}
+		}
+
+		if selected < 0 {
+			break
+		}
+
+		ips.currentWeights[selected] -= totalWeight
+		slots[selected]++
+	}
+
+	var next []IntroductionPointRef
+	for i, count := range ips.counts {
+		for n := 0; n < slots[i]; n++ {
+			next = append(next, IntroductionPointRef{Backend: i, Index: (ips.positions[i] + n) % count})
+		}
+
+		if count > 0 {
+			ips.positions[i] = (ips.positions[i] + slots[i]) % count
+		}
 	}
+
+	return next
+}
+
+// NewWeightedIntroductionPointsIterator returns a new WeightedIntroductionPointsIterator over backend instances
+// with counts introduction points each, that returns size introduction points at a time. weights holds the weight
+// of each backend instance.
+func NewWeightedIntroductionPointsIterator(counts []int, weights []int,
+	size int) *WeightedIntroductionPointsIterator {
+	return &WeightedIntroductionPointsIterator{
+		counts:         counts,
+		weights:        weights,
+		size:           size,
+		currentWeights: make([]int, len(counts)),
+		positions:      make([]int, len(counts)),
+	}
+}
+
+// WeightedIntroductionPoints returns the largest set of introduction points in which the number of introduction
+// points of every backend instance is proportional to its weight, every backend keeps at least one
+func WeightedIntroductionPoints(counts []int, weights []int) []IntroductionPointRef {
+	// the backend with the fewest introduction points per weight limits the size of the set
+	limiting := -1
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+
+		if limiting < 0 || count*weights[limiting] < counts[limiting]*weights[i] {
+			limiting = i
+		}
+	}
+
+	var introductionPoints []IntroductionPointRef
+	if limiting < 0 {
+		return introductionPoints
+	}
+
+	limitingLen, limitingWeight := counts[limiting], weights[limiting]
+	for i, count := range counts {
+		// rounded weight * limitingLen / limitingWeight
+		selected := (2*weights[i]*limitingLen + limitingWeight) / (2 * limitingWeight)
+		if selected < 1 {
+			selected = 1
+		}
+
+		if selected > count {
+			selected = count
+		}
+
+		for n := 0; n < selected; n++ {
+			introductionPoints = append(introductionPoints, IntroductionPointRef{Backend: i, Index: n})
+		}
+	}
+
+	return introductionPoints
 }
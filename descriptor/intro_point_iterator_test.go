@@ -5,6 +5,16 @@ import (
 	"testing"
 )
 
+// introductionPointCounts returns the number of introduction points of every backend
+func introductionPointCounts(introPoints [][]IntroductionPoint) []int {
+	var counts []int
+	for _, backendIntroPoints := range introPoints {
+		counts = append(counts, len(backendIntroPoints))
+	}
+
+	return counts
+}
+
 func TestSortIntroductionPoints(t *testing.T) {
 	introPoints := [][]IntroductionPoint{
 		{
@@ -33,7 +43,8 @@ func TestSortIntroductionPoints(t *testing.T) {
 		{Identifier: "c7"}, {Identifier: "a8"}, {Identifier: "b8"}, {Identifier: "c8"},
 		{Identifier: "b9"}}
 
-	if got := sortIntroductionPoints(introPoints); !reflect.DeepEqual(got, want) {
+	got := IntroductionPointsAt(introPoints, sortIntroductionPoints(introductionPointCounts(introPoints)))
+	if !reflect.DeepEqual(got, want) {
 		t.Errorf("expected %v got %v", want, got)
 	}
 }
@@ -57,9 +68,9 @@ func TestIntroductionPointsIteratorNext(t *testing.T) {
 		},
 	}
 
-	itr := NewIntroductionPointsIterator(introPoints)
+	itr := NewIntroductionPointsIterator(introductionPointCounts(introPoints), 10)
 
-	want := sortIntroductionPoints(introPoints)
+	want := sortIntroductionPoints(introductionPointCounts(introPoints))
 	if got := itr.Next(); !reflect.DeepEqual(got, want[0:10]) {
 		t.Errorf("expected %v got %v", want, got)
 	}
@@ -73,3 +84,122 @@ func TestIntroductionPointsIteratorNext(t *testing.T) {
 		t.Errorf("expected %v got %v", want, got)
 	}
 }
+
+func TestIntroductionPointsV3At(t *testing.T) {
+	introPoints := [][]IntroductionPointV3{
+		{{Raw: "a1"}, {Raw: "a2"}, {Raw: "a3"}},
+		{{Raw: "b1"}, {Raw: "b2"}},
+	}
+
+	itr := NewIntroductionPointsIterator([]int{3, 2}, 2)
+
+	want := [][]IntroductionPointV3{
+		{{Raw: "a1"}, {Raw: "b1"}},
+		{{Raw: "a2"}, {Raw: "b2"}},
+		{{Raw: "a3"}, {Raw: "a1"}},
+		{{Raw: "b1"}, {Raw: "a2"}},
+	}
+
+	for i, w := range want {
+		if got := IntroductionPointsV3At(introPoints, itr.Next()); !reflect.DeepEqual(got, w) {
+			t.Errorf("%d: expected %v got %v", i, w, got)
+		}
+	}
+}
+
+func TestWeightedIntroductionPointsIteratorNext(t *testing.T) {
+	introPoints := [][]IntroductionPoint{
+		{{Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "a3"}, {Identifier: "a4"}},
+		{{Identifier: "b1"}, {Identifier: "b2"}, {Identifier: "b3"}},
+		{{Identifier: "c1"}},
+	}
+
+	itr := NewWeightedIntroductionPointsIterator(introductionPointCounts(introPoints[:2]), []int{3, 1}, 4)
+
+	want := [][]IntroductionPoint{
+		{{Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "a3"}, {Identifier: "b1"}},
+		{{Identifier: "a4"}, {Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "b2"}},
+	}
+
+	for i, w := range want {
+		if got := IntroductionPointsAt(introPoints, itr.Next()); !reflect.DeepEqual(got, w) {
+			t.Errorf("%d: expected %v got %v", i, w, got)
+		}
+	}
+
+	// a backend never gets more slots than it has introduction points
+	itr = NewWeightedIntroductionPointsIterator(introductionPointCounts(introPoints), []int{1, 1, 100}, 4)
+	for i := 0; i < 5; i++ {
+		next := IntroductionPointsAt(introPoints, itr.Next())
+		if len(next) != 4 {
+			t.Fatalf("expected 4 introduction points got %d", len(next))
+		}
+
+		seen := make(map[string]bool)
+		for _, introductionPoint := range next {
+			if seen[introductionPoint.Identifier] {
+				t.Errorf("%d: duplicate introduction point %s", i, introductionPoint.Identifier)
+			}
+			seen[introductionPoint.Identifier] = true
+		}
+	}
+
+	// a backend with a small weight gets a slot in some of the sets
+	itr = NewWeightedIntroductionPointsIterator(introductionPointCounts(introPoints[:2]), []int{9, 1}, 2)
+	slots := make(map[int]int)
+	for i := 0; i < 10; i++ {
+		for _, ref := range itr.Next() {
+			slots[ref.Backend]++
+		}
+	}
+
+	if slots[0] != 18 || slots[1] != 2 {
+		t.Errorf("expected 18 slots for a and 2 for b got %d and %d", slots[0], slots[1])
+	}
+}
+
+func TestWeightedIntroductionPoints(t *testing.T) {
+	introPoints := [][]IntroductionPoint{
+		{{Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "a3"}},
+		{{Identifier: "b1"}, {Identifier: "b2"}, {Identifier: "b3"}},
+	}
+
+	testCases := []struct {
+		name    string
+		weights []int
+
+		want []IntroductionPoint
+	}{
+		{
+			"equal weights",
+			[]int{1, 1},
+			[]IntroductionPoint{
+				{Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "a3"},
+				{Identifier: "b1"}, {Identifier: "b2"}, {Identifier: "b3"},
+			},
+		},
+		{
+			"3 to 1",
+			[]int{3, 1},
+			[]IntroductionPoint{{Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "a3"}, {Identifier: "b1"}},
+		},
+		{
+			"every backend keeps one",
+			[]int{1, 10},
+			[]IntroductionPoint{{Identifier: "a1"}, {Identifier: "b1"}, {Identifier: "b2"}, {Identifier: "b3"}},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := IntroductionPointsAt(introPoints,
+				WeightedIntroductionPoints(introductionPointCounts(introPoints), tt.weights))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package descriptor
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the introduction point selection strategies
+const (
+	SelectionRoundRobin    = "round-robin"
+	SelectionShuffle       = "shuffle"
+	SelectionWeighted      = "weighted"
+	SelectionMaxPerBackend = "max-per-backend"
+	SelectionDiversity     = "diversity"
+)
+
+// IntroductionPointRelay is the relay an introduction point is on
+type IntroductionPointRelay struct {
+	// Fingerprint is the uppercase hex fingerprint of the relay, it is empty when it isn't known
+	Fingerprint string
+	Address     net.IP
+}
+
+// BackendIntroductionPoints holds the relays of the introduction points of a backend instance, in order
+type BackendIntroductionPoints struct {
+	Address string
+	Relays  []IntroductionPointRelay
+}
+
+// NewBackendIntroductionPoints returns the BackendIntroductionPoints of a backend with v2 introduction points
+func NewBackendIntroductionPoints(address string, introductionPoints []IntroductionPoint) BackendIntroductionPoints {
+	backend := BackendIntroductionPoints{Address: address}
+	for _, introductionPoint := range introductionPoints {
+		// an identifier that isn't base32 leaves the fingerprint empty
+		fingerprint, _ := relayFingerprint(introductionPoint)
+		backend.Relays = append(backend.Relays, IntroductionPointRelay{
+			Fingerprint: fingerprint,
+			Address:     introductionPoint.Address,
+		})
+	}
+
+	return backend
+}
+
+// NewBackendIntroductionPointsV3 returns the BackendIntroductionPoints of a backend with v3 introduction points
+func NewBackendIntroductionPointsV3(address string,
+	introductionPoints []IntroductionPointV3) BackendIntroductionPoints {
+	backend := BackendIntroductionPoints{Address: address}
+	for _, introductionPoint := range introductionPoints {
+		ip, _ := introductionPoint.Address()
+		backend.Relays = append(backend.Relays, IntroductionPointRelay{
+			Fingerprint: introductionPoint.Fingerprint(),
+			Address:     ip,
+		})
+	}
+
+	return backend
+}
+
+// IntroductionPointSelector decides which introduction points of the backend instances end up in the balanced
+// descriptors
+type IntroductionPointSelector interface {
+	// Select returns the introduction points of the descriptor that is published to all the hsdirs, it is used
+	// when the introduction points of all the backends fit in a single descriptor
+	Select(backends []BackendIntroductionPoints, size int) []IntroductionPointRef
+	// Iterator returns the iterator over the introduction points of the descriptors published to each hsdir
+	Iterator(backends []BackendIntroductionPoints, size int) IntroductionPointsIterator
+}
+
+// countsOf returns the number of introduction points of every backend
+func countsOf(backends []BackendIntroductionPoints) []int {
+	var counts []int
+	for _, backend := range backends {
+		counts = append(counts, len(backend.Relays))
+	}
+
+	return counts
+}
+
+// RoundRobinSelector publishes all the introduction points in a single descriptor and otherwise iterates over
+// them in a round robin fashion
+type RoundRobinSelector struct{}
+
+// Select returns all the introduction points
+func (s *RoundRobinSelector) Select(backends []BackendIntroductionPoints, size int) []IntroductionPointRef {
+	var introductionPoints []IntroductionPointRef
+	for i, backend := range backends {
+		for j := range backend.Relays {
+			introductionPoints = append(introductionPoints, IntroductionPointRef{Backend: i, Index: j})
+		}
+	}
+
+	return introductionPoints
+}
+
+// Iterator returns a round robin iterator
+func (s *RoundRobinSelector) Iterator(backends []BackendIntroductionPoints, size int) IntroductionPointsIterator {
+	return NewIntroductionPointsIterator(countsOf(backends), size)
+}
+
+// ShuffleSelector picks a random sample of the introduction points for every descriptor
+type ShuffleSelector struct {
+	rand     *rand.Rand
+	randLock sync.Mutex
+}
+
+// shuffleIterator returns a new random sample of introduction points for every set
+type shuffleIterator struct {
+	selector           *ShuffleSelector
+	introductionPoints []IntroductionPointRef
+	size               int
+}
+
+// sample returns up to size randomly picked introduction points
+func (s *ShuffleSelector) sample(introductionPoints []IntroductionPointRef, size int) []IntroductionPointRef {
+	s.randLock.Lock()
+	permutation := s.rand.Perm(len(introductionPoints))
+	s.randLock.Unlock()
+
+	if len(permutation) > size {
+		permutation = permutation[:size]
+	}
+
+	var sample []IntroductionPointRef
+	for _, i := range permutation {
+		sample = append(sample, introductionPoints[i])
+	}
+
+	return sample
+}
+
+// Select returns a random sample of the introduction points
+func (s *ShuffleSelector) Select(backends []BackendIntroductionPoints, size int) []IntroductionPointRef {
+	return s.sample(sortIntroductionPoints(countsOf(backends)), size)
+}
+
+// Iterator returns an iterator that returns a random sample for every descriptor
+func (s *ShuffleSelector) Iterator(backends []BackendIntroductionPoints, size int) IntroductionPointsIterator {
+	return &shuffleIterator{
+		selector:           s,
+		introductionPoints: sortIntroductionPoints(countsOf(backends)),
+		size:               size,
+	}
+}
+
+// Next returns a new random sample of introduction points
+func (ips *shuffleIterator) Next() []IntroductionPointRef {
+	return ips.selector.sample(ips.introductionPoints, ips.size)
+}
+
+// NewShuffleSelector returns a new ShuffleSelector
+func NewShuffleSelector() *ShuffleSelector {
+	return &ShuffleSelector{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// WeightedSelector gives every backend a share of the introduction points proportional to its weight
+type WeightedSelector struct {
+	weights map[string]int
+}
+
+// weightsOf returns the weight of every backend, backends without a weight have a weight of 1
+func (s *WeightedSelector) weightsOf(backends []BackendIntroductionPoints) []int {
+	var weights []int
+	for _, backend := range backends {
+		weight, ok := s.weights[backend.Address]
+		if !ok {
+			weight = 1
+		}
+
+		weights = append(weights, weight)
+	}
+
+	return weights
+}
+
+// Select returns the largest set of introduction points that is proportional to the weights
+func (s *WeightedSelector) Select(backends []BackendIntroductionPoints, size int) []IntroductionPointRef {
+	introductionPoints := WeightedIntroductionPoints(countsOf(backends), s.weightsOf(backends))
+	if len(introductionPoints) > size {
+		introductionPoints = introductionPoints[:size]
+	}
+
+	return introductionPoints
+}
+
+// Iterator returns a weighted iterator
+func (s *WeightedSelector) Iterator(backends []BackendIntroductionPoints, size int) IntroductionPointsIterator {
+	return NewWeightedIntroductionPointsIterator(countsOf(backends), s.weightsOf(backends), size)
+}
+
+// NewWeightedSelector returns a new WeightedSelector given the weights of the backends keyed by address
+func NewWeightedSelector(weights map[string]int) *WeightedSelector {
+	return &WeightedSelector{
+		weights: weights,
+	}
+}
+
+// MaxPerBackendSelector puts at most a fixed number of introduction points of every backend in a descriptor
+type MaxPerBackendSelector struct {
+	max int
+}
+
+// Select returns up to max introduction points of every backend
+func (s *MaxPerBackendSelector) Select(backends []BackendIntroductionPoints, size int) []IntroductionPointRef {
+	var introductionPoints []IntroductionPointRef
+	for i, backend := range backends {
+		count := len(backend.Relays)
+		if count > s.max {
+			count = s.max
+		}
+
+		for j := 0; j < count; j++ {
+			introductionPoints = append(introductionPoints, IntroductionPointRef{Backend: i, Index: j})
+		}
+	}
+
+	if len(introductionPoints) > size {
+		introductionPoints = introductionPoints[:size]
+	}
+
+	return introductionPoints
+}
+
+// Iterator returns an iterator that spreads the slots evenly over the backends, up to max each
+func (s *MaxPerBackendSelector) Iterator(backends []BackendIntroductionPoints, size int) IntroductionPointsIterator {
+	weights := make([]int, len(backends))
+	for i := range weights {
+		weights[i] = 1
+	}
+
+	iterator := NewWeightedIntroductionPointsIterator(countsOf(backends), weights, size)
+	iterator.maxPerBackend = s.max
+
+	return iterator
+}
+
+// NewMaxPerBackendSelector returns a new MaxPerBackendSelector
+func NewMaxPerBackendSelector(max int) *MaxPerBackendSelector {
+	return &MaxPerBackendSelector{
+		max: max,
+	}
+}
+
+// RelayFamilies tells whether two relays, given by their hex fingerprints, are in the same family
+type RelayFamilies interface {
+	SameFamily(string, string) bool
+}
+
+// DiversitySelector avoids putting introduction points on the same relay, in the same /16 (/32 for IPv6) or on
+// relays of the same family in a descriptor. When there aren't enough unrelated introduction points to fill a
+// descriptor the remaining slots are filled in round robin order.
+type DiversitySelector struct {
+	families RelayFamilies
+}
+
+// diversityIterator is a stateful iterator over diverse sets of introduction points
+type diversityIterator struct {
+	selector           *DiversitySelector
+	backends           []BackendIntroductionPoints
+	introductionPoints []IntroductionPointRef
+	size               int
+
+	currentPos int
+}
+
+// relayFingerprint returns the uppercase hex fingerprint of the relay of an introduction point
+func relayFingerprint(introductionPoint IntroductionPoint) (string, error) {
+	decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(introductionPoint.Identifier))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToUpper(hex.EncodeToString(decoded)), nil
+}
+
+// sameSubnet returns true if both addresses are in the same /16 for IPv4 or /32 for IPv6
+func sameSubnet(a, b net.IP) bool {
+	if a == nil || b == nil {
+		return false
+	}
+
+	if a.To4() != nil && b.To4() != nil {
+		return a.Mask(net.CIDRMask(16, 32)).Equal(b.Mask(net.CIDRMask(16, 32)))
+	}
+
+	return a.Mask(net.CIDRMask(32, 128)).Equal(b.Mask(net.CIDRMask(32, 128)))
+}
+
+// related returns true if the relays are the same, share a subnet or a family
+func (s *DiversitySelector) related(a, b IntroductionPointRelay) bool {
+	if a.Fingerprint != "" && a.Fingerprint == b.Fingerprint || sameSubnet(a.Address, b.Address) {
+		return true
+	}
+
+	if s.families == nil || a.Fingerprint == "" || b.Fingerprint == "" {
+		return false
+	}
+
+	return s.families.SameFamily(a.Fingerprint, b.Fingerprint)
+}
+
+// pick returns up to size introduction points going through them from start, unrelated ones are picked first.
+// It also returns how many of the introduction points were gone through.
+func (s *DiversitySelector) pick(backends []BackendIntroductionPoints, introductionPoints []IntroductionPointRef,
+	start, size int) ([]IntroductionPointRef, int) {
+	relay := func(ref IntroductionPointRef) IntroductionPointRelay {
+		return backends[ref.Backend].Relays[ref.Index]
+	}
+
+	var picked, skipped []IntroductionPointRef
+	scanned := 0
+	for ; scanned < len(introductionPoints) && len(picked) < size; scanned++ {
+		introductionPoint := introductionPoints[(start+scanned)%len(introductionPoints)]
+
+		isRelated := false
+		for _, pickedIntroductionPoint := range picked {
+			if s.related(relay(introductionPoint), relay(pickedIntroductionPoint)) {
+				isRelated = true
+				break
+			}
+		}
+
+		if isRelated {
+			skipped = append(skipped, introductionPoint)
+			continue
+		}
+
+		picked = append(picked, introductionPoint)
+	}
+
+	// fall back to round robin for the remaining slots
+	for i := 0; i < len(skipped) && len(picked) < size; i++ {
+		picked = append(picked, skipped[i])
+	}
+
+	return picked, scanned
+}
+
+// Select returns the introduction points with the unrelated ones first
+func (s *DiversitySelector) Select(backends []BackendIntroductionPoints, size int) []IntroductionPointRef {
+	picked, _ := s.pick(backends, sortIntroductionPoints(countsOf(backends)), 0, size)
+
+	return picked
+}
+
+// Iterator returns an iterator over diverse sets of introduction points
+func (s *DiversitySelector) Iterator(backends []BackendIntroductionPoints, size int) IntroductionPointsIterator {
+	return &diversityIterator{
+		selector:           s,
+		backends:           backends,
+		introductionPoints: sortIntroductionPoints(countsOf(backends)),
+		size:               size,
+	}
+}
+
+// Next returns the next set of introduction points
+func (ips *diversityIterator) Next() []IntroductionPointRef {
+	if len(ips.introductionPoints) == 0 {
+		return nil
+	}
+
+	picked, scanned := ips.selector.pick(ips.backends, ips.introductionPoints, ips.currentPos, ips.size)
+
+	// when all the introduction points were gone through, move on like the round robin iterator
+	if scanned == len(ips.introductionPoints) {
+		scanned = ips.size
+	}
+	ips.currentPos = (ips.currentPos + scanned) % len(ips.introductionPoints)
+
+	return picked
+}
+
+// NewDiversitySelector returns a new DiversitySelector, families is optional
+func NewDiversitySelector(families RelayFamilies) *DiversitySelector {
+	return &DiversitySelector{
+		families: families,
+	}
+}
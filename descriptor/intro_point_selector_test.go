@@ -0,0 +1,230 @@
+package descriptor
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testIntroductionPoints = [][]IntroductionPoint{
+	{{Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "a3"}, {Identifier: "a4"}},
+	{{Identifier: "b1"}, {Identifier: "b2"}},
+}
+
+var testBackendIntroductionPoints = []BackendIntroductionPoints{
+	NewBackendIntroductionPoints("aaaaaaaaaaaaaaaa", testIntroductionPoints[0]),
+	NewBackendIntroductionPoints("bbbbbbbbbbbbbbbb", testIntroductionPoints[1]),
+}
+
+func TestIntroductionPointSelector_Select(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		selector IntroductionPointSelector
+		size     int
+
+		want []IntroductionPoint
+	}{
+		{
+			"round robin",
+			&RoundRobinSelector{},
+			10,
+			[]IntroductionPoint{
+				{Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "a3"}, {Identifier: "a4"},
+				{Identifier: "b1"}, {Identifier: "b2"},
+			},
+		},
+		{
+			"weighted",
+			NewWeightedSelector(map[string]int{"bbbbbbbbbbbbbbbb": 2}),
+			10,
+			[]IntroductionPoint{{Identifier: "a1"}, {Identifier: "b1"}, {Identifier: "b2"}},
+		},
+		{
+			"max per backend",
+			NewMaxPerBackendSelector(2),
+			10,
+			[]IntroductionPoint{{Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "b1"}, {Identifier: "b2"}},
+		},
+		{
+			"max per backend - limited by size",
+			NewMaxPerBackendSelector(2),
+			3,
+			[]IntroductionPoint{{Identifier: "a1"}, {Identifier: "a2"}, {Identifier: "b1"}},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := IntroductionPointsAt(testIntroductionPoints,
+				tt.selector.Select(testBackendIntroductionPoints, tt.size))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestShuffleSelector(t *testing.T) {
+	t.Parallel()
+
+	selector := NewShuffleSelector()
+	all := make(map[string]bool)
+	for _, backendIntroductionPoints := range testIntroductionPoints {
+		for _, introductionPoint := range backendIntroductionPoints {
+			all[introductionPoint.Identifier] = true
+		}
+	}
+
+	if got := selector.Select(testBackendIntroductionPoints, 10); len(got) != len(all) {
+		t.Errorf("expected all %d introduction points got %d", len(all), len(got))
+	}
+
+	itr := selector.Iterator(testBackendIntroductionPoints, 4)
+	for i := 0; i < 10; i++ {
+		next := IntroductionPointsAt(testIntroductionPoints, itr.Next())
+		if len(next) != 4 {
+			t.Fatalf("expected 4 introduction points got %d", len(next))
+		}
+
+		seen := make(map[string]bool)
+		for _, introductionPoint := range next {
+			if !all[introductionPoint.Identifier] || seen[introductionPoint.Identifier] {
+				t.Errorf("unexpected introduction point %s in %v", introductionPoint.Identifier, next)
+			}
+			seen[introductionPoint.Identifier] = true
+		}
+	}
+}
+
+func TestMaxPerBackendSelector_Iterator(t *testing.T) {
+	t.Parallel()
+
+	itr := NewMaxPerBackendSelector(1).Iterator(testBackendIntroductionPoints, 10)
+
+	want := [][]IntroductionPoint{
+		{{Identifier: "a1"}, {Identifier: "b1"}},
+		{{Identifier: "a2"}, {Identifier: "b2"}},
+		{{Identifier: "a3"}, {Identifier: "b1"}},
+	}
+
+	for i, w := range want {
+		if got := IntroductionPointsAt(testIntroductionPoints, itr.Next()); !reflect.DeepEqual(got, w) {
+			t.Errorf("%d: expected %v got %v", i, w, got)
+		}
+	}
+}
+
+// testFamilies is a RelayFamilies of mutual family pairs
+type testFamilies map[string]string
+
+func (f testFamilies) SameFamily(fingerprintA, fingerprintB string) bool {
+	return f[fingerprintA] == fingerprintB || f[fingerprintB] == fingerprintA
+}
+
+// testIntroductionPoint returns an introduction point on the relay with the given hex fingerprint
+func testIntroductionPoint(t *testing.T, fingerprint, address string) IntroductionPoint {
+	decoded, err := hex.DecodeString(fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return IntroductionPoint{
+		Identifier: strings.ToLower(base32.StdEncoding.EncodeToString(decoded)),
+		Address:    net.ParseIP(address),
+	}
+}
+
+func TestDiversitySelector(t *testing.T) {
+	t.Parallel()
+
+	const (
+		relay1 = "1111111111111111111111111111111111111111"
+		relay3 = "3333333333333333333333333333333333333333"
+		relay4 = "4444444444444444444444444444444444444444"
+		relay5 = "5555555555555555555555555555555555555555"
+	)
+
+	p1 := testIntroductionPoint(t, relay1, "10.0.1.1")
+	p2 := testIntroductionPoint(t, relay1, "172.16.0.1")
+	p3 := testIntroductionPoint(t, relay3, "192.168.1.1")
+	p4 := testIntroductionPoint(t, relay4, "10.0.9.9")
+	p5 := testIntroductionPoint(t, relay5, "8.8.8.8")
+
+	// in round robin order p1, p2, p5, p3, p4
+	introductionPoints := [][]IntroductionPoint{{p1, p3}, {p2, p4}, {p5}}
+	backends := []BackendIntroductionPoints{
+		NewBackendIntroductionPoints("aaaaaaaaaaaaaaaa", introductionPoints[0]),
+		NewBackendIntroductionPoints("bbbbbbbbbbbbbbbb", introductionPoints[1]),
+		NewBackendIntroductionPoints("cccccccccccccccc", introductionPoints[2]),
+	}
+	families := testFamilies{relay3: relay5}
+
+	testCases := []struct {
+		name     string
+		families RelayFamilies
+
+		want []IntroductionPoint
+	}{
+		{
+			"families",
+			families,
+			// p2 shares the relay of p1, p3 the family of p5 and p4 the /16 of p1, p2 is the round robin fallback
+			[]IntroductionPoint{p1, p5, p2},
+		},
+		{
+			"without families",
+			nil,
+			[]IntroductionPoint{p1, p5, p3},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := IntroductionPointsAt(introductionPoints, NewDiversitySelector(tt.families).Select(backends, 3))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v got %v", tt.want, got)
+			}
+		})
+	}
+
+	itr := NewDiversitySelector(families).Iterator(backends, 2)
+	want := [][]IntroductionPoint{{p1, p5}, {p3, p4}, {p1, p5}}
+	for i, w := range want {
+		if got := IntroductionPointsAt(introductionPoints, itr.Next()); !reflect.DeepEqual(got, w) {
+			t.Errorf("%d: expected %v got %v", i, w, got)
+		}
+	}
+}
+
+func TestSameSubnet(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"10.0.1.1", "10.0.200.3", true},
+		{"10.0.1.1", "10.1.1.1", false},
+		{"2001:db8:1::1", "2001:db8:2::1", true},
+		{"2001:db8:1::1", "2001:db9:1::1", false},
+		{"10.0.1.1", "2001:db8:1::1", false},
+		{"10.0.1.1", "", false},
+	}
+
+	for _, tt := range testCases {
+		if got := sameSubnet(net.ParseIP(tt.a), net.ParseIP(tt.b)); got != tt.expected {
+			t.Errorf("%s %s: expected %v got %v", tt.a, tt.b, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package descriptor
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// Microdescriptor represents a relay microdescriptor as defined in
+// https://gitweb.torproject.org/torspec.git/plain/dir-spec.txt
+type Microdescriptor struct {
+	Digest          string
+	OnionKey        string
+	NtorOnionKey    string
+	Family          []string
+	Ed25519Identity []byte
+	Raw             string
+}
+
+// ParseMicrodescriptors parses a list of concatenated microdescriptors, such as the output of GETINFO md/all
+func ParseMicrodescriptors(data string) ([]Microdescriptor, error) {
+	data = strings.Replace(data, "\r\n", "\n", -1)
+
+	start := strings.Index(data, "onion-key\n")
+	if start < 0 {
+		if strings.TrimSpace(data) == "" {
+			return nil, nil
+		}
+
+		return nil, errors.New("cannot find the start of the microdescriptor")
+	}
+	data = data[start:]
+
+	var microdescriptors []Microdescriptor
+	for data != "" {
+		end := strings.Index(data[1:], "\nonion-key\n")
+
+		var microdescriptorRaw string
+		if end >= 0 {
+			microdescriptorRaw, data = data[:end+2], data[end+2:]
+		} else {
+			microdescriptorRaw, data = data, ""
+		}
+
+		microdescriptor, err := parseMicrodescriptor(microdescriptorRaw)
+		if err != nil {
+			return nil, err
+		}
+
+		microdescriptors = append(microdescriptors, *microdescriptor)
+	}
+
+	return microdescriptors, nil
+}
+
+// parseMicrodescriptor parses a single microdescriptor, the digest is the unpadded base64 encoded SHA256 of its
+// raw text as it is referenced by the "m" line of a microdesc consensus
+func parseMicrodescriptor(microdescriptorRaw string) (*Microdescriptor, error) {
+	if !strings.HasSuffix(microdescriptorRaw, "\n") {
+		microdescriptorRaw += "\n"
+	}
+
+	digest := sha256.Sum256([]byte(microdescriptorRaw))
+	microdescriptor := &Microdescriptor{
+		Digest: base64.RawStdEncoding.EncodeToString(digest[:]),
+		Raw:    microdescriptorRaw,
+	}
+
+	lines := strings.Split(microdescriptorRaw, "\n")
+
+	var err error
+	for i, line := range lines {
+		words := strings.Split(line, " ")
+		switch words[0] {
+		case "onion-key":
+			microdescriptor.OnionKey, err = extractEntry("-----END RSA PUBLIC KEY-----", lines[i:])
+		case "ntor-onion-key":
+			if len(words) < 2 {
+				return nil, errors.New("missing ntor onion key")
+			}
+
+			microdescriptor.NtorOnionKey = words[1]
+		case "family":
+			microdescriptor.Family = words[1:]
+		case "id":
+			if len(words) < 3 {
+				return nil, errors.New("malformed id line")
+			}
+
+			if words[1] == "ed25519" {
+				microdescriptor.Ed25519Identity, err = decodeBase64(words[2])
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return microdescriptor, nil
+}
@@ -0,0 +1,105 @@
+package descriptor
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestParseMicrodescriptors(t *testing.T) {
+	t.Parallel()
+
+	microdescriptorsRaw, err := ioutil.ReadFile("../testdata/microdescriptors.txt")
+	if err != nil {
+		t.Fatalf("failed to read microdescriptors: %v", err)
+	}
+
+	// GETINFO md/all values start with a newline
+	got, err := ParseMicrodescriptors("\r\n" + string(microdescriptorsRaw))
+	if err != nil {
+		t.Fatalf("failed to parse microdescriptors: %v", err)
+	}
+
+	if len(got) != 8 {
+		t.Fatalf("expected 8 microdescriptors got %v", len(got))
+	}
+
+	// digests match the "m" lines of the consensus
+	if want := "mXoKsBXr5CsIv+bGRLLaJkTIR4HFGplAmyU+C90D9bc"; got[0].Digest != want {
+		t.Errorf("expected digest %v got %v", want, got[0].Digest)
+	}
+
+	if want := "zjd8RX21nIbZX040OOEdJkgtIjQQwdpdqBs4BfwpEg0="; got[0].NtorOnionKey != want {
+		t.Errorf("expected ntor onion key %v got %v", want, got[0].NtorOnionKey)
+	}
+
+	wantIdentity := "8b6f77e6b76925e62d2d56c908387533c70437d22ccc9f278ca48ca7bb2084f1"
+	if hex.EncodeToString(got[0].Ed25519Identity) != wantIdentity {
+		t.Errorf("expected ed25519 identity %v got %x", wantIdentity, got[0].Ed25519Identity)
+	}
+
+	var raw string
+	for _, microdescriptor := range got {
+		raw += microdescriptor.Raw
+	}
+
+	if raw != string(microdescriptorsRaw) {
+		t.Errorf("expected raw microdescriptors to add up to the input")
+	}
+}
+
+func TestParseMicrodescriptor(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name         string
+		input        string
+		wantNtorKey  string
+		wantFamily   []string
+		wantIdentity string
+		wantErr      bool
+	}{
+		{
+			name: "family and identity",
+			input: "onion-key\nntor-onion-key AAAA\nfamily $0011BD2485AD45D984EC4159C88FC066E5E3300E relay\n" +
+				"id ed25519 AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8\n",
+			wantNtorKey:  "AAAA",
+			wantFamily:   []string{"$0011BD2485AD45D984EC4159C88FC066E5E3300E", "relay"},
+			wantIdentity: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		},
+		{
+			name:    "malformed id",
+			input:   "onion-key\nid ed25519\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseMicrodescriptor(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v got %v", tt.wantErr, err)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if got.NtorOnionKey != tt.wantNtorKey {
+				t.Errorf("expected ntor onion key %v got %v", tt.wantNtorKey, got.NtorOnionKey)
+			}
+
+			if !reflect.DeepEqual(tt.wantFamily, got.Family) {
+				t.Errorf("expected family %v got %v", tt.wantFamily, got.Family)
+			}
+
+			if hex.EncodeToString(got.Ed25519Identity) != tt.wantIdentity {
+				t.Errorf("expected identity %v got %x", tt.wantIdentity, got.Ed25519Identity)
+			}
+		})
+	}
+}
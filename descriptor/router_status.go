@@ -41,6 +41,11 @@ type RouterStatusEntry struct {
 	Bandwidth   int
 	Accept      bool
 	PortList    string
+
+	// MicrodescriptorDigest is only set for entries of a microdesc consensus, it is used to find the
+	// microdescriptor holding the ed25519 identity of the relay
+	MicrodescriptorDigest string
+	Ed25519Identity       []byte
 }
 
 func ParseRouterStatusEntriesRaw(data string) ([]RouterStatusEntry, error) {
@@ -107,6 +112,11 @@ func parseRouterStatusEntry(routerStatusEntryRaw string) (*RouterStatusEntry, er
 		switch words[0] {
 		case "r":
 			//r" SP nickname SP identity SP digest SP publication SP IP SP ORPort SP DirPort NL
+			// microdesc consensuses leave out the digest
+			if len(words) != 8 && len(words) != 9 {
+				return nil, errors.New("malformed router status entry")
+			}
+
 			routerStatusEntry.Nickname = words[1]
 
 			routerStatusEntry.Fingerprint, err = common.Base64ToHex(words[2])
@@ -114,29 +124,37 @@ func parseRouterStatusEntry(routerStatusEntryRaw string) (*RouterStatusEntry, er
 				return nil, err
 			}
 
-			routerStatusEntry.Digest, err = common.Base64ToHex(words[3])
-			if err != nil {
-				return nil, err
+			if len(words) == 9 {
+				routerStatusEntry.Digest, err = common.Base64ToHex(words[3])
+				if err != nil {
+					return nil, err
+				}
+
+				words = append(words[:3], words[4:]...)
 			}
 
-			pubTime, err := time.Parse("2006-01-02 15:04:05", strings.Join(words[4:6], " "))
+			pubTime, err := time.Parse("2006-01-02 15:04:05", strings.Join(words[3:5], " "))
 			if err != nil {
 				return nil, err
 			}
 
 			routerStatusEntry.Published = pubTime
-			routerStatusEntry.Address = net.ParseIP(words[6])
+			routerStatusEntry.Address = net.ParseIP(words[5])
 
-			routerStatusEntry.ORPort, err = strconv.Atoi(words[7])
+			routerStatusEntry.ORPort, err = strconv.Atoi(words[6])
 			if err != nil {
 				return nil, err
 			}
 
-			routerStatusEntry.DirPort, err = strconv.Atoi(words[8])
+			routerStatusEntry.DirPort, err = strconv.Atoi(words[7])
 			if err != nil {
 				return nil, err
 			}
 
+		case "m":
+			if len(words) == 2 {
+				routerStatusEntry.MicrodescriptorDigest = words[1]
+			}
 		case "s":
 			routerStatusEntry.Flags = parseFlags(words[1:])
 		case "v":
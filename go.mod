@@ -3,6 +3,7 @@ module github.com/csucu/onionspread
 go 1.12
 
 require (
+	filippo.io/edwards25519 v1.0.0
 	github.com/alecthomas/template v0.0.0-20160405071501-a0175ee3bccc
 	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf
 	github.com/cretz/bine v0.0.0-20180724154149-f77fae492fee
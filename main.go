@@ -2,12 +2,16 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/csucu/onionspread/common"
 	"github.com/csucu/onionspread/onion"
 
+	"go.uber.org/zap"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -35,10 +39,23 @@ func main() {
 		return
 	}
 
-	// Initialising controller
-	controller, err := onion.NewController(config.Address, config.ControlPortPassword)
+	// Initialising a controller for every tor instance
+	var controllers []onion.IController
+	for _, address := range config.controlAddresses() {
+		controller, err := onion.NewController(address, config.controlAuth(), config.maxConcurrentFetches(),
+			logger)
+		if err != nil {
+			logger.Errorf("failed to initialise controller %s: %v", address, err)
+			return
+		}
+		defer controller.Close()
+
+		controllers = append(controllers, controller)
+	}
+
+	controller, err := onion.NewControllerPool(controllers, config.publishMode())
 	if err != nil {
-		logger.Errorf("failed to initialise controller: %v", err)
+		logger.Errorf("failed to initialise controller pool: %v", err)
 		return
 	}
 	defer controller.Close()
@@ -51,44 +68,213 @@ func main() {
 	}
 	defer hsdirFetcher.Stop()
 
+	// Revision counters of v3 descriptors are shared by all the services, the time periods are as long as the
+	// consensus of the hsdir fetcher says
+	scheduler, err := onion.NewTimePeriodScheduler(config.StateFilePath, hsdirFetcher, common.NewTimeProvider())
+	if err != nil {
+		logger.Errorf("failed to initialise time period scheduler: %v", err)
+		return
+	}
+
+	// Only the leader publishes when there are several instances, the others stand by
+	var leadership onion.Leadership
+	var elector *onion.Elector
+	if config.HighAvailability != nil {
+		elector, err = newElector(config.HighAvailability, logger)
+		if err != nil {
+			logger.Errorf("failed to initialise elector: %v", err)
+			return
+		}
+
+		elector.Start()
+		defer elector.Stop()
+		leadership = elector
+	}
+
 	// Launch services
 	logger.Debug("launching services")
 	wg := &sync.WaitGroup{}
+	balancers := make(map[string]onion.Balancer)
 	for _, service := range config.Services {
-		wg.Add(1)
+		var healthChecker onion.IHealthChecker
+		if service.HealthCheck != nil {
+			backendHealthChecker, err := newHealthChecker(config.SocksAddress, service, logger)
+			if err != nil {
+				logger.Errorf("failed to initialize health checker: %v", err)
+				return
+			}
+
+			backendHealthChecker.Start()
+			defer backendHealthChecker.Stop()
+			healthChecker = backendHealthChecker
+		}
 
-		publicKey, privateKey, err := common.LoadKeysFromFile(service.PrivateKeyPath)
+		masterOnion, err := newBalancer(service, controller, hsdirFetcher, scheduler, healthChecker, leadership, logger)
 		if err != nil {
-			logger.Errorf("failed to load keys from file: %v", err)
+			logger.Errorf("failed to initialize onion %v", err)
+			return
+		}
+
+		balancers[service.PrivateKeyPath] = masterOnion
+
+		wg.Add(1)
+		go func(masterOnion onion.Balancer) {
+			defer wg.Done()
+			defer masterOnion.Stop()
+
+			if err := masterOnion.Start(time.Minute * 10); err != nil {
+				logger.Error(err)
+			}
+		}(masterOnion)
+	}
+
+	// Stop the services on SIGINT or SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		sig := <-signals
+		logger.Infof("received %v, stopping services", sig)
+		for _, balancer := range balancers {
+			balancer.Stop()
+		}
+	}()
+
+	done := make(chan struct{})
+	go reportDegraded(balancers, time.Minute, done, logger)
+
+	wg.Wait()
+	close(done)
+
+	// The services stopped publishing, so the lease is released for a standby to take over
+	if elector != nil {
+		elector.Stop()
+	}
+}
+
+// reportDegraded logs the services that can't be balanced because their control connection is down every interval
+// until done is closed
+func reportDegraded(balancers map[string]onion.Balancer, interval time.Duration, done <-chan struct{},
+	logger *zap.SugaredLogger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
 			return
+		case <-ticker.C:
 		}
 
-		// Start onion
-		masterOnion, err := onion.NewOnion(
+		for name, balancer := range balancers {
+			if balancer.Degraded() {
+				logger.Warnf("service %s is degraded, its control connection is down", name)
+			}
+		}
+	}
+}
+
+// newHealthChecker returns the health checker of the backends of the service
+func newHealthChecker(socksAddress string, service Service, logger *zap.SugaredLogger) (*onion.HealthChecker, error) {
+	interval, timeout, err := service.HealthCheck.intervalAndTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	return onion.NewHealthChecker(
+		socksAddress,
+		service.BackendAddresses,
+		service.HealthCheck.Port,
+		service.HealthCheck.checkType(),
+		service.HealthCheck.Path,
+		interval,
+		timeout,
+		logger)
+}
+
+// newElector returns the elector campaigning for the configured lease
+func newElector(ha *HighAvailability, logger *zap.SugaredLogger) (*onion.Elector, error) {
+	holder, err := ha.holder()
+	if err != nil {
+		return nil, err
+	}
+
+	failoverTime, err := ha.failoverTime()
+	if err != nil {
+		return nil, err
+	}
+
+	return onion.NewElector(ha.lease(failoverTime), holder, failoverTime, logger)
+}
+
+// newBalancer returns the balancer for the version of the service
+func newBalancer(service Service, controller onion.IController, hsdirFetcher *onion.HSDirFetcher,
+	scheduler *onion.TimePeriodScheduler, healthChecker onion.IHealthChecker, leadership onion.Leadership,
+	logger *zap.SugaredLogger) (onion.Balancer, error) {
+	retryPolicy, err := service.retryPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := service.selector(hsdirFetcher)
+	if err != nil {
+		return nil, err
+	}
+
+	options := onion.OnionOptions{
+		HealthChecker: healthChecker,
+		Selector:      selector,
+		RetryPolicy:   retryPolicy,
+		Leadership:    leadership,
+	}
+
+	if service.Version == 3 {
+		publicKey, expandedPrivateKey, err := common.LoadEd25519KeysFromFile(service.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load keys from file: %v", err)
+		}
+
+		options.ClientAuthV3, err = service.clientAuthV3()
+		if err != nil {
+			return nil, err
+		}
+
+		return onion.NewOnionV3(
 			controller,
 			service.BackendAddresses,
 			publicKey,
-			privateKey,
+			expandedPrivateKey,
 			hsdirFetcher,
+			scheduler,
 			logger,
 			common.NewTimeProvider(),
-			time.Second*3600)
-		if err != nil {
-			logger.Errorf("failed to initialize onion %v", err)
-			return
-		}
+			time.Second*3600,
+			options)
+	}
 
-		go func() {
-			defer wg.Done()
+	publicKey, privateKey, err := common.LoadKeysFromFile(service.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keys from file: %v", err)
+	}
 
-			err = masterOnion.Start(time.Minute * 10)
-			if err != nil {
-				logger.Error(err)
-			}
+	options.ClientAuthV2, err = service.clientAuthV2()
+	if err != nil {
+		return nil, err
+	}
 
-			defer masterOnion.Stop()
-		}()
+	options.MaxDescriptorAge, err = service.maxDescriptorAge()
+	if err != nil {
+		return nil, err
 	}
 
-	wg.Wait()
+	return onion.NewOnion(
+		controller,
+		service.BackendAddresses,
+		publicKey,
+		privateKey,
+		hsdirFetcher,
+		logger,
+		common.NewTimeProvider(),
+		time.Second*3600,
+		options)
 }
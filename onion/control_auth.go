@@ -0,0 +1,194 @@
+package onion
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+
+	"github.com/cretz/bine/control"
+)
+
+// Authentication methods of the control port
+const (
+	AuthNull       = "null"
+	AuthPassword   = "password"
+	AuthCookie     = "cookie"
+	AuthSafeCookie = "safecookie"
+)
+
+// cookieLength is the length of the authentication cookie tor writes
+const cookieLength = 32
+
+// ControlAuth configures how the controller authenticates to tor
+type ControlAuth struct {
+	// Method is one of the authentication methods, when empty the best method tor offers is used
+	Method   string
+	Password string
+	// CookiePath overrides the path of the cookie file tor reports in PROTOCOLINFO
+	CookiePath string
+}
+
+// method returns the configured authentication method or the best one tor offers, in the order null, safecookie,
+// cookie and password
+func (a ControlAuth) method(info *control.ProtocolInfo) (string, error) {
+	if a.Method != "" {
+		return a.Method, nil
+	}
+
+	switch {
+	case info.HasAuthMethod("NULL"):
+		return AuthNull, nil
+	case info.HasAuthMethod("SAFECOOKIE"):
+		return AuthSafeCookie, nil
+	case info.HasAuthMethod("COOKIE"):
+		return AuthCookie, nil
+	case info.HasAuthMethod("HASHEDPASSWORD"):
+		return AuthPassword, nil
+	}
+
+	return "", fmt.Errorf("no supported authentication method in %v", info.AuthMethods)
+}
+
+// readCookie reads the authentication cookie from the configured path or the one tor reported
+func (a ControlAuth) readCookie(info *control.ProtocolInfo) ([]byte, error) {
+	path := a.CookiePath
+	if path == "" {
+		path = info.CookieFile
+	}
+
+	if path == "" {
+		return nil, errors.New("tor didn't report a cookie file")
+	}
+
+	cookie, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cookie file: %v", err)
+	}
+
+	if len(cookie) != cookieLength {
+		return nil, fmt.Errorf("invalid cookie length %d", len(cookie))
+	}
+
+	return cookie, nil
+}
+
+// authenticate authenticates the connection with the configured method
+func authenticate(conn *control.Conn, auth ControlAuth) error {
+	info, err := conn.ProtocolInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get protocol info: %v", err)
+	}
+
+	method, err := auth.method(info)
+	if err != nil {
+		return err
+	}
+
+	var secret []byte
+	switch method {
+	case AuthNull:
+	case AuthPassword:
+		if auth.Password == "" {
+			return errors.New("password authentication requires a password")
+		}
+
+		secret = []byte(auth.Password)
+	case AuthCookie:
+		if secret, err = auth.readCookie(info); err != nil {
+			return err
+		}
+	case AuthSafeCookie:
+		cookie, err := auth.readCookie(info)
+		if err != nil {
+			return err
+		}
+
+		if secret, err = safeCookieResponse(conn, cookie); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown authentication method %s", method)
+	}
+
+	cmd := "AUTHENTICATE"
+	if len(secret) > 0 {
+		cmd += " " + hex.EncodeToString(secret)
+	}
+
+	if _, err = conn.SendRequest("%v", cmd); err != nil {
+		return err
+	}
+
+	conn.Authenticated = true
+
+	return nil
+}
+
+// safeCookieResponse sends an AUTHCHALLENGE, verifies that tor knows the cookie as well and returns the hash that
+// proves the controller knows it
+func safeCookieResponse(conn *control.Conn, cookie []byte) ([]byte, error) {
+	clientNonce := make([]byte, 32)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	resp, err := conn.SendRequest("AUTHCHALLENGE SAFECOOKIE %s", hex.EncodeToString(clientNonce))
+	if err != nil {
+		return nil, err
+	}
+
+	var serverHash, serverNonce []byte
+	for _, field := range strings.Fields(resp.Reply) {
+		switch {
+		case strings.HasPrefix(field, "SERVERHASH="):
+			serverHash, err = hex.DecodeString(strings.TrimPrefix(field, "SERVERHASH="))
+		case strings.HasPrefix(field, "SERVERNONCE="):
+			serverNonce, err = hex.DecodeString(strings.TrimPrefix(field, "SERVERNONCE="))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid AUTHCHALLENGE response: %v", err)
+		}
+	}
+
+	if len(serverHash) != sha256.Size || len(serverNonce) != 32 {
+		return nil, errors.New("invalid AUTHCHALLENGE response")
+	}
+
+	if !hmac.Equal(serverHash, safeCookieHash(serverToControllerKey, cookie, clientNonce, serverNonce)) {
+		return nil, errors.New("tor doesn't know the authentication cookie")
+	}
+
+	return safeCookieHash(controllerToServerKey, cookie, clientNonce, serverNonce), nil
+}
+
+// Keys of the SAFECOOKIE hashes
+const (
+	serverToControllerKey = "Tor safe cookie authentication server-to-controller hash"
+	controllerToServerKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// safeCookieHash returns the SAFECOOKIE hash of the cookie and nonces with the given key
+func safeCookieHash(key string, cookie, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(cookie)
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+
+	return mac.Sum(nil)
+}
+
+// dialControlPort connects to the control port at address, a "unix:" prefix selects a unix socket
+func dialControlPort(address string) (*textproto.Conn, error) {
+	if strings.HasPrefix(address, "unix:") {
+		return textproto.Dial("unix", strings.TrimPrefix(address, "unix:"))
+	}
+
+	return textproto.Dial("tcp", address)
+}
@@ -0,0 +1,171 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/control"
+)
+
+// serveAuth answers the authentication commands like tor offering the given methods
+func serveAuth(server net.Conn, methods, cookieFile string, cookie []byte, password string) {
+	conn := textproto.NewConn(server)
+	defer conn.Close()
+
+	accepted := make(map[string]bool)
+	for _, method := range strings.Split(methods, ",") {
+		switch method {
+		case "NULL":
+			accepted[""] = true
+		case "HASHEDPASSWORD":
+			accepted[hex.EncodeToString([]byte(password))] = true
+		case "COOKIE":
+			accepted[hex.EncodeToString(cookie)] = true
+		}
+	}
+
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "PROTOCOLINFO":
+			conn.PrintfLine("250-PROTOCOLINFO 1")
+			conn.PrintfLine(`250-AUTH METHODS=%s COOKIEFILE="%s"`, methods, cookieFile)
+			conn.PrintfLine(`250-VERSION Tor="0.3.5.8"`)
+			conn.PrintfLine("250 OK")
+		case "AUTHCHALLENGE":
+			clientNonce, _ := hex.DecodeString(fields[2])
+			serverNonce := bytes.Repeat([]byte{1}, 32)
+			clientHash := safeCookieHash(controllerToServerKey, cookie, clientNonce, serverNonce)
+			accepted[hex.EncodeToString(clientHash)] = true
+
+			conn.PrintfLine("250 AUTHCHALLENGE SERVERHASH=%s SERVERNONCE=%s",
+				hex.EncodeToString(safeCookieHash(serverToControllerKey, cookie, clientNonce, serverNonce)),
+				hex.EncodeToString(serverNonce))
+		case "AUTHENTICATE":
+			secret := ""
+			if len(fields) > 1 {
+				secret = fields[1]
+			}
+
+			if !accepted[secret] {
+				conn.PrintfLine("515 Authentication failed")
+				continue
+			}
+
+			conn.PrintfLine("250 OK")
+		default:
+			conn.PrintfLine("510 Unrecognized command")
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	cookie := bytes.Repeat([]byte{7}, cookieLength)
+	cookieFile, err := ioutil.TempFile("", "control_auth_cookie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(cookieFile.Name())
+
+	if _, err = cookieFile.Write(cookie); err != nil {
+		t.Fatal(err)
+	}
+	cookieFile.Close()
+
+	testCases := []struct {
+		name       string
+		methods    string
+		cookieFile string
+		auth       ControlAuth
+
+		expectedErr bool
+	}{
+		{"best method", "COOKIE,SAFECOOKIE,HASHEDPASSWORD", cookieFile.Name(), ControlAuth{}, false},
+		{"null", "NULL", "", ControlAuth{}, false},
+		{"cookie", "COOKIE,SAFECOOKIE", cookieFile.Name(), ControlAuth{Method: AuthCookie}, false},
+		{"safecookie", "COOKIE,SAFECOOKIE", cookieFile.Name(), ControlAuth{Method: AuthSafeCookie}, false},
+		{"password", "HASHEDPASSWORD", "", ControlAuth{Password: "password"}, false},
+		{"wrong password", "HASHEDPASSWORD", "", ControlAuth{Method: AuthPassword, Password: "wrong"}, true},
+		{"method not offered", "HASHEDPASSWORD", "", ControlAuth{Method: AuthNull}, true},
+		{"missing cookie file", "SAFECOOKIE", "/nonexistent/control_auth_cookie", ControlAuth{}, true},
+		{
+			"cookie path",
+			"SAFECOOKIE",
+			"/nonexistent/control_auth_cookie",
+			ControlAuth{CookiePath: cookieFile.Name()},
+			false,
+		},
+	}
+
+	for _, tt := range testCases {
+		// not parallel as the cookie file is removed once the test returns
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go serveAuth(server, tt.methods, tt.cookieFile, cookie, "password")
+
+			conn := control.NewConn(textproto.NewConn(client))
+			defer conn.Close()
+
+			err := authenticate(conn, tt.auth)
+			if (err != nil) != tt.expectedErr {
+				t.Errorf("expected error %v got %v", tt.expectedErr, err)
+			}
+
+			if conn.Authenticated != !tt.expectedErr {
+				t.Errorf("expected authenticated %v got %v", !tt.expectedErr, conn.Authenticated)
+			}
+		})
+	}
+}
+
+func TestDialControlPort(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "control_socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "control")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		serveAuth(conn, "NULL", "", nil, "")
+	}()
+
+	conn, err := dialControlPort("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controlConn := control.NewConn(conn)
+	defer controlConn.Close()
+
+	if err = authenticate(controlConn, ControlAuth{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,79 +3,523 @@ package onion
 import (
 	"context"
 	"fmt"
-	"net/textproto"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cretz/bine/control"
+	"github.com/csucu/onionspread/common"
 	"github.com/csucu/onionspread/descriptor"
+	"go.uber.org/zap"
 )
 
 // IController is a interface for Controller
 type IController interface {
 	FetchHiddenServiceDescriptor(string, string, context.Context) (*descriptor.HiddenServiceDescriptor, error)
-	PostHiddenServiceDescriptor(string, []string, string) error
+	FetchHiddenServiceDescriptorV3(string, string, context.Context) (*descriptor.HiddenServiceDescriptorV3, error)
+	PostHiddenServiceDescriptor(string, []string, string) ([]UploadResult, error)
 	FetchRouterStatusEntries() ([]descriptor.RouterStatusEntry, error)
-	GetConn() *control.Conn
+	FetchConsensus() (*descriptor.Consensus, error)
+	FetchMicrodescriptors() ([]descriptor.Microdescriptor, error)
+	// EventBuses returns the event buses of the tor instances behind the controller
+	EventBuses() []*EventBus
+	Connected() bool
+	Reconnected() <-chan struct{}
+	// FetchTimeout returns how long fetching the given number of descriptors at once may take
+	FetchTimeout(int) time.Duration
 }
 
-// Controller represents a tor controller, it is essentially a wrapper over Bine
+// DefaultMaxConcurrentFetches is the default number of descriptor fetches that are in flight at once
+const DefaultMaxConcurrentFetches = 8
+
+// fetchTimeout is how long a descriptor fetch waits for the descriptor once it got a slot
+const fetchTimeout = 45 * time.Second
+
+// uploadTimeout is how long a descriptor upload waits for the hsdirs to respond
+const uploadTimeout = 60 * time.Second
+
+// reconnectBackoff is how long the controller waits between attempts to reconnect to tor
+var reconnectBackoff = RetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute, Jitter: 0.2}
+
+// Controller represents a tor controller, it is essentially a wrapper over Bine. Its event bus handles the events
+// of the connection, descriptor fetches run concurrently and the HS_DESC and HS_DESC_CONTENT events are matched
+// back to them by address. The HS_DESC events of uploads are matched back to them by hsdir. When the connection
+// drops it reconnects with a backoff.
 type Controller struct {
-	conn *control.Conn
-	mux  sync.Mutex
+	// address is the control port, it is only used in the logs
+	address string
+	logger  *zap.SugaredLogger
+
+	// mux serializes the commands, bine can't tell the replies of commands sent at the same time apart. It also
+	// guards the connection which is replaced when reconnecting
+	conn   *control.Conn
+	closed bool
+	mux    sync.Mutex
+
+	// dial opens and authenticates a new connection, reconnecting is disabled without it
+	dial             func() (*control.Conn, error)
+	reconnectBackoff RetryPolicy
+
+	connected   bool
+	reconnected chan struct{}
+	stateLock   sync.Mutex
+
+	fetchSlots   chan struct{}
+	fetchTimeout time.Duration
+	fetches      map[string][]chan fetchResult
+	fetchesLock  sync.Mutex
+
+	uploads     []*pendingUpload
+	uploadsLock sync.Mutex
+	// uploadsChanged is signalled when an upload finished or was removed, it uses uploadsLock
+	uploadsChanged *sync.Cond
+
+	events         *EventBus
+	dispatching    bool
+	dispatcherLock sync.Mutex
+}
+
+// fetchResult is the outcome of a descriptor fetch
+type fetchResult struct {
+	descriptor string
+	err        error
+}
+
+// UploadResult is the outcome of uploading a descriptor to a hsdir
+type UploadResult struct {
+	// HSDir is the fingerprint of the hsdir
+	HSDir    string
+	Uploaded bool
+	// Reason is why the upload failed
+	Reason string
+}
+
+// pendingUpload collects the results of uploading a descriptor. When tor picks the hsdirs they are learned from
+// the HS_DESC UPLOAD events of the descriptor ID. The results are matched by the address of the service and the
+// hsdir, see uploadAddress.
+type pendingUpload struct {
+	address      string
+	descriptorID string
+	hsDirs       map[string]bool
+	results      []UploadResult
+	done         chan struct{}
 }
 
 // FetchHiddenServiceDescriptor returns a hidden service descriptor for the requested address
 func (c *Controller) FetchHiddenServiceDescriptor(address, server string, ctx context.Context) (*descriptor.HiddenServiceDescriptor, error) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
+	descriptorRaw, err := c.fetchHiddenServiceDescriptorRaw(address, server, ctx)
+	if err != nil || descriptorRaw == "" {
+		return nil, err
+	}
 
-	eventCh := make(chan control.Event)
-	defer close(eventCh)
+	return descriptor.ParseHiddenServiceDescriptor(descriptorRaw)
+}
 
-	err := c.conn.AddEventListener(eventCh, control.EventCodeHSDescContent)
-	if err != nil {
+// FetchHiddenServiceDescriptorV3 returns the outer layer of the v3 onion service descriptor for the requested address
+func (c *Controller) FetchHiddenServiceDescriptorV3(address, server string, ctx context.Context) (*descriptor.HiddenServiceDescriptorV3, error) {
+	descriptorRaw, err := c.fetchHiddenServiceDescriptorRaw(address, server, ctx)
+	if err != nil || descriptorRaw == "" {
 		return nil, err
 	}
-	defer c.conn.RemoveEventListener(eventCh, control.EventCodeHSDescContent)
 
-	err = c.conn.GetHiddenServiceDescriptorAsync(address, server)
+	return descriptor.ParseHiddenServiceDescriptorV3(descriptorRaw)
+}
+
+// fetchHiddenServiceDescriptorRaw requests the descriptor for address and waits for its content event, at most
+// fetchSlots requests are in flight at once
+func (c *Controller) fetchHiddenServiceDescriptorRaw(address, server string, ctx context.Context) (string, error) {
+	select {
+	case c.fetchSlots <- struct{}{}:
+		defer func() { <-c.fetchSlots }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	if err := c.startDispatcher(); err != nil {
+		return "", err
+	}
+
+	address = normalizeAddress(address)
+	resultCh := make(chan fetchResult, 1)
+	c.addFetch(address, resultCh)
+	defer c.removeFetch(address, resultCh)
+
+	c.mux.Lock()
+	err := c.conn.GetHiddenServiceDescriptorAsync(address, server)
+	c.mux.Unlock()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	// Grab events
-	eventCtx, eventCancel := context.WithTimeout(ctx, 45*time.Second)
+	eventCtx, eventCancel := context.WithTimeout(ctx, c.fetchTimeout)
 	defer eventCancel()
 
-	errCh := make(chan error, 1)
+	select {
+	case <-eventCtx.Done():
+		return "", fmt.Errorf("no descriptor received for %s: %v", address, eventCtx.Err())
+	case result := <-resultCh:
+		return result.descriptor, result.err
+	}
+}
+
+// addFetch registers a pending fetch for address
+func (c *Controller) addFetch(address string, resultCh chan fetchResult) {
+	c.fetchesLock.Lock()
+	defer c.fetchesLock.Unlock()
+
+	c.fetches[address] = append(c.fetches[address], resultCh)
+}
+
+// removeFetch removes a pending fetch for address
+func (c *Controller) removeFetch(address string, resultCh chan fetchResult) {
+	c.fetchesLock.Lock()
+	defer c.fetchesLock.Unlock()
+
+	var remaining []chan fetchResult
+	for _, ch := range c.fetches[address] {
+		if ch != resultCh {
+			remaining = append(remaining, ch)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(c.fetches, address)
+		return
+	}
+
+	c.fetches[address] = remaining
+}
+
+// finishFetches hands the result to all the pending fetches for address
+func (c *Controller) finishFetches(address string, result fetchResult) {
+	c.fetchesLock.Lock()
+	defer c.fetchesLock.Unlock()
+
+	address = normalizeAddress(address)
+	for _, ch := range c.fetches[address] {
+		select {
+		case ch <- result:
+		default:
+		}
+	}
+	delete(c.fetches, address)
+}
+
+// failFetches fails all the pending fetches
+func (c *Controller) failFetches(err error) {
+	c.fetchesLock.Lock()
+	defer c.fetchesLock.Unlock()
+
+	for address, chs := range c.fetches {
+		for _, ch := range chs {
+			select {
+			case ch <- fetchResult{err: err}:
+			default:
+			}
+		}
+		delete(c.fetches, address)
+	}
+}
+
+// startDispatcher subscribes to the descriptor events if it didn't already
+func (c *Controller) startDispatcher() error {
+	c.dispatcherLock.Lock()
+	defer c.dispatcherLock.Unlock()
+
+	if c.dispatching {
+		return nil
+	}
+
+	eventCh := make(chan control.Event)
+	subscription, err := c.events.Subscribe(eventCh, control.EventCodeHSDesc, control.EventCodeHSDescContent)
+	if err != nil {
+		return err
+	}
+
+	c.dispatching = true
+	go c.dispatch(eventCh, subscription)
 
-	go func() { errCh <- c.conn.HandleEvents(eventCtx) }()
+	return nil
+}
+
+// dispatch matches descriptor events to the pending fetches by address until the event bus stops
+func (c *Controller) dispatch(eventCh chan control.Event, subscription *Subscription) {
 	for {
 		select {
-		case <-eventCtx.Done():
-			return nil, err
-		case err := <-errCh:
-			return nil, err
+		case <-c.events.Done():
+			subscription.Unsubscribe()
+			c.failFetches(c.events.Err())
+			c.failUploads()
+
+			c.dispatcherLock.Lock()
+			c.dispatching = false
+			c.dispatcherLock.Unlock()
+			return
 		case event := <-eventCh:
-			var hsEvent = event.(*control.HSDescContentEvent)
-			if hsEvent.Descriptor == "" {
-				continue
+			switch event := event.(type) {
+			case *control.HSDescContentEvent:
+				// tor sends empty content when a hsdir doesn't have the descriptor
+				if event.Descriptor != "" {
+					c.finishFetches(event.Address, fetchResult{descriptor: event.Descriptor})
+				}
+			case *control.HSDescEvent:
+				c.dispatchHSDesc(event)
+			}
+		}
+	}
+}
+
+// dispatchHSDesc hands a HS_DESC event to the pending fetch or upload it belongs to
+func (c *Controller) dispatchHSDesc(event *control.HSDescEvent) {
+	switch event.Action {
+	case "UPLOAD":
+		c.uploadStarted(event.DescID, event.HSDir)
+	case "UPLOADED":
+		c.uploadFinished(event.Address, event.HSDir, true, "")
+	case "FAILED":
+		switch event.Reason {
+		case "QUERY_NO_HSDIR":
+			// tor gives up on a fetch once there are no hsdirs left to ask
+			c.finishFetches(event.Address, fetchResult{
+				err: fmt.Errorf("no hsdir returned the descriptor of %s", event.Address),
+			})
+		case "UPLOAD_REJECTED", "UNEXPECTED":
+			c.uploadFinished(event.Address, event.HSDir, false, event.Reason)
+		}
+	}
+}
+
+// getInfo sends a GETINFO command
+func (c *Controller) getInfo(keys ...string) ([]*control.KeyVal, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	data, err := c.conn.GetInfo(keys...)
+	if err == nil && len(data) < len(keys) {
+		return nil, fmt.Errorf("missing values in the reply to GETINFO %s", strings.Join(keys, " "))
+	}
+
+	return data, err
+}
+
+// PostHiddenServiceDescriptor posts a hidden service descriptor and returns the result of the upload to every
+// hsdir, tor picks the hsdirs when servers is empty. The address is required for v3 descriptors, bine leaves out
+// the space before HSADDRESS so the command is built here when one is given
+func (c *Controller) PostHiddenServiceDescriptor(desc string, servers []string, address string) ([]UploadResult,
+	error) {
+	if err := c.startDispatcher(); err != nil {
+		return nil, err
+	}
+
+	upload := &pendingUpload{
+		address: uploadAddress(address),
+		hsDirs:  make(map[string]bool),
+		done:    make(chan struct{}),
+	}
+
+	if len(servers) == 0 {
+		upload.descriptorID = descriptorIDOf(desc)
+	}
+
+	for _, server := range servers {
+		upload.hsDirs[hsDirFingerprint(server)] = true
+	}
+
+	c.addUpload(upload)
+	defer c.removeUpload(upload)
+
+	if err := c.postHiddenServiceDescriptor(desc, servers, address); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(uploadTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-upload.done:
+	case <-timer.C:
+	}
+
+	return c.finishUpload(upload, "TIMEOUT"), nil
+}
+
+// postHiddenServiceDescriptor sends the HSPOST command
+func (c *Controller) postHiddenServiceDescriptor(desc string, servers []string, address string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if address == "" {
+		return c.conn.PostHiddenServiceDescriptorAsync(desc, servers, "")
+	}
+
+	cmd := "+HSPOST"
+	for _, server := range servers {
+		cmd += " SERVER=" + server
+	}
+	cmd += " HSADDRESS=" + address
+	cmd += "\r\n" + desc + "\r\n."
+
+	_, err := c.conn.SendRequest("%v", cmd)
+	return err
+}
+
+// addUpload registers a pending upload, it waits for the pending uploads whose results can't be told apart from
+// those of the upload
+func (c *Controller) addUpload(upload *pendingUpload) {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	for c.overlaps(upload) {
+		c.uploadsChanged.Wait()
+	}
+
+	c.uploads = append(c.uploads, upload)
+}
+
+// overlaps returns true if a pending upload is for the same service and may go to the same hsdirs as upload,
+// uploadsLock must be held
+func (c *Controller) overlaps(upload *pendingUpload) bool {
+	for _, pending := range c.uploads {
+		if pending.address != upload.address {
+			continue
+		}
+
+		// the hsdirs tor picks aren't known until they are uploaded to
+		if pending.descriptorID != "" || upload.descriptorID != "" {
+			return true
+		}
+
+		for hsDir := range upload.hsDirs {
+			if pending.hsDirs[hsDir] {
+				return true
 			}
+		}
+	}
 
-			return descriptor.ParseHiddenServiceDescriptor(hsEvent.Descriptor)
+	return false
+}
+
+// removeUpload removes a pending upload
+func (c *Controller) removeUpload(upload *pendingUpload) {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	for i, pending := range c.uploads {
+		if pending == upload {
+			c.uploads = append(c.uploads[:i], c.uploads[i+1:]...)
+			c.uploadsChanged.Broadcast()
+			return
 		}
 	}
 }
 
-// PostHiddenServiceDescriptor posts a hidden service descriptor.
-func (c *Controller) PostHiddenServiceDescriptor(desc string, servers []string, address string) error {
-	return c.conn.PostHiddenServiceDescriptorAsync(desc, servers, "")
+// uploadStarted adds the hsdir to the pending upload that lets tor pick the hsdirs for the descriptor ID
+func (c *Controller) uploadStarted(descriptorID, hsDir string) {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	for _, upload := range c.uploads {
+		if upload.descriptorID != "" && upload.descriptorID == descriptorID {
+			upload.hsDirs[hsDirFingerprint(hsDir)] = true
+			return
+		}
+	}
+}
+
+// uploadFinished records the result of the pending upload of the service at address to the hsdir. Overlapping
+// uploads wait for each other so there is only one.
+func (c *Controller) uploadFinished(address, hsDir string, uploaded bool, reason string) {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	address = uploadAddress(address)
+	fingerprint := hsDirFingerprint(hsDir)
+	for _, upload := range c.uploads {
+		if upload.address != address || !upload.hsDirs[fingerprint] {
+			continue
+		}
+
+		delete(upload.hsDirs, fingerprint)
+		upload.results = append(upload.results, UploadResult{HSDir: fingerprint, Uploaded: uploaded, Reason: reason})
+		c.uploadsChanged.Broadcast()
+
+		if len(upload.hsDirs) == 0 {
+			close(upload.done)
+		}
+
+		return
+	}
+}
+
+// finishUpload returns the results of the upload, the hsdirs that didn't respond failed for reason
+func (c *Controller) finishUpload(upload *pendingUpload, reason string) []UploadResult {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	var hsDirs []string
+	for hsDir := range upload.hsDirs {
+		hsDirs = append(hsDirs, hsDir)
+	}
+	sort.Strings(hsDirs)
+
+	for _, hsDir := range hsDirs {
+		upload.results = append(upload.results, UploadResult{HSDir: hsDir, Reason: reason})
+	}
+	upload.hsDirs = make(map[string]bool)
+
+	return upload.results
+}
+
+// failUploads makes all the pending uploads return
+func (c *Controller) failUploads() {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	for _, upload := range c.uploads {
+		select {
+		case <-upload.done:
+		default:
+			close(upload.done)
+		}
+	}
+}
+
+// uploadAddress returns the address uploads of the service are matched by. For v2 uploads tor reports UNKNOWN or
+// the address of the service so they are only told apart by hsdir, their address is empty.
+func uploadAddress(address string) string {
+	address = normalizeAddress(address)
+	if _, err := common.ParseOnionAddressV3(address); err != nil {
+		return ""
+	}
+
+	return address
+}
+
+// hsDirFingerprint returns the fingerprint of a hsdir given as $FINGERPRINT~nickname or FINGERPRINT
+func hsDirFingerprint(hsDir string) string {
+	hsDir = strings.TrimPrefix(hsDir, "$")
+	if i := strings.IndexAny(hsDir, "~="); i != -1 {
+		hsDir = hsDir[:i]
+	}
+
+	return strings.ToUpper(hsDir)
+}
+
+// descriptorIDOf returns the ID of a v2 descriptor, as given in its first line
+func descriptorIDOf(desc string) string {
+	line := desc
+	if i := strings.IndexByte(desc, '\n'); i != -1 {
+		line = desc[:i]
+	}
+
+	return strings.TrimPrefix(strings.TrimSpace(line), "rendezvous-service-descriptor ")
 }
 
 // FetchRouterStatusEntries requests the router status info from the controller
 func (c *Controller) FetchRouterStatusEntries() ([]descriptor.RouterStatusEntry, error) {
-	data, err := c.conn.GetInfo("ns/all")
+	data, err := c.getInfo("ns/all")
 	if err != nil {
 		return nil, fmt.Errorf("error fetching RouterStatusEntries: %v", err)
 	}
@@ -83,30 +527,210 @@ func (c *Controller) FetchRouterStatusEntries() ([]descriptor.RouterStatusEntry,
 	return descriptor.ParseRouterStatusEntriesRaw(data[0].Val)
 }
 
-// GetConn returns the underlining controller connection
-func (c *Controller) GetConn() *control.Conn {
-	return c.conn
+// FetchConsensus requests the current consensus from the controller, the microdesc flavour is preferred as it is
+// the one tor clients keep. The ns flavour it falls back to has no microdescriptor digests, so the hsdirs get no
+// ed25519 identities and v3 services can't be published.
+func (c *Controller) FetchConsensus() (*descriptor.Consensus, error) {
+	data, err := c.getInfo("dir/status-vote/current/consensus-microdesc")
+	if err != nil {
+		c.logger.Warnf("controller: no microdesc consensus from %s, v3 services can't be published: %v", c.address,
+			err)
+		data, err = c.getInfo("dir/status-vote/current/consensus")
+		if err != nil {
+			return nil, fmt.Errorf("error fetching consensus: %v", err)
+		}
+	}
+
+	return descriptor.ParseConsensus(data[0].Val)
+}
+
+// FetchMicrodescriptors requests all the microdescriptors tor knows about from the controller
+func (c *Controller) FetchMicrodescriptors() ([]descriptor.Microdescriptor, error) {
+	data, err := c.getInfo("md/all")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching microdescriptors: %v", err)
+	}
+
+	return descriptor.ParseMicrodescriptors(data[0].Val)
+}
+
+// Events returns the event bus of the controller connection
+func (c *Controller) Events() *EventBus {
+	return c.events
+}
+
+// EventBuses returns the event bus of the controller connection
+func (c *Controller) EventBuses() []*EventBus {
+	return []*EventBus{c.events}
 }
 
-// Close closes the underlining controller connection
+// Connected returns false while the controller is reconnecting
+func (c *Controller) Connected() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	return c.connected
+}
+
+// Reconnected returns a channel that is closed the next time the controller reconnected
+func (c *Controller) Reconnected() <-chan struct{} {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	return c.reconnected
+}
+
+// FetchTimeout returns how long fetching the given number of descriptors at once may take. The fetches take turns
+// for the slots and every fetch waits up to fetchTimeout once it got one, an extra turn leaves time for sending the
+// commands.
+func (c *Controller) FetchTimeout(fetches int) time.Duration {
+	turns := (fetches + cap(c.fetchSlots) - 1) / cap(c.fetchSlots)
+
+	return time.Duration(turns+1) * c.fetchTimeout
+}
+
+// setConnected updates the state of the connection, tells those waiting for a reconnect when it is back
+func (c *Controller) setConnected(connected bool) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if connected && !c.connected {
+		close(c.reconnected)
+		c.reconnected = make(chan struct{})
+	}
+
+	c.connected = connected
+}
+
+// supervise fails the pending fetches and uploads and reconnects every time the connection drops, until the
+// controller is closed
+func (c *Controller) supervise() {
+	for {
+		select {
+		case <-c.events.Done():
+			return
+		case err := <-c.events.Disconnected():
+			c.logger.Warnf("controller: lost connection to %s: %v", c.address, err)
+			c.setConnected(false)
+			c.failFetches(err)
+			c.failUploads()
+
+			if c.dial != nil && c.reconnect() {
+				c.setConnected(true)
+			}
+		}
+	}
+}
+
+// reconnect dials tor with a backoff until it gets a new connection and moves the event bus to it, it returns
+// false if the controller was closed meanwhile
+func (c *Controller) reconnect() bool {
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(c.reconnectBackoff.backoff(attempt, rand.Float64()))
+		select {
+		case <-c.events.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			c.logger.Errorf("controller: reconnect attempt %d to %s failed: %v", attempt, c.address, err)
+			continue
+		}
+
+		c.mux.Lock()
+		if c.closed {
+			c.mux.Unlock()
+			conn.Close()
+			return false
+		}
+
+		previous := c.conn
+		c.conn = conn
+		c.mux.Unlock()
+		previous.Close()
+
+		if err = c.events.attach(conn); err != nil {
+			c.logger.Errorf("controller: reconnect attempt %d to %s failed to attach events: %v", attempt, c.address,
+				err)
+			continue
+		}
+
+		c.logger.Infof("controller: reconnected to %s after %d attempts", c.address, attempt)
+		return true
+	}
+}
+
+// Close stops the event bus and closes the underlining controller connection
 func (c *Controller) Close() error {
+	c.events.Stop()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.closed = true
+
 	return c.conn.Close()
 }
 
-// NewController constructs a new controller
-func NewController(address, controlPortPassword string) (*Controller, error) {
-	textprotoConn, err := textproto.Dial("tcp", address)
+// dialer returns a function that connects to the control port at address and authenticates
+func dialer(address string, auth ControlAuth) func() (*control.Conn, error) {
+	return func() (*control.Conn, error) {
+		textprotoConn, err := dialControlPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("dial error: %v", err)
+		}
+
+		// Connect to tor controller
+		conn := control.NewConn(textprotoConn)
+		if err = authenticate(conn, auth); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("authentication error: %v", err)
+		}
+
+		return conn, nil
+	}
+}
+
+// NewController constructs a new controller, address is a host and port or a unix socket prefixed with "unix:".
+// maxConcurrentFetches limits the descriptor fetches that are in flight at once
+func NewController(address string, auth ControlAuth, maxConcurrentFetches int,
+	logger *zap.SugaredLogger) (*Controller, error) {
+	if maxConcurrentFetches < 1 {
+		return nil, fmt.Errorf("invalid number of concurrent fetches %d", maxConcurrentFetches)
+	}
+
+	dial := dialer(address, auth)
+	conn, err := dial()
 	if err != nil {
-		return nil, fmt.Errorf("dial error: %v", err)
+		return nil, err
 	}
 
-	// Connect to tor controller
-	conn := control.NewConn(textprotoConn)
-	if err = conn.Authenticate(controlPortPassword); err != nil {
-		return nil, fmt.Errorf("authentication error: %v", err)
+	return newController(address, conn, dial, maxConcurrentFetches, logger), nil
+}
+
+// newController returns a controller over an authenticated connection and starts its event bus, dial is optional
+func newController(address string, conn *control.Conn, dial func() (*control.Conn, error), maxConcurrentFetches int,
+	logger *zap.SugaredLogger) *Controller {
+	c := &Controller{
+		address:          address,
+		logger:           logger,
+		conn:             conn,
+		dial:             dial,
+		reconnectBackoff: reconnectBackoff,
+		connected:        true,
+		reconnected:      make(chan struct{}),
+		fetchSlots:       make(chan struct{}, maxConcurrentFetches),
+		fetchTimeout:     fetchTimeout,
+		fetches:          make(map[string][]chan fetchResult),
 	}
+	c.uploadsChanged = sync.NewCond(&c.uploadsLock)
+
+	c.events = newEventBus(conn, &c.mux)
+	c.events.Start()
+	go c.supervise()
 
-	return &Controller{
-		conn: conn,
-	}, nil
+	return c
 }
@@ -2,19 +2,38 @@ package onion
 
 import (
 	"context"
+	"sync"
+	"time"
 
-	"github.com/cretz/bine/control"
 	"github.com/csucu/onionspread/descriptor"
 )
 
 type MockController struct {
 	ReturnedHiddenServiceDescriptor    *descriptor.HiddenServiceDescriptor
 	ReturnedRouterStatusEntries        []descriptor.RouterStatusEntry
+	ReturnedConsensus                  *descriptor.Consensus
+	ReturnedMicrodescriptors           []descriptor.Microdescriptor
 	ReturnedHiddenServiceDescriptorRaw string
 	ReturnedErr                        error
 	PostedDescriptors                  map[string]string
 	FetchedDescriptors                 map[string]*descriptor.HiddenServiceDescriptor
+	FetchedDescriptorsV3               map[string]*descriptor.HiddenServiceDescriptorV3
+	PostedAddresses                    map[string]string
 	PostedDescriptor                   string
+	// ReturnedUploadResults are returned when tor picks the hsdirs
+	ReturnedUploadResults []UploadResult
+	// RejectingHSDirs don't accept the descriptors posted to them
+	RejectingHSDirs map[string]bool
+	// Rejections are the number of uploads hsdirs reject before accepting one
+	Rejections map[string]int
+	// Uploads counts the uploads to every hsdir
+	Uploads map[string]int
+	// Disconnected makes the controller report that it is reconnecting
+	Disconnected bool
+	// ReconnectedCh is returned by Reconnected
+	ReconnectedCh chan struct{}
+
+	lock sync.Mutex
 }
 
 func (m *MockController) FetchHiddenServiceDescriptor(address, server string, ctx context.Context) (
@@ -26,29 +45,82 @@ func (m *MockController) FetchHiddenServiceDescriptor(address, server string, ct
 	return m.FetchedDescriptors[address], nil
 }
 
-func (m *MockController) PostHiddenServiceDescriptor(desc string, servers []string, address string) error {
+func (m *MockController) FetchHiddenServiceDescriptorV3(address, server string, ctx context.Context) (
+	*descriptor.HiddenServiceDescriptorV3, error) {
+	if m.ReturnedErr != nil {
+		return nil, m.ReturnedErr
+	}
+
+	return m.FetchedDescriptorsV3[address], nil
+}
+
+func (m *MockController) PostHiddenServiceDescriptor(desc string, servers []string, address string) (
+	[]UploadResult, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
 	if m.ReturnedErr != nil {
-		return m.ReturnedErr
+		return nil, m.ReturnedErr
 	}
 
 	if servers == nil {
 		m.PostedDescriptor = desc
-		return nil
+		return m.ReturnedUploadResults, nil
 	}
 
 	if m.PostedDescriptors == nil {
 		m.PostedDescriptors = make(map[string]string)
 	}
 
-	m.PostedDescriptors[servers[0]] = desc
+	if m.PostedAddresses == nil {
+		m.PostedAddresses = make(map[string]string)
+	}
+
+	if m.Uploads == nil {
+		m.Uploads = make(map[string]int)
+	}
+
+	var results []UploadResult
+	for _, server := range servers {
+		m.PostedDescriptors[server] = desc
+		m.PostedAddresses[server] = address
+		m.Uploads[server]++
+
+		if m.RejectingHSDirs[server] || m.Uploads[server] <= m.Rejections[server] {
+			results = append(results, UploadResult{HSDir: server, Reason: "UPLOAD_REJECTED"})
+			continue
+		}
 
-	return m.ReturnedErr
+		results = append(results, UploadResult{HSDir: server, Uploaded: true})
+	}
+
+	return results, nil
 }
 
 func (m *MockController) FetchRouterStatusEntries() ([]descriptor.RouterStatusEntry, error) {
 	return m.ReturnedRouterStatusEntries, m.ReturnedErr
 }
 
-func (m *MockController) GetConn() *control.Conn {
+func (m *MockController) FetchConsensus() (*descriptor.Consensus, error) {
+	return m.ReturnedConsensus, m.ReturnedErr
+}
+
+func (m *MockController) FetchMicrodescriptors() ([]descriptor.Microdescriptor, error) {
+	return m.ReturnedMicrodescriptors, m.ReturnedErr
+}
+
+func (m *MockController) EventBuses() []*EventBus {
 	return nil
-}
\ No newline at end of file
+}
+
+func (m *MockController) Connected() bool {
+	return !m.Disconnected
+}
+
+func (m *MockController) Reconnected() <-chan struct{} {
+	return m.ReconnectedCh
+}
+
+func (m *MockController) FetchTimeout(fetches int) time.Duration {
+	return fetchTimeout
+}
@@ -0,0 +1,290 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/csucu/onionspread/descriptor"
+)
+
+// Ways a ControllerPool publishes descriptors
+const (
+	// PublishSpread posts every descriptor through one tor instance, taking turns
+	PublishSpread = "spread"
+	// PublishMirror posts every descriptor through all the tor instances
+	PublishMirror = "mirror"
+)
+
+// ControllerPool is an IController over the controllers of several tor instances. Fetches fail over from one
+// instance to the next in order, descriptors are either spread over the instances or mirrored to all of them.
+type ControllerPool struct {
+	controllers []IController
+	publishMode string
+
+	next     int
+	nextLock sync.Mutex
+
+	reconnected chan struct{}
+	stateLock   sync.Mutex
+
+	once sync.Once
+	stop chan struct{}
+}
+
+// connected returns the connected controllers in order starting at start, or all of them if none is connected
+// so the error of a command tells why
+func (p *ControllerPool) connected(start int) []IController {
+	var connected, all []IController
+	for i := range p.controllers {
+		controller := p.controllers[(start+i)%len(p.controllers)]
+		all = append(all, controller)
+
+		if controller.Connected() {
+			connected = append(connected, controller)
+		}
+	}
+
+	if len(connected) == 0 {
+		return all
+	}
+
+	return connected
+}
+
+// failover calls f with the controllers in turn until it succeeds, starting at start
+func (p *ControllerPool) failover(start int, f func(IController) error) error {
+	var err error
+	for _, controller := range p.connected(start) {
+		if err = f(controller); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// FetchHiddenServiceDescriptor fetches the descriptor through the first controller that returns it
+func (p *ControllerPool) FetchHiddenServiceDescriptor(address, server string, ctx context.Context) (
+	*descriptor.HiddenServiceDescriptor, error) {
+	var desc *descriptor.HiddenServiceDescriptor
+	err := p.failover(0, func(controller IController) error {
+		var err error
+		desc, err = controller.FetchHiddenServiceDescriptor(address, server, ctx)
+		if err == nil && desc == nil {
+			return fmt.Errorf("no descriptor received for %s", address)
+		}
+
+		return err
+	})
+
+	return desc, err
+}
+
+// FetchHiddenServiceDescriptorV3 fetches the descriptor through the first controller that returns it
+func (p *ControllerPool) FetchHiddenServiceDescriptorV3(address, server string, ctx context.Context) (
+	*descriptor.HiddenServiceDescriptorV3, error) {
+	var desc *descriptor.HiddenServiceDescriptorV3
+	err := p.failover(0, func(controller IController) error {
+		var err error
+		desc, err = controller.FetchHiddenServiceDescriptorV3(address, server, ctx)
+		if err == nil && desc == nil {
+			return fmt.Errorf("no descriptor received for %s", address)
+		}
+
+		return err
+	})
+
+	return desc, err
+}
+
+// PostHiddenServiceDescriptor posts the descriptor according to the publish mode of the pool
+func (p *ControllerPool) PostHiddenServiceDescriptor(desc string, servers []string, address string) (
+	[]UploadResult, error) {
+	if p.publishMode == PublishMirror {
+		return p.mirror(desc, servers, address)
+	}
+
+	p.nextLock.Lock()
+	start := p.next
+	p.next = (p.next + 1) % len(p.controllers)
+	p.nextLock.Unlock()
+
+	var results []UploadResult
+	err := p.failover(start, func(controller IController) error {
+		var err error
+		results, err = controller.PostHiddenServiceDescriptor(desc, servers, address)
+		return err
+	})
+
+	return results, err
+}
+
+// mirror posts the descriptor through all the controllers at once, an hsdir accepted it if it did through any of
+// them. It fails only if the descriptor couldn't be posted through any controller.
+func (p *ControllerPool) mirror(desc string, servers []string, address string) ([]UploadResult, error) {
+	controllers := p.connected(0)
+	controllerResults := make([][]UploadResult, len(controllers))
+	errs := make([]error, len(controllers))
+	forEachConcurrently(len(controllers), func(i int) {
+		controllerResults[i], errs[i] = controllers[i].PostHiddenServiceDescriptor(desc, servers, address)
+	})
+
+	var hsDirs []string
+	results := make(map[string]UploadResult)
+	var err error
+	posted := false
+	for i := range controllers {
+		if errs[i] != nil {
+			err = errs[i]
+			continue
+		}
+		posted = true
+
+		for _, result := range controllerResults[i] {
+			previous, ok := results[result.HSDir]
+			if !ok {
+				hsDirs = append(hsDirs, result.HSDir)
+			}
+
+			if !ok || !previous.Uploaded {
+				results[result.HSDir] = result
+			}
+		}
+	}
+
+	if !posted {
+		return nil, err
+	}
+
+	var ordered []UploadResult
+	for _, hsDir := range hsDirs {
+		ordered = append(ordered, results[hsDir])
+	}
+
+	return ordered, nil
+}
+
+// FetchRouterStatusEntries fetches the router status entries through the first controller that returns them
+func (p *ControllerPool) FetchRouterStatusEntries() ([]descriptor.RouterStatusEntry, error) {
+	var entries []descriptor.RouterStatusEntry
+	err := p.failover(0, func(controller IController) error {
+		var err error
+		entries, err = controller.FetchRouterStatusEntries()
+		return err
+	})
+
+	return entries, err
+}
+
+// FetchConsensus fetches the consensus through the first controller that returns it
+func (p *ControllerPool) FetchConsensus() (*descriptor.Consensus, error) {
+	var consensus *descriptor.Consensus
+	err := p.failover(0, func(controller IController) error {
+		var err error
+		consensus, err = controller.FetchConsensus()
+		return err
+	})
+
+	return consensus, err
+}
+
+// FetchMicrodescriptors fetches the microdescriptors through the first controller that returns them
+func (p *ControllerPool) FetchMicrodescriptors() ([]descriptor.Microdescriptor, error) {
+	var microdescriptors []descriptor.Microdescriptor
+	err := p.failover(0, func(controller IController) error {
+		var err error
+		microdescriptors, err = controller.FetchMicrodescriptors()
+		return err
+	})
+
+	return microdescriptors, err
+}
+
+// EventBuses returns the event buses of all the controllers, so events keep arriving while some are disconnected
+func (p *ControllerPool) EventBuses() []*EventBus {
+	var buses []*EventBus
+	for _, controller := range p.controllers {
+		buses = append(buses, controller.EventBuses()...)
+	}
+
+	return buses
+}
+
+// Connected returns true if any of the controllers is connected
+func (p *ControllerPool) Connected() bool {
+	for _, controller := range p.controllers {
+		if controller.Connected() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FetchTimeout returns how long fetching the given number of descriptors at once may take, a fetch may fail over
+// through all the controllers
+func (p *ControllerPool) FetchTimeout(fetches int) time.Duration {
+	var timeout time.Duration
+	for _, controller := range p.controllers {
+		timeout += controller.FetchTimeout(fetches)
+	}
+
+	return timeout
+}
+
+// Reconnected returns a channel that is closed the next time any of the controllers reconnected
+func (p *ControllerPool) Reconnected() <-chan struct{} {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	return p.reconnected
+}
+
+// watch tells those waiting for a reconnect every time the controller reconnected, until the pool is closed
+func (p *ControllerPool) watch(controller IController) {
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-controller.Reconnected():
+			p.stateLock.Lock()
+			close(p.reconnected)
+			p.reconnected = make(chan struct{})
+			p.stateLock.Unlock()
+		}
+	}
+}
+
+// Close stops watching the controllers, they are left open
+func (p *ControllerPool) Close() {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+}
+
+// NewControllerPool returns a pool of the controllers, publishMode is PublishSpread or PublishMirror
+func NewControllerPool(controllers []IController, publishMode string) (*ControllerPool, error) {
+	if len(controllers) == 0 {
+		return nil, errors.New("a controller pool needs at least one controller")
+	}
+
+	if publishMode != PublishSpread && publishMode != PublishMirror {
+		return nil, fmt.Errorf("unknown publish mode %s", publishMode)
+	}
+
+	p := &ControllerPool{
+		controllers: controllers,
+		publishMode: publishMode,
+		reconnected: make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+
+	for _, controller := range controllers {
+		go p.watch(controller)
+	}
+
+	return p, nil
+}
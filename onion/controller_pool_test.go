@@ -0,0 +1,188 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/csucu/onionspread/descriptor"
+)
+
+func TestControllerPool_FetchHiddenServiceDescriptor(t *testing.T) {
+	t.Parallel()
+
+	descriptor1 := &descriptor.HiddenServiceDescriptor{DescriptorID: "descriptor1"}
+	descriptor2 := &descriptor.HiddenServiceDescriptor{DescriptorID: "descriptor2"}
+
+	testCases := []struct {
+		name        string
+		controllers []IController
+
+		expected    *descriptor.HiddenServiceDescriptor
+		expectedErr error
+	}{
+		{
+			"first controller",
+			[]IController{
+				&MockController{FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{"a": descriptor1}},
+				&MockController{FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{"a": descriptor2}},
+			},
+			descriptor1,
+			nil,
+		},
+		{
+			"failing controller",
+			[]IController{
+				&MockController{ReturnedErr: errors.New("test error")},
+				&MockController{FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{"a": descriptor2}},
+			},
+			descriptor2,
+			nil,
+		},
+		{
+			"disconnected controller",
+			[]IController{
+				&MockController{
+					FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{"a": descriptor1},
+					Disconnected:       true,
+				},
+				&MockController{FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{"a": descriptor2}},
+			},
+			descriptor2,
+			nil,
+		},
+		{
+			"all failing",
+			[]IController{
+				&MockController{ReturnedErr: errors.New("test error")},
+				&MockController{},
+			},
+			nil,
+			errors.New("no descriptor received for a"),
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pool, err := NewControllerPool(tt.controllers, PublishSpread)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pool.Close()
+
+			desc, err := pool.FetchHiddenServiceDescriptor("a", "", context.Background())
+			if !reflect.DeepEqual(err, tt.expectedErr) {
+				t.Errorf("expected %v got %v", tt.expectedErr, err)
+			}
+
+			if desc != tt.expected {
+				t.Errorf("expected %v got %v", tt.expected, desc)
+			}
+		})
+	}
+}
+
+func TestControllerPool_PostHiddenServiceDescriptor(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		controllers []*MockController
+		publishMode string
+
+		expectedResults []UploadResult
+		expectedUploads []map[string]int
+	}{
+		{
+			"spread",
+			[]*MockController{{}, {}},
+			PublishSpread,
+			[]UploadResult{{HSDir: "hsdir1", Uploaded: true}, {HSDir: "hsdir2", Uploaded: true}},
+			[]map[string]int{{"hsdir1": 2, "hsdir2": 2}, {"hsdir1": 2, "hsdir2": 2}},
+		},
+		{
+			"spread with a failing controller",
+			[]*MockController{{ReturnedErr: errors.New("test error")}, {}},
+			PublishSpread,
+			[]UploadResult{{HSDir: "hsdir1", Uploaded: true}, {HSDir: "hsdir2", Uploaded: true}},
+			[]map[string]int{nil, {"hsdir1": 4, "hsdir2": 4}},
+		},
+		{
+			"mirror",
+			[]*MockController{
+				{RejectingHSDirs: map[string]bool{"hsdir1": true, "hsdir2": true}},
+				{RejectingHSDirs: map[string]bool{"hsdir2": true}},
+			},
+			PublishMirror,
+			[]UploadResult{{HSDir: "hsdir1", Uploaded: true}, {HSDir: "hsdir2", Reason: "UPLOAD_REJECTED"}},
+			[]map[string]int{{"hsdir1": 4, "hsdir2": 4}, {"hsdir1": 4, "hsdir2": 4}},
+		},
+		{
+			"mirror with a failing controller",
+			[]*MockController{{ReturnedErr: errors.New("test error")}, {}},
+			PublishMirror,
+			[]UploadResult{{HSDir: "hsdir1", Uploaded: true}, {HSDir: "hsdir2", Uploaded: true}},
+			[]map[string]int{nil, {"hsdir1": 4, "hsdir2": 4}},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var controllers []IController
+			for _, controller := range tt.controllers {
+				controllers = append(controllers, controller)
+			}
+
+			pool, err := NewControllerPool(controllers, tt.publishMode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pool.Close()
+
+			for i := 0; i < 4; i++ {
+				results, err := pool.PostHiddenServiceDescriptor("descriptor", []string{"hsdir1", "hsdir2"}, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(results, tt.expectedResults) {
+					t.Errorf("expected %v got %v", tt.expectedResults, results)
+				}
+			}
+
+			for i, controller := range tt.controllers {
+				if !reflect.DeepEqual(controller.Uploads, tt.expectedUploads[i]) {
+					t.Errorf("controller %d: expected uploads %v got %v", i, tt.expectedUploads[i], controller.Uploads)
+				}
+			}
+		})
+	}
+}
+
+func TestControllerPool_Reconnected(t *testing.T) {
+	t.Parallel()
+
+	controller := &MockController{ReconnectedCh: make(chan struct{})}
+	pool, err := NewControllerPool([]IController{&MockController{}, controller}, PublishSpread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	reconnected := pool.Reconnected()
+	controller.ReconnectedCh <- struct{}{}
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pool didn't report the reconnect")
+	}
+}
@@ -0,0 +1,385 @@
+package onion
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control"
+	"github.com/csucu/onionspread/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+// torStandIn answers the commands of a controller like the control port of tor, once triggerCount commands that
+// start with trigger were received the events are sent
+type torStandIn struct {
+	conn         *textproto.Conn
+	trigger      string
+	triggerCount int
+	events       []string
+
+	commands     []string
+	commandsLock sync.Mutex
+}
+
+func newTorStandIn(t *testing.T, maxConcurrentFetches int, trigger string, triggerCount int,
+	events []string) (*Controller, *torStandIn) {
+	conn, tor := dialTorStandIn(trigger, triggerCount, events)
+
+	return newController("stand-in", conn, nil, maxConcurrentFetches, common.NewNopLogger()), tor
+}
+
+// dialTorStandIn returns a connection to a new torStandIn
+func dialTorStandIn(trigger string, triggerCount int, events []string) (*control.Conn, *torStandIn) {
+	client, server := net.Pipe()
+
+	tor := &torStandIn{
+		conn:         textproto.NewConn(server),
+		trigger:      trigger,
+		triggerCount: triggerCount,
+		events:       events,
+	}
+	go tor.serve()
+
+	return control.NewConn(textproto.NewConn(client)), tor
+}
+
+func (s *torStandIn) serve() {
+	defer s.conn.Close()
+
+	for {
+		line, err := s.conn.ReadLine()
+		if err != nil {
+			return
+		}
+
+		// multi line commands such as HSPOST end with a dot
+		if strings.HasPrefix(line, "+") {
+			if _, err = s.conn.ReadDotLines(); err != nil {
+				return
+			}
+		}
+
+		s.commandsLock.Lock()
+		s.commands = append(s.commands, line)
+		triggered := strings.HasPrefix(line, s.trigger) && s.count(s.trigger) == s.triggerCount
+		s.commandsLock.Unlock()
+
+		if err = s.conn.PrintfLine("250 OK"); err != nil {
+			return
+		}
+
+		if !triggered {
+			continue
+		}
+
+		for _, event := range s.events {
+			if _, err = s.conn.W.WriteString(event); err != nil {
+				return
+			}
+		}
+
+		if err = s.conn.W.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// count returns the number of commands received that start with prefix, commandsLock must be held
+func (s *torStandIn) count(prefix string) int {
+	count := 0
+	for _, command := range s.commands {
+		if strings.HasPrefix(command, prefix) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestController_fetchHiddenServiceDescriptorRaw(t *testing.T) {
+	t.Parallel()
+
+	// the events arrive in a different order than the fetches
+	controller, _ := newTorStandIn(t, 3, "HSFETCH ", 3, []string{
+		"650+HS_DESC_CONTENT irthspr2nebf7x5i aaaa $1111111111111111111111111111111111111111\r\n.\r\n650 OK\r\n",
+		"650+HS_DESC_CONTENT irthspr2nebf7x5i bbbb $2222222222222222222222222222222222222222\r\n" +
+			"descriptor of irthspr2nebf7x5i\r\n.\r\n650 OK\r\n",
+		"650 HS_DESC FAILED aaaaaaaaaaaaaaaa NO_AUTH UNKNOWN REASON=QUERY_NO_HSDIR\r\n",
+		"650+HS_DESC_CONTENT 7ctbljpgkiayaita cccc $3333333333333333333333333333333333333333\r\n" +
+			"descriptor of 7ctbljpgkiayaita\r\n.\r\n650 OK\r\n",
+	})
+	defer controller.Close()
+
+	testCases := []struct {
+		address string
+
+		expectedDescriptor string
+		expectedErr        bool
+	}{
+		{"7ctbljpgkiayaita.onion", "descriptor of 7ctbljpgkiayaita", false},
+		{"irthspr2nebf7x5i", "descriptor of irthspr2nebf7x5i", false},
+		{"aaaaaaaaaaaaaaaa", "", true},
+	}
+
+	var wg sync.WaitGroup
+	for _, tt := range testCases {
+		wg.Add(1)
+		go func(address, expectedDescriptor string, expectedErr bool) {
+			defer wg.Done()
+
+			descriptor, err := controller.fetchHiddenServiceDescriptorRaw(address, "", context.Background())
+			if (err != nil) != expectedErr {
+				t.Errorf("%s: expected error %v got %v", address, expectedErr, err)
+			}
+
+			if descriptor != expectedDescriptor {
+				t.Errorf("%s: expected descriptor %q got %q", address, expectedDescriptor, descriptor)
+			}
+		}(tt.address, tt.expectedDescriptor, tt.expectedErr)
+	}
+
+	wg.Wait()
+}
+
+func TestController_fetchHiddenServiceDescriptorRawLimit(t *testing.T) {
+	t.Parallel()
+
+	controller, tor := newTorStandIn(t, 1, "HSFETCH ", 1, nil)
+	defer controller.Close()
+
+	// the only slot is taken so the fetch waits until it is cancelled
+	controller.fetchSlots <- struct{}{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := controller.fetchHiddenServiceDescriptorRaw("7ctbljpgkiayaita", "", ctx); err != context.Canceled {
+		t.Errorf("expected %v got %v", context.Canceled, err)
+	}
+
+	tor.commandsLock.Lock()
+	defer tor.commandsLock.Unlock()
+
+	if fetches := tor.count("HSFETCH "); fetches != 0 {
+		t.Errorf("expected no fetches got %d", fetches)
+	}
+}
+
+func TestController_PostHiddenServiceDescriptor(t *testing.T) {
+	t.Parallel()
+
+	const (
+		hsDir1 = "1111111111111111111111111111111111111111"
+		hsDir2 = "2222222222222222222222222222222222222222"
+	)
+
+	testCases := []struct {
+		name    string
+		servers []string
+		events  []string
+
+		expectedResults []UploadResult
+	}{
+		{
+			"given hsdirs",
+			[]string{"$" + hsDir1, hsDir2},
+			[]string{
+				"650 HS_DESC UPLOAD UNKNOWN UNKNOWN $" + hsDir2 + "~hsdir2 aaaa\r\n",
+				"650 HS_DESC UPLOAD UNKNOWN UNKNOWN $" + hsDir1 + "~hsdir1 aaaa\r\n",
+				"650 HS_DESC FAILED UNKNOWN UNKNOWN $" + hsDir2 + "~hsdir2 REASON=UPLOAD_REJECTED\r\n",
+				"650 HS_DESC UPLOADED UNKNOWN UNKNOWN $" + hsDir1 + "~hsdir1\r\n",
+			},
+			[]UploadResult{
+				{HSDir: hsDir2, Reason: "UPLOAD_REJECTED"},
+				{HSDir: hsDir1, Uploaded: true},
+			},
+		},
+		{
+			"hsdirs picked by tor",
+			nil,
+			[]string{
+				"650 HS_DESC UPLOAD 7ctbljpgkiayaita UNKNOWN $" + hsDir1 + "~hsdir1 otherdescriptorid\r\n",
+				"650 HS_DESC UPLOAD 7ctbljpgkiayaita UNKNOWN $" + hsDir1 + "~hsdir1 s43alcs3qyeyc4xdy7th2zf7c7kvrxse\r\n",
+				"650 HS_DESC UPLOAD 7ctbljpgkiayaita UNKNOWN $" + hsDir2 + "~hsdir2 s43alcs3qyeyc4xdy7th2zf7c7kvrxse\r\n",
+				"650 HS_DESC UPLOADED 7ctbljpgkiayaita UNKNOWN $" + hsDir2 + "~hsdir2\r\n",
+				"650 HS_DESC UPLOADED 7ctbljpgkiayaita UNKNOWN $" + hsDir1 + "~hsdir1\r\n",
+			},
+			[]UploadResult{
+				{HSDir: hsDir2, Uploaded: true},
+				{HSDir: hsDir1, Uploaded: true},
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			controller, _ := newTorStandIn(t, 1, "+HSPOST", 1, tt.events)
+			defer controller.Close()
+
+			results, err := controller.PostHiddenServiceDescriptor(
+				"rendezvous-service-descriptor s43alcs3qyeyc4xdy7th2zf7c7kvrxse\nversion 2", tt.servers, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(results, tt.expectedResults) {
+				t.Errorf("expected %v got %v", tt.expectedResults, results)
+			}
+		})
+	}
+}
+
+func TestController_PostHiddenServiceDescriptorConcurrent(t *testing.T) {
+	t.Parallel()
+
+	const hsDir = "1111111111111111111111111111111111111111"
+
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherAddress := common.CalculateOnionAddressV3(otherKey)
+
+	// tor responds once both services posted to the hsdir, the upload of the service that posted last is first
+	controller, tor := newTorStandIn(t, 2, "+HSPOST", 2, []string{
+		"650 HS_DESC UPLOADED " + otherAddress + " UNKNOWN $" + hsDir + "~hsdir1\r\n",
+		"650 HS_DESC FAILED " + testBackendAddressV3 + " UNKNOWN $" + hsDir + "~hsdir1 REASON=UPLOAD_REJECTED\r\n",
+	})
+	defer controller.Close()
+
+	addresses := []string{testBackendAddressV3, otherAddress}
+	results := make([][]UploadResult, len(addresses))
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+
+			var err error
+			results[i], err = controller.PostHiddenServiceDescriptor("hs-descriptor 3", []string{hsDir}, address)
+			if err != nil {
+				t.Error(err)
+			}
+		}(i, address)
+
+		// the first upload is pending before the second one is posted
+		for {
+			tor.commandsLock.Lock()
+			posted := tor.count("+HSPOST") == i+1
+			tor.commandsLock.Unlock()
+
+			if posted {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	wg.Wait()
+
+	expectedResults := [][]UploadResult{
+		{{HSDir: hsDir, Reason: "UPLOAD_REJECTED"}},
+		{{HSDir: hsDir, Uploaded: true}},
+	}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Errorf("expected %v got %v", expectedResults, results)
+	}
+}
+
+func TestController_overlaps(t *testing.T) {
+	t.Parallel()
+
+	controller := &Controller{
+		uploads: []*pendingUpload{
+			{hsDirs: map[string]bool{"A": true}},
+			{address: testBackendAddressV3, hsDirs: map[string]bool{"B": true}},
+		},
+	}
+
+	testCases := []struct {
+		name   string
+		upload *pendingUpload
+
+		expected bool
+	}{
+		{"v2 same hsdir", &pendingUpload{hsDirs: map[string]bool{"A": true}}, true},
+		{"v2 other hsdir", &pendingUpload{hsDirs: map[string]bool{"B": true}}, false},
+		{"v2 hsdirs picked by tor", &pendingUpload{descriptorID: "aaaa", hsDirs: map[string]bool{}}, true},
+		{"v3 same hsdir", &pendingUpload{address: testBackendAddressV3, hsDirs: map[string]bool{"B": true}}, true},
+		{"v3 other service", &pendingUpload{address: "other", hsDirs: map[string]bool{"B": true}}, false},
+	}
+
+	for _, tt := range testCases {
+		if got := controller.overlaps(tt.upload); got != tt.expected {
+			t.Errorf("%s: expected %v got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestController_reconnect(t *testing.T) {
+	t.Parallel()
+
+	conn, tor := dialTorStandIn("", 0, nil)
+
+	// the new connection sends an event once tor is asked for the events of the subscription again
+	reconnectedConn, reconnectedTor := dialTorStandIn("SETEVENTS", 1,
+		[]string{"650 STATUS_GENERAL NOTICE CONSENSUS_ARRIVED\r\n"})
+	dials := 0
+	dial := func() (*control.Conn, error) {
+		dials++
+		if dials == 1 {
+			return nil, errors.New("connection refused")
+		}
+
+		return reconnectedConn, nil
+	}
+
+	controller := newController("stand-in", conn, dial, 1, common.NewNopLogger())
+	controller.reconnectBackoff = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	defer controller.Close()
+
+	eventCh := make(chan *control.StatusEvent)
+	if _, err := controller.Events().SubscribeStatusGeneral(eventCh); err != nil {
+		t.Fatal(err)
+	}
+
+	reconnected := controller.Reconnected()
+	tor.conn.Close()
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("controller didn't reconnect")
+	}
+
+	if !controller.Connected() {
+		t.Error("expected the controller to be connected")
+	}
+
+	select {
+	case event := <-eventCh:
+		if event.Action != "CONSENSUS_ARRIVED" {
+			t.Errorf("expected CONSENSUS_ARRIVED got %s", event.Action)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received on the new connection")
+	}
+
+	reconnectedTor.commandsLock.Lock()
+	defer reconnectedTor.commandsLock.Unlock()
+
+	if expected := []string{"SETEVENTS STATUS_GENERAL"}; !reflect.DeepEqual(reconnectedTor.commands, expected) {
+		t.Errorf("expected %v got %v", expected, reconnectedTor.commands)
+	}
+}
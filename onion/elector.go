@@ -0,0 +1,174 @@
+package onion
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Leadership tells whether this instance is the one that publishes the descriptors, standby instances only fetch
+// the backend descriptors so they can take over right away
+type Leadership interface {
+	Leader() bool
+	// Elected returns a channel that is closed the next time the instance becomes the leader
+	Elected() <-chan struct{}
+}
+
+// leading returns true if the instance publishes, without a Leadership every instance does
+func leading(leadership Leadership) bool {
+	return leadership == nil || leadership.Leader()
+}
+
+// whenElected returns the Elected channel of the leadership, without one it is nil and never fires
+func whenElected(leadership Leadership) <-chan struct{} {
+	if leadership == nil {
+		return nil
+	}
+
+	return leadership.Elected()
+}
+
+// Elector campaigns for a Lease so only one of several onionspread instances publishes. The lease is held for three
+// quarters of the failover time and renewed every quarter, so a standby takes over within the failover time once
+// the leader went away. A leader that can't renew steps down before its lease could expire.
+type Elector struct {
+	lease    Lease
+	holder   string
+	ttl      time.Duration
+	interval time.Duration
+	logger   *zap.SugaredLogger
+
+	// renewed is when the lease was last acquired, it is only used by the campaign
+	renewed time.Time
+
+	leader    bool
+	elected   chan struct{}
+	stateLock sync.Mutex
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Leader returns true while the instance holds the lease
+func (e *Elector) Leader() bool {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+
+	return e.leader
+}
+
+// Elected returns a channel that is closed the next time the instance becomes the leader
+func (e *Elector) Elected() <-chan struct{} {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+
+	return e.elected
+}
+
+// setLeader records whether the instance is the leader, telling those waiting when it was elected
+func (e *Elector) setLeader(leader bool) {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+
+	if leader == e.leader {
+		return
+	}
+
+	e.leader = leader
+	if leader {
+		e.logger.Infof("elector: %s is the leader, publishing descriptors", e.holder)
+		close(e.elected)
+		e.elected = make(chan struct{})
+		return
+	}
+
+	e.logger.Warnf("elector: %s is standing by, not publishing descriptors", e.holder)
+}
+
+// campaign acquires or renews the lease
+func (e *Elector) campaign() {
+	attempted := time.Now()
+	acquired, err := e.lease.Acquire(e.holder, e.ttl)
+	if err != nil {
+		e.logger.Errorf("elector: failed to acquire lease: %v", err)
+
+		// a standby takes the lease over once it expired, so the leader steps down while there is less than half
+		// an interval left after the next attempt
+		if time.Since(e.renewed)+e.interval*3/2 >= e.ttl {
+			e.setLeader(false)
+		}
+		return
+	}
+
+	if acquired {
+		e.renewed = attempted
+	}
+
+	e.setLeader(acquired)
+}
+
+// Start campaigns for the lease until the Elector is stopped
+func (e *Elector) Start() {
+	e.logger.Debug("elector: starting")
+
+	go func() {
+		defer close(e.done)
+
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		for {
+			e.campaign()
+
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the campaign of a started Elector and releases the lease so a standby takes over right away
+func (e *Elector) Stop() {
+	e.once.Do(func() {
+		close(e.stop)
+		<-e.done
+		e.logger.Debug("elector: stopping")
+
+		if !e.Leader() {
+			return
+		}
+
+		e.setLeader(false)
+		if err := e.lease.Release(e.holder); err != nil {
+			e.logger.Errorf("elector: failed to release lease: %v", err)
+		}
+	})
+}
+
+// NewElector returns an Elector campaigning for the lease as holder, holder has to be unique among the instances
+func NewElector(lease Lease, holder string, failoverTime time.Duration, logger *zap.SugaredLogger) (*Elector,
+	error) {
+	if holder == "" {
+		return nil, errors.New("missing lease holder")
+	}
+
+	if failoverTime <= 0 {
+		return nil, errors.New("failover time must be positive")
+	}
+
+	return &Elector{
+		lease:    lease,
+		holder:   holder,
+		ttl:      failoverTime * 3 / 4,
+		interval: failoverTime / 4,
+		logger:   logger,
+		elected:  make(chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
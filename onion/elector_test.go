@@ -0,0 +1,102 @@
+package onion
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+)
+
+// failingLease is a lease that can be made to fail
+type failingLease struct {
+	Lease
+
+	failing bool
+	lock    sync.Mutex
+}
+
+func (l *failingLease) setFailing(failing bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.failing = failing
+}
+
+func (l *failingLease) Acquire(holder string, ttl time.Duration) (bool, error) {
+	l.lock.Lock()
+	failing := l.failing
+	l.lock.Unlock()
+
+	if failing {
+		return false, errors.New("test error")
+	}
+
+	return l.Lease.Acquire(holder, ttl)
+}
+
+func TestElector(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "elector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	failoverTime := 400 * time.Millisecond
+	lease := &failingLease{Lease: NewFileLease(filepath.Join(dir, "lease"))}
+
+	electorA, err := NewElector(lease, "a", failoverTime, common.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	electorB, err := NewElector(NewFileLease(filepath.Join(dir, "lease")), "b", failoverTime, common.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elected := electorA.Elected()
+	electorA.Start()
+	defer electorA.Stop()
+	select {
+	case <-elected:
+	case <-time.After(failoverTime):
+		t.Fatal("a wasn't elected")
+	}
+
+	electorB.Start()
+	defer electorB.Stop()
+	time.Sleep(failoverTime)
+	if electorB.Leader() {
+		t.Fatal("b was elected while a held the lease")
+	}
+
+	// a steps down before its lease expires once it can't renew, b takes over within the failover time
+	elected = electorB.Elected()
+	lease.setFailing(true)
+	select {
+	case <-elected:
+	case <-time.After(2 * failoverTime):
+		t.Fatal("b wasn't elected after a failed to renew")
+	}
+
+	if electorA.Leader() {
+		t.Error("a and b are both leaders")
+	}
+
+	// stopping b releases the lease so a takes over
+	lease.setFailing(false)
+	elected = electorA.Elected()
+	electorB.Stop()
+	select {
+	case <-elected:
+	case <-time.After(failoverTime):
+		t.Fatal("a wasn't elected after b stopped")
+	}
+}
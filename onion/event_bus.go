@@ -0,0 +1,389 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cretz/bine/control"
+)
+
+// EventBus owns the one loop that handles the events of a controller connection and hands them to the
+// subscriptions of their event codes. Every subscription has its own queue so a slow subscriber holds up neither
+// the connection nor the other subscribers. Subscriptions outlive the connection, when the controller reconnects
+// the bus is attached to the new connection and tor is asked for their events again.
+type EventBus struct {
+	// commandLock is the lock of the controller that serializes the commands on the connection
+	commandLock *sync.Mutex
+	eventCh     chan control.Event
+
+	// listenLock serializes changes to the connection and the events tor is asked to send
+	conn       *control.Conn
+	codes      map[control.EventCode]int
+	detached   bool
+	listenLock sync.Mutex
+
+	subscriptions     map[*Subscription]bool
+	subscriptionsLock sync.RWMutex
+
+	// disconnected receives why the events of the connection couldn't be handled anymore
+	disconnected chan error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	err  error
+	done chan struct{}
+
+	once sync.Once
+	stop chan struct{}
+}
+
+// Subscription hands the events of its codes to a channel until it is unsubscribed
+type Subscription struct {
+	bus     *EventBus
+	codes   []control.EventCode
+	deliver func(control.Event, <-chan struct{})
+
+	queue     []control.Event
+	queueLock sync.Mutex
+	notify    chan struct{}
+
+	once sync.Once
+	done chan struct{}
+}
+
+// Start starts handling the events of the connection
+func (b *EventBus) Start() {
+	b.handle(b.conn)
+
+	go func() {
+		defer close(b.done)
+		defer b.detach()
+
+		for {
+			select {
+			case <-b.stop:
+				b.err = errors.New("event bus stopped")
+				return
+			case event := <-b.eventCh:
+				b.publish(event)
+			}
+		}
+	}()
+}
+
+// handle reads the events of the connection until it fails or the bus is stopped
+func (b *EventBus) handle(conn *control.Conn) {
+	go func() {
+		err := conn.HandleEvents(b.ctx)
+
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+
+		select {
+		case b.disconnected <- fmt.Errorf("failed to handle events: %v", err):
+		default:
+		}
+	}()
+}
+
+// attach moves the bus to a new connection and asks tor for the events of the subscriptions on it
+func (b *EventBus) attach(conn *control.Conn) error {
+	b.listenLock.Lock()
+	defer b.listenLock.Unlock()
+
+	if b.detached {
+		return b.err
+	}
+
+	var codes []control.EventCode
+	for code := range b.codes {
+		codes = append(codes, code)
+	}
+
+	if len(codes) > 0 {
+		b.commandLock.Lock()
+		err := conn.AddEventListener(b.eventCh, codes...)
+		b.commandLock.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to listen for events: %v", err)
+		}
+	}
+
+	b.conn = conn
+	b.handle(conn)
+
+	return nil
+}
+
+// Stop stops handling events
+func (b *EventBus) Stop() {
+	b.once.Do(func() {
+		close(b.stop)
+		b.cancel()
+	})
+}
+
+// Done is closed once the bus stopped handling events
+func (b *EventBus) Done() <-chan struct{} {
+	return b.done
+}
+
+// Disconnected receives an error when the events of the connection can't be handled anymore, the bus keeps its
+// subscriptions until it is attached to a new connection
+func (b *EventBus) Disconnected() <-chan error {
+	return b.disconnected
+}
+
+// Err returns why the bus stopped handling events, it is only set once Done is closed
+func (b *EventBus) Err() error {
+	select {
+	case <-b.done:
+		return b.err
+	default:
+		return nil
+	}
+}
+
+// publish queues the event for the subscriptions of its code
+func (b *EventBus) publish(event control.Event) {
+	b.subscriptionsLock.RLock()
+	defer b.subscriptionsLock.RUnlock()
+
+	for subscription := range b.subscriptions {
+		for _, code := range subscription.codes {
+			if code == event.Code() {
+				subscription.push(event)
+				break
+			}
+		}
+	}
+}
+
+// detach stops tor from sending any events, bine blocks until relayed events are read so they are drained
+// meanwhile
+func (b *EventBus) detach() {
+	detached := make(chan struct{})
+	go func() {
+		defer close(detached)
+
+		b.listenLock.Lock()
+		defer b.listenLock.Unlock()
+
+		var codes []control.EventCode
+		for code := range b.codes {
+			codes = append(codes, code)
+		}
+		b.codes = make(map[control.EventCode]int)
+		b.detached = true
+
+		b.commandLock.Lock()
+		defer b.commandLock.Unlock()
+
+		b.conn.RemoveEventListener(b.eventCh, codes...)
+	}()
+
+	for {
+		select {
+		case <-detached:
+			return
+		case <-b.eventCh:
+		}
+	}
+}
+
+// subscribe asks tor for the codes nobody subscribed to yet and adds the subscription
+func (b *EventBus) subscribe(deliver func(control.Event, <-chan struct{}), codes ...control.EventCode) (
+	*Subscription, error) {
+	b.listenLock.Lock()
+	defer b.listenLock.Unlock()
+
+	if b.detached {
+		return nil, b.err
+	}
+
+	var newCodes []control.EventCode
+	for _, code := range codes {
+		if b.codes[code] == 0 {
+			newCodes = append(newCodes, code)
+		}
+	}
+
+	if len(newCodes) > 0 {
+		b.commandLock.Lock()
+		err := b.conn.AddEventListener(b.eventCh, newCodes...)
+		b.commandLock.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for events: %v", err)
+		}
+	}
+
+	for _, code := range codes {
+		b.codes[code]++
+	}
+
+	subscription := &Subscription{
+		bus:     b,
+		codes:   codes,
+		deliver: deliver,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go subscription.run()
+
+	b.subscriptionsLock.Lock()
+	b.subscriptions[subscription] = true
+	b.subscriptionsLock.Unlock()
+
+	return subscription, nil
+}
+
+// unsubscribe removes the subscription and stops tor from sending the codes nobody is subscribed to anymore
+func (b *EventBus) unsubscribe(subscription *Subscription) error {
+	b.subscriptionsLock.Lock()
+	delete(b.subscriptions, subscription)
+	b.subscriptionsLock.Unlock()
+
+	b.listenLock.Lock()
+	defer b.listenLock.Unlock()
+
+	var unusedCodes []control.EventCode
+	for _, code := range subscription.codes {
+		if b.codes[code] == 0 {
+			// the bus detached already
+			continue
+		}
+
+		b.codes[code]--
+		if b.codes[code] == 0 {
+			delete(b.codes, code)
+			unusedCodes = append(unusedCodes, code)
+		}
+	}
+
+	if len(unusedCodes) == 0 {
+		return nil
+	}
+
+	b.commandLock.Lock()
+	defer b.commandLock.Unlock()
+
+	return b.conn.RemoveEventListener(b.eventCh, unusedCodes...)
+}
+
+// Subscribe sends the events of the given codes to ch
+func (b *EventBus) Subscribe(ch chan<- control.Event, codes ...control.EventCode) (*Subscription, error) {
+	return b.subscribe(func(event control.Event, done <-chan struct{}) {
+		select {
+		case ch <- event:
+		case <-done:
+		}
+	}, codes...)
+}
+
+// SubscribeHSDesc sends the HS_DESC events to ch
+func (b *EventBus) SubscribeHSDesc(ch chan<- *control.HSDescEvent) (*Subscription, error) {
+	return b.subscribe(func(event control.Event, done <-chan struct{}) {
+		select {
+		case ch <- event.(*control.HSDescEvent):
+		case <-done:
+		}
+	}, control.EventCodeHSDesc)
+}
+
+// SubscribeHSDescContent sends the HS_DESC_CONTENT events to ch
+func (b *EventBus) SubscribeHSDescContent(ch chan<- *control.HSDescContentEvent) (*Subscription, error) {
+	return b.subscribe(func(event control.Event, done <-chan struct{}) {
+		select {
+		case ch <- event.(*control.HSDescContentEvent):
+		case <-done:
+		}
+	}, control.EventCodeHSDescContent)
+}
+
+// SubscribeStatusGeneral sends the STATUS_GENERAL events to ch
+func (b *EventBus) SubscribeStatusGeneral(ch chan<- *control.StatusEvent) (*Subscription, error) {
+	return b.subscribe(func(event control.Event, done <-chan struct{}) {
+		select {
+		case ch <- event.(*control.StatusEvent):
+		case <-done:
+		}
+	}, control.EventCodeStatusGeneral)
+}
+
+// push queues an event
+func (s *Subscription) push(event control.Event) {
+	s.queueLock.Lock()
+	s.queue = append(s.queue, event)
+	s.queueLock.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued events in order until the subscription is unsubscribed
+func (s *Subscription) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.notify:
+		}
+
+		for {
+			s.queueLock.Lock()
+			if len(s.queue) == 0 {
+				s.queueLock.Unlock()
+				break
+			}
+
+			event := s.queue[0]
+			s.queue = s.queue[1:]
+			s.queueLock.Unlock()
+
+			s.deliver(event, s.done)
+
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// Unsubscribe stops sending events to the channel of the subscription, it is safe to call more than once
+func (s *Subscription) Unsubscribe() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.bus.unsubscribe(s)
+	})
+
+	return err
+}
+
+// newEventBus returns a new EventBus for the connection, commandLock must be held while sending commands on it
+func newEventBus(conn *control.Conn, commandLock *sync.Mutex) *EventBus {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &EventBus{
+		conn:          conn,
+		commandLock:   commandLock,
+		eventCh:       make(chan control.Event),
+		codes:         make(map[control.EventCode]int),
+		subscriptions: make(map[*Subscription]bool),
+		disconnected:  make(chan error, 1),
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+		stop:          make(chan struct{}),
+	}
+}
@@ -0,0 +1,78 @@
+package onion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control"
+)
+
+func TestEventBus(t *testing.T) {
+	t.Parallel()
+
+	controller, tor := newTorStandIn(t, 1, "SETEVENTS", 2, []string{
+		"650 STATUS_GENERAL NOTICE CONSENSUS_ARRIVED\r\n",
+		"650 HS_DESC RECEIVED 7ctbljpgkiayaita NO_AUTH $1111111111111111111111111111111111111111\r\n",
+	})
+	defer controller.Close()
+
+	events := controller.Events()
+
+	statusCh := make(chan *control.StatusEvent)
+	statusSubscription, err := events.SubscribeStatusGeneral(statusCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventCh := make(chan control.Event)
+	subscription, err := events.Subscribe(eventCh, control.EventCodeHSDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the status event isn't read yet, it mustn't hold up the other subscription
+	select {
+	case event := <-eventCh:
+		if hsDescEvent, ok := event.(*control.HSDescEvent); !ok || hsDescEvent.Address != "7ctbljpgkiayaita" {
+			t.Errorf("unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the HS_DESC event")
+	}
+
+	select {
+	case event := <-statusCh:
+		if event.Action != "CONSENSUS_ARRIVED" {
+			t.Errorf("unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the STATUS_GENERAL event")
+	}
+
+	if err = statusSubscription.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = subscription.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	tor.commandsLock.Lock()
+	lastCommand := tor.commands[len(tor.commands)-1]
+	tor.commandsLock.Unlock()
+
+	if lastCommand != "SETEVENTS" {
+		t.Errorf("expected all the events to be turned off got %q", lastCommand)
+	}
+
+	events.Stop()
+	<-events.Done()
+
+	if events.Err() == nil {
+		t.Error("expected an error once the bus stopped")
+	}
+
+	if _, err = events.SubscribeStatusGeneral(statusCh); err == nil {
+		t.Error("expected subscribing to a stopped bus to fail")
+	}
+}
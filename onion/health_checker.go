@@ -0,0 +1,207 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+// Health check types
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+)
+
+// IHealthChecker is the interface for HealthChecker
+type IHealthChecker interface {
+	Healthy(string) bool
+}
+
+// contextDialer is implemented by the SOCKS5 dialer of golang.org/x/net/proxy
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// HealthChecker periodically connects to backend services through the SOCKS port of tor, either opening a TCP
+// connection to a virtual port or sending a HTTP GET request to it. Backends are healthy until a check fails and
+// it is safe for concurrent use.
+type HealthChecker struct {
+	dialer    contextDialer
+	addresses []string
+	port      int
+	checkType string
+	path      string
+	interval  time.Duration
+	timeout   time.Duration
+	logger    *zap.SugaredLogger
+
+	unhealthy     map[string]bool
+	unhealthyLock sync.RWMutex
+
+	once sync.Once
+	stop chan struct{}
+}
+
+// Healthy returns false if the last check of the backend failed
+func (h *HealthChecker) Healthy(address string) bool {
+	h.unhealthyLock.RLock()
+	defer h.unhealthyLock.RUnlock()
+
+	return !h.unhealthy[normalizeAddress(address)]
+}
+
+// Start checks the backends every interval until the HealthChecker is stopped
+func (h *HealthChecker) Start() {
+	h.logger.Debug("health_checker: starting")
+
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			h.checkAll()
+
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the HealthChecker
+func (h *HealthChecker) Stop() {
+	h.once.Do(func() {
+		close(h.stop)
+		h.logger.Debug("health_checker: stopping")
+	})
+}
+
+// checkAll checks all the backends concurrently and records which are unhealthy
+func (h *HealthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, address := range h.addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+
+			err := h.check(address)
+
+			h.unhealthyLock.Lock()
+			defer h.unhealthyLock.Unlock()
+
+			switch {
+			case err != nil && !h.unhealthy[address]:
+				h.logger.Warnf("health_checker: backend %s is unhealthy: %v", address, err)
+				h.unhealthy[address] = true
+			case err == nil && h.unhealthy[address]:
+				h.logger.Infof("health_checker: backend %s is healthy again", address)
+				delete(h.unhealthy, address)
+			}
+		}(address)
+	}
+
+	wg.Wait()
+}
+
+// check connects to the virtual port of the backend through tor
+func (h *HealthChecker) check(address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	target := net.JoinHostPort(address+".onion", strconv.Itoa(h.port))
+	if h.checkType == HealthCheckTCP {
+		conn, err := h.dialer.DialContext(ctx, "tcp", target)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: h.dialer.DialContext},
+	}
+	defer client.Transport.(*http.Transport).CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+target+h.path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// normalizeAddress lowercases an onion address and strips the .onion suffix
+func normalizeAddress(address string) string {
+	return strings.TrimSuffix(strings.ToLower(address), ".onion")
+}
+
+// NewHealthChecker returns a new HealthChecker for the backend addresses that uses the tor SOCKS port at
+// socksAddress, checkType is HealthCheckTCP or HealthCheckHTTP
+func NewHealthChecker(socksAddress string, addresses []string, port int, checkType, path string, interval,
+	timeout time.Duration, logger *zap.SugaredLogger) (*HealthChecker, error) {
+	if checkType != HealthCheckTCP && checkType != HealthCheckHTTP {
+		return nil, fmt.Errorf("unknown health check type %s", checkType)
+	}
+
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid health check port %d", port)
+	}
+
+	if interval <= 0 || timeout <= 0 {
+		return nil, errors.New("health check interval and timeout must be positive")
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", socksAddress, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SOCKS dialer: %v", err)
+	}
+
+	socksDialer, ok := dialer.(contextDialer)
+	if !ok {
+		return nil, errors.New("SOCKS dialer does not support contexts")
+	}
+
+	var normalized []string
+	for _, address := range addresses {
+		normalized = append(normalized, normalizeAddress(address))
+	}
+
+	return &HealthChecker{
+		dialer:    socksDialer,
+		addresses: normalized,
+		port:      port,
+		checkType: checkType,
+		path:      path,
+		interval:  interval,
+		timeout:   timeout,
+		logger:    logger,
+		unhealthy: make(map[string]bool),
+		stop:      make(chan struct{}),
+	}, nil
+}
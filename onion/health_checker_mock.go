@@ -0,0 +1,9 @@
+package onion
+
+type MockHealthChecker struct {
+	unhealthy map[string]bool
+}
+
+func (m *MockHealthChecker) Healthy(address string) bool {
+	return !m.unhealthy[address]
+}
@@ -0,0 +1,199 @@
+package onion
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+)
+
+// socksStandIn is a minimal SOCKS5 server that, like the SOCKS port of tor, connects onion addresses to the
+// services behind them, which are local listeners here
+type socksStandIn struct {
+	listener net.Listener
+	services map[string]string
+}
+
+func newSocksStandIn(t *testing.T, services map[string]string) *socksStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &socksStandIn{listener: listener, services: services}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.handle(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *socksStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// greeting, no authentication
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+
+	conn.Write([]byte{5, 0})
+
+	// CONNECT request with a domain name
+	request := make([]byte, 5)
+	if _, err := io.ReadFull(conn, request); err != nil || request[3] != 3 {
+		return
+	}
+
+	host := make([]byte, int(request[4])+2)
+	if _, err := io.ReadFull(conn, host); err != nil {
+		return
+	}
+
+	port := binary.BigEndian.Uint16(host[len(host)-2:])
+	target, ok := s.services[net.JoinHostPort(string(host[:len(host)-2]), strconv.Itoa(int(port)))]
+	if !ok {
+		// host unreachable
+		conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	service, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer service.Close()
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(service, conn)
+	io.Copy(conn, service)
+}
+
+func TestHealthChecker_check(t *testing.T) {
+	t.Parallel()
+
+	okServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer okServer.Close()
+
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failingServer.Close()
+
+	socks := newSocksStandIn(t, map[string]string{
+		"7ctbljpgkiayaita.onion:80": okServer.Listener.Addr().String(),
+		"irthspr2nebf7x5i.onion:80": failingServer.Listener.Addr().String(),
+	})
+	defer socks.listener.Close()
+
+	testCases := []struct {
+		name      string
+		address   string
+		checkType string
+
+		expectedErr bool
+	}{
+		{
+			"tcp - OK",
+			"7ctbljpgkiayaita",
+			HealthCheckTCP,
+			false,
+		},
+		{
+			"tcp - unreachable",
+			"aaaaaaaaaaaaaaaa",
+			HealthCheckTCP,
+			true,
+		},
+		{
+			"http - OK",
+			"7ctbljpgkiayaita",
+			HealthCheckHTTP,
+			false,
+		},
+		{
+			"http - server error",
+			"irthspr2nebf7x5i",
+			HealthCheckHTTP,
+			true,
+		},
+		{
+			"http - unreachable",
+			"aaaaaaaaaaaaaaaa",
+			HealthCheckHTTP,
+			true,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		// not parallel, the servers are closed when the test function returns
+		t.Run(tt.name, func(t *testing.T) {
+			healthChecker, err := NewHealthChecker(socks.listener.Addr().String(), []string{tt.address}, 80,
+				tt.checkType, "health", time.Minute, 5*time.Second, common.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = healthChecker.check(tt.address); (err != nil) != tt.expectedErr {
+				t.Errorf("expected error %v got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestHealthChecker_checkAll(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	socks := newSocksStandIn(t, map[string]string{
+		"7ctbljpgkiayaita.onion:80": server.Listener.Addr().String(),
+	})
+	defer socks.listener.Close()
+
+	healthChecker, err := NewHealthChecker(socks.listener.Addr().String(),
+		[]string{"7ctbljpgkiayaita", "irthspr2nebf7x5i.onion"}, 80, HealthCheckTCP, "", time.Minute, 5*time.Second,
+		common.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !healthChecker.Healthy("irthspr2nebf7x5i") {
+		t.Error("expected backends to be healthy before they are checked")
+	}
+
+	healthChecker.checkAll()
+
+	if !healthChecker.Healthy("7ctbljpgkiayaita") {
+		t.Error("expected 7ctbljpgkiayaita to be healthy")
+	}
+
+	if healthChecker.Healthy("irthspr2nebf7x5i.onion") {
+		t.Error("expected irthspr2nebf7x5i to be unhealthy")
+	}
+}
@@ -1,8 +1,9 @@
 package onion
 
 import (
-	"context"
+	"bytes"
 	"encoding/base32"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -11,23 +12,42 @@ import (
 	"sync"
 
 	"github.com/cretz/bine/control"
+	"github.com/csucu/onionspread/common"
 	"github.com/csucu/onionspread/descriptor"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	defaultHSDirNReplicas   = 2
+	defaultHSDirSpreadStore = 4
 )
 
 // IHSDirFetcher is the interface for HSDirFetcher
 type IHSDirFetcher interface {
 	CalculateResponsibleHSDirs(string) ([]descriptor.RouterStatusEntry, error)
+	CalculateResponsibleHSDirsV3(ed25519.PublicKey, int64, bool) ([][]descriptor.RouterStatusEntry, error)
 }
 
-// HSDirFetcher maintains a list of HSDirs which it gets from the consensus, the list is updated every time
-// the controller returns an status_general event. It is used to calculate the responsible hsdirs for a given
+// HSDirFetcher maintains a list of HSDirs and the shared random values which it gets from the consensus, they
+// are updated every time the controller returns an status_general event. It is used to calculate the responsible hsdirs for a given
 // service and is safe for concurrent use.
 type HSDirFetcher struct {
 	controller IController
 	logger     *zap.SugaredLogger
 	hsDirs     []descriptor.RouterStatusEntry
 
+	// v3 hash ring state, taken from the consensus
+	currentSRV   []byte
+	previousSRV  []byte
+	periodLength int64
+	nReplicas    int
+	spreadStore  int
+
+	// families maps the fingerprint of every relay to the fingerprints of the family it declared
+	families map[string]map[string]bool
+
 	hsDirsLock sync.RWMutex
 
 	once sync.Once
@@ -36,30 +56,99 @@ type HSDirFetcher struct {
 
 // update refreshes the internal list of hsdirs
 func (f *HSDirFetcher) update() error {
-	routerEntries, err := f.controller.FetchRouterStatusEntries()
+	consensus, err := f.controller.FetchConsensus()
 	if err != nil {
 		return err
 	}
 
-	if len(routerEntries) == 0 {
+	if consensus == nil || len(consensus.RouterStatusEntries) == 0 {
 		return errors.New("failed to fetch router status entries")
 	}
 
+	// the ed25519 identities needed for the v3 ring live in the microdescriptors, v2 works without them
+	identities := make(map[string][]byte)
+	declaredFamilies := make(map[string][]string)
+	microdescriptors, err := f.controller.FetchMicrodescriptors()
+	if err != nil {
+		f.logger.Warnf("hsdir_fetcher: failed to fetch microdescriptors: %v", err)
+	}
+
+	for _, microdescriptor := range microdescriptors {
+		identities[microdescriptor.Digest] = microdescriptor.Ed25519Identity
+		declaredFamilies[microdescriptor.Digest] = microdescriptor.Family
+	}
+
 	var HSDirs []descriptor.RouterStatusEntry
+	identified := 0
+	families := make(map[string]map[string]bool)
 	// grab all hsdirs
-	for _, routerStatusEntry := range routerEntries {
+	for _, routerStatusEntry := range consensus.RouterStatusEntries {
+		if family, ok := declaredFamilies[routerStatusEntry.MicrodescriptorDigest]; ok && len(family) > 0 {
+			families[routerStatusEntry.Fingerprint] = parseFamily(family)
+		}
+
 		if routerStatusEntry.Flags.HSDir {
+			if identity, ok := identities[routerStatusEntry.MicrodescriptorDigest]; ok {
+				routerStatusEntry.Ed25519Identity = identity
+				identified++
+			}
+
 			HSDirs = append(HSDirs, routerStatusEntry)
 		}
 	}
 
+	if len(HSDirs) > 0 && identified == 0 {
+		f.logger.Errorf("hsdir_fetcher: no hsdir has an ed25519 identity, v3 services can't be published until " +
+			"tor has the microdesc consensus and microdescriptors")
+	}
+
 	f.hsDirsLock.Lock()
 	f.hsDirs = HSDirs
+	f.currentSRV = consensus.SharedRandCurrentValue
+	f.previousSRV = consensus.SharedRandPreviousValue
+	f.periodLength = int64(consensus.Param("hsdir-interval", common.TimePeriodLengthV3))
+	f.nReplicas = consensus.Param("hsdir_n_replicas", defaultHSDirNReplicas)
+	f.spreadStore = consensus.Param("hsdir_spread_store", defaultHSDirSpreadStore)
+	f.families = families
 	f.hsDirsLock.Unlock()
 
 	return nil
 }
 
+// parseFamily returns the fingerprints of a family line, members given by nickname are left out as nicknames
+// aren't unique
+func parseFamily(family []string) map[string]bool {
+	fingerprints := make(map[string]bool)
+	for _, member := range family {
+		if !strings.HasPrefix(member, "$") {
+			continue
+		}
+
+		fingerprint := strings.ToUpper(member[1:])
+		if end := strings.IndexAny(fingerprint, "=~"); end >= 0 {
+			fingerprint = fingerprint[:end]
+		}
+
+		if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 40 {
+			continue
+		}
+
+		fingerprints[fingerprint] = true
+	}
+
+	return fingerprints
+}
+
+// SameFamily returns true if the relays with the given fingerprints both declared the other as family
+func (f *HSDirFetcher) SameFamily(fingerprintA, fingerprintB string) bool {
+	f.hsDirsLock.RLock()
+	defer f.hsDirsLock.RUnlock()
+
+	fingerprintA, fingerprintB = strings.ToUpper(fingerprintA), strings.ToUpper(fingerprintB)
+
+	return f.families[fingerprintA][fingerprintB] && f.families[fingerprintB][fingerprintA]
+}
+
 // CalculateResponsibleHSDirs returns the responsible hsdirs given a descriptor ID
 func (f *HSDirFetcher) CalculateResponsibleHSDirs(descriptorID string) ([]descriptor.RouterStatusEntry, error) {
 	decoded, err := base32.StdEncoding.DecodeString(descriptorID)
@@ -100,6 +189,127 @@ func (f *HSDirFetcher) CalculateResponsibleHSDirs(descriptorID string) ([]descri
 	return responsibleHSDirs, nil
 }
 
+// PeriodLength returns the length of a v3 time period in minutes, it is the hsdir-interval of the consensus
+func (f *HSDirFetcher) PeriodLength() int64 {
+	f.hsDirsLock.RLock()
+	defer f.hsDirsLock.RUnlock()
+
+	return f.periodLength
+}
+
+// CalculateResponsibleHSDirsV3 returns the responsible hsdirs for each replica given the blinded key of a service
+// and the time period of the descriptor. The first descriptor of the overlap uses the previous shared random
+// value and the second uses the current one
+func (f *HSDirFetcher) CalculateResponsibleHSDirsV3(blindedKey ed25519.PublicKey, timePeriod int64,
+	firstDescriptor bool) ([][]descriptor.RouterStatusEntry, error) {
+	f.hsDirsLock.RLock()
+	defer f.hsDirsLock.RUnlock()
+
+	srv := f.currentSRV
+	if firstDescriptor {
+		srv = f.previousSRV
+	}
+
+	if srv == nil {
+		srv = calculateDisasterSRV(timePeriod, f.periodLength)
+	}
+
+	// Build the ring sorted by hsdir_index, relays without an ed25519 identity can't be placed on it
+	var ring []hsDirIndexV3
+	for _, hsDir := range f.hsDirs {
+		if hsDir.Ed25519Identity == nil {
+			continue
+		}
+
+		ring = append(ring, hsDirIndexV3{
+			index: calculateHSDirIndexV3(hsDir.Ed25519Identity, srv, timePeriod, f.periodLength),
+			entry: hsDir,
+		})
+	}
+
+	if len(ring) == 0 {
+		return nil, errors.New("no hsdirs with an ed25519 identity available")
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return bytes.Compare(ring[i].index, ring[j].index) < 0 })
+
+	var responsibleHSDirs [][]descriptor.RouterStatusEntry
+	used := make(map[string]bool)
+	for replica := 1; replica <= f.nReplicas; replica++ {
+		hsIndex := calculateHSIndexV3(blindedKey, replica, timePeriod, f.periodLength)
+		startIndex := sort.Search(len(ring), func(i int) bool { return bytes.Compare(ring[i].index, hsIndex) >= 0 })
+
+		var replicaHSDirs []descriptor.RouterStatusEntry
+		for i := 0; i < len(ring) && len(replicaHSDirs) < f.spreadStore; i++ {
+			hsDir := ring[(startIndex+i)%len(ring)].entry
+
+			// a relay is only responsible once across replicas
+			if used[hsDir.Fingerprint] {
+				continue
+			}
+
+			used[hsDir.Fingerprint] = true
+			replicaHSDirs = append(replicaHSDirs, hsDir)
+		}
+
+		responsibleHSDirs = append(responsibleHSDirs, replicaHSDirs)
+	}
+
+	return responsibleHSDirs, nil
+}
+
+// hsDirIndexV3 is a position on the v3 hash ring
+type hsDirIndexV3 struct {
+	index []byte
+	entry descriptor.RouterStatusEntry
+}
+
+// calculateHSIndexV3 computes where a replica of a descriptor is stored on the ring
+// hs_index(replicanum) = SHA3_256("store-at-idx" | blinded_public_key | INT_8(replicanum) | INT_8(period_length) |
+// INT_8(period_num))
+func calculateHSIndexV3(blindedKey ed25519.PublicKey, replica int, timePeriod, periodLength int64) []byte {
+	h := sha3.New256()
+	h.Write([]byte("store-at-idx"))
+	h.Write(blindedKey)
+	h.Write(uint64Bytes(uint64(replica)))
+	h.Write(uint64Bytes(uint64(periodLength)))
+	h.Write(uint64Bytes(uint64(timePeriod)))
+
+	return h.Sum(nil)
+}
+
+// calculateHSDirIndexV3 computes the position of a relay on the ring
+// hsdir_index(node) = SHA3_256("node-idx" | node_identity | shared_random_value | INT_8(period_num) |
+// INT_8(period_length))
+func calculateHSDirIndexV3(identity, srv []byte, timePeriod, periodLength int64) []byte {
+	h := sha3.New256()
+	h.Write([]byte("node-idx"))
+	h.Write(identity)
+	h.Write(srv)
+	h.Write(uint64Bytes(uint64(timePeriod)))
+	h.Write(uint64Bytes(uint64(periodLength)))
+
+	return h.Sum(nil)
+}
+
+// calculateDisasterSRV returns the shared random value to use when the consensus has none
+// SRV = SHA3_256("shared-random-disaster" | INT_8(period_length) | INT_8(period_num))
+func calculateDisasterSRV(timePeriod, periodLength int64) []byte {
+	h := sha3.New256()
+	h.Write([]byte("shared-random-disaster"))
+	h.Write(uint64Bytes(uint64(periodLength)))
+	h.Write(uint64Bytes(uint64(timePeriod)))
+
+	return h.Sum(nil)
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+
+	return b
+}
+
 // Start starts the HSDirFetcher
 func (f *HSDirFetcher) Start() error {
 	f.logger.Debug("hsdir_fetcher: starting")
@@ -127,54 +337,95 @@ func (f *HSDirFetcher) Stop() {
 	})
 }
 
-// listen listens for status general events from the tor controller
-// when it receives the event it updates its internal hsdir list
+// listen listens for status general events from the event buses of the controller
+// when it receives the event or the controller reconnected it updates its internal hsdir list
 func (f *HSDirFetcher) listen() error {
-	eventCh := make(chan control.Event)
-	defer close(eventCh)
+	buses := f.controller.EventBuses()
+	reconnected := f.controller.Reconnected()
 
-	err := f.controller.GetConn().AddEventListener(eventCh, control.EventCodeStatusGeneral)
-	if err != nil {
-		return err
-	}
-	defer f.controller.GetConn().RemoveEventListener(eventCh, control.EventCodeStatusGeneral)
+	eventCh := make(chan *control.StatusEvent)
+	subscriptions := make(map[*EventBus]*Subscription)
+	defer func() {
+		for _, subscription := range subscriptions {
+			subscription.Unsubscribe()
+		}
+	}()
 
-	// Grab events
-	eventCtx := context.Background()
-	defer eventCtx.Done()
+	f.subscribe(buses, subscriptions, eventCh)
+	if len(subscriptions) == 0 {
+		return errors.New("failed to subscribe to the events of any controller")
+	}
 
-	errCh := make(chan error, 1)
+	stopped := make(chan error)
+	for _, events := range buses {
+		go func(events *EventBus) {
+			select {
+			case <-f.stop:
+			case <-events.Done():
+				select {
+				case stopped <- events.Err():
+				case <-f.stop:
+				}
+			}
+		}(events)
+	}
 
-	go func() { errCh <- f.controller.GetConn().HandleEvents(eventCtx) }()
+	running := len(buses)
 	for {
 		select {
 		case <-f.stop:
 			return nil
-		case <-eventCtx.Done():
-			f.logger.Info("hsdir_fetcher: event context closed, stopping listener")
-			return nil
-		case err := <-errCh:
-			f.logger.Errorf("hsdir_fetcher: error channel: %v", err)
-			return err
-			//return nil, err
-		case event := <-eventCh:
-			f.logger.Debug("hsdir_fetcher: got a new event")
-			statusEvent := event.(*control.StatusEvent)
-			if statusEvent.Code() == control.EventCodeStatusGeneral {
-				f.logger.Debug("hsdir_fetcher: event is a status general event, updating")
-				err = f.update()
-				if err != nil {
-					f.logger.Errorf("hsdir_fetcher: failed to update: %v", err)
-				}
+		case err := <-stopped:
+			f.logger.Errorf("hsdir_fetcher: event bus stopped: %v", err)
+			running--
+			if running == 0 {
+				return err
+			}
+		case <-eventCh:
+			f.logger.Debug("hsdir_fetcher: got a status general event, updating")
+			err := f.update()
+			if err != nil {
+				f.logger.Errorf("hsdir_fetcher: failed to update: %v", err)
 			}
+		case <-reconnected:
+			reconnected = f.controller.Reconnected()
+			f.logger.Info("hsdir_fetcher: controller reconnected, updating")
+			f.subscribe(buses, subscriptions, eventCh)
+			err := f.update()
+			if err != nil {
+				f.logger.Errorf("hsdir_fetcher: failed to update: %v", err)
+			}
+		}
+	}
+}
+
+// subscribe subscribes to the status general events of the buses that aren't subscribed to yet, subscribing fails
+// while the controller of a bus is disconnected so it is tried again once the controller reconnected
+func (f *HSDirFetcher) subscribe(buses []*EventBus, subscriptions map[*EventBus]*Subscription,
+	eventCh chan<- *control.StatusEvent) {
+	for i, events := range buses {
+		if subscriptions[events] != nil || events.Err() != nil {
+			continue
+		}
+
+		subscription, err := events.SubscribeStatusGeneral(eventCh)
+		if err != nil {
+			f.logger.Warnf("hsdir_fetcher: failed to subscribe to the events of controller %d: %v", i, err)
+			continue
 		}
+
+		subscriptions[events] = subscription
 	}
 }
 
 // NewHSDirFetcher returns a new HSDirFetcher
 func NewHSDirFetcher(controller IController, logger *zap.SugaredLogger) *HSDirFetcher {
 	return &HSDirFetcher{
-		controller: controller,
-		logger:     logger,
+		controller:   controller,
+		logger:       logger,
+		periodLength: common.TimePeriodLengthV3,
+		nReplicas:    defaultHSDirNReplicas,
+		spreadStore:  defaultHSDirSpreadStore,
+		stop:         make(chan struct{}),
 	}
 }
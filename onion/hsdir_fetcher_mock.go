@@ -1,12 +1,21 @@
 package onion
 
-import "github.com/csucu/onionspread/descriptor"
+import (
+	"github.com/csucu/onionspread/descriptor"
+	"golang.org/x/crypto/ed25519"
+)
 
 type MockHSDirFetcher struct {
 	returnResponsibleHSdirsMap map[string][]descriptor.RouterStatusEntry
-	returnErr error
+	returnResponsibleHSDirsV3  [][]descriptor.RouterStatusEntry
+	returnErr                  error
 }
 
 func (m *MockHSDirFetcher) CalculateResponsibleHSDirs(descriptorID string) ([]descriptor.RouterStatusEntry, error) {
 	return m.returnResponsibleHSdirsMap[descriptorID], m.returnErr
-}
\ No newline at end of file
+}
+
+func (m *MockHSDirFetcher) CalculateResponsibleHSDirsV3(blindedKey ed25519.PublicKey, timePeriod int64,
+	firstDescriptor bool) ([][]descriptor.RouterStatusEntry, error) {
+	return m.returnResponsibleHSDirsV3, m.returnErr
+}
@@ -1,14 +1,19 @@
 package onion
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
+	"io/ioutil"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/csucu/onionspread/common"
 	"github.com/csucu/onionspread/descriptor"
+	"golang.org/x/crypto/ed25519"
 )
 
 func TestHSDirFetcher_update(t *testing.T) {
@@ -26,21 +31,23 @@ func TestHSDirFetcher_update(t *testing.T) {
 		{
 			"OK",
 			&MockController{
-				ReturnedRouterStatusEntries: []descriptor.RouterStatusEntry{
-					{
-						Nickname: "entry1",
-						Flags: descriptor.RouterFlags{
-							HSDir: true,
+				ReturnedConsensus: &descriptor.Consensus{
+					RouterStatusEntries: []descriptor.RouterStatusEntry{
+						{
+							Nickname: "entry1",
+							Flags: descriptor.RouterFlags{
+								HSDir: true,
+							},
 						},
-					},
-					{
-						Nickname: "entry2",
-						Flags:    descriptor.RouterFlags{},
-					},
-					{
-						Nickname: "entry3",
-						Flags: descriptor.RouterFlags{
-							HSDir: true,
+						{
+							Nickname: "entry2",
+							Flags:    descriptor.RouterFlags{},
+						},
+						{
+							Nickname: "entry3",
+							Flags: descriptor.RouterFlags{
+								HSDir: true,
+							},
 						},
 					},
 				},
@@ -95,11 +102,58 @@ func TestHSDirFetcher_update(t *testing.T) {
 	}
 }
 
+func TestHSDirFetcher_listenDisconnected(t *testing.T) {
+	t.Parallel()
+
+	disconnected, disconnectedTor := newTorStandIn(t, 1, "", 0, nil)
+	defer disconnected.Close()
+
+	controller, tor := newTorStandIn(t, 1, "SETEVENTS", 1,
+		[]string{"650 STATUS_GENERAL NOTICE CONSENSUS_ARRIVED\r\n"})
+	defer controller.Close()
+
+	// the first controller lost its connection and doesn't reconnect
+	disconnectedTor.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for disconnected.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("controller didn't notice the lost connection")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pool, err := NewControllerPool([]IController{disconnected, controller}, PublishSpread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	fetcher := NewHSDirFetcher(pool, common.NewNopLogger())
+	defer fetcher.Stop()
+	go fetcher.listen()
+
+	// the event of the second controller makes the fetcher update through it
+	for {
+		tor.commandsLock.Lock()
+		updates := tor.count("GETINFO")
+		tor.commandsLock.Unlock()
+
+		if updates > 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("fetcher didn't update on the event of the connected controller")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func TestCalculateResponsibleHSDirs(t *testing.T) {
 	t.Parallel()
 
 	controller := &MockController{
-		ReturnedRouterStatusEntries: routerStatusEntries,
+		ReturnedConsensus: &descriptor.Consensus{RouterStatusEntries: routerStatusEntries},
 	}
 
 	hsdirFetcher := NewHSDirFetcher(controller, common.NewNopLogger())
@@ -328,3 +382,248 @@ func TestCalculateResponsibleHSDirs(t *testing.T) {
 		})
 	}
 }
+
+func TestCalculateResponsibleHSDirsV3(t *testing.T) {
+	t.Parallel()
+
+	controller := &MockController{
+		ReturnedConsensus: &descriptor.Consensus{RouterStatusEntries: routerStatusEntries},
+	}
+
+	hsdirFetcher := NewHSDirFetcher(controller, common.NewNopLogger())
+	if err := hsdirFetcher.update(); err != nil {
+		t.Fatalf("failed to update hsdir fetcher: %v", err)
+	}
+
+	// Synthetic ed25519 identities and shared random values, the test data has neither
+	for i, hsDir := range hsdirFetcher.hsDirs {
+		identity := sha256.Sum256([]byte(hsDir.Fingerprint))
+		hsdirFetcher.hsDirs[i].Ed25519Identity = identity[:]
+	}
+
+	previousSRV := sha256.Sum256([]byte("previous"))
+	currentSRV := sha256.Sum256([]byte("current"))
+	hsdirFetcher.previousSRV = previousSRV[:]
+	hsdirFetcher.currentSRV = currentSRV[:]
+
+	blindedKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+
+	first, err := hsdirFetcher.CalculateResponsibleHSDirsV3(blindedKey, 17756, true)
+	if err != nil {
+		t.Fatalf("failed to calculate responsible hsdirs: %v", err)
+	}
+
+	second, err := hsdirFetcher.CalculateResponsibleHSDirsV3(blindedKey, 17757, false)
+	if err != nil {
+		t.Fatalf("failed to calculate responsible hsdirs: %v", err)
+	}
+
+	for _, responsibleHSDirs := range [][][]descriptor.RouterStatusEntry{first, second} {
+		if len(responsibleHSDirs) != defaultHSDirNReplicas {
+			t.Fatalf("expected %v replicas got %v", defaultHSDirNReplicas, len(responsibleHSDirs))
+		}
+
+		seen := make(map[string]bool)
+		for _, replica := range responsibleHSDirs {
+			if len(replica) != defaultHSDirSpreadStore {
+				t.Errorf("expected %v hsdirs got %v", defaultHSDirSpreadStore, len(replica))
+			}
+
+			for _, hsDir := range replica {
+				if seen[hsDir.Fingerprint] {
+					t.Errorf("hsdir %v is responsible more than once", hsDir.Fingerprint)
+				}
+				seen[hsDir.Fingerprint] = true
+			}
+		}
+	}
+
+	if reflect.DeepEqual(first, second) {
+		t.Errorf("expected different hsdirs for different time periods")
+	}
+
+	// The first replica starts at the first relay whose hsdir_index is at or after the hs_index
+	hsIndex := calculateHSIndexV3(blindedKey, 1, 17756, common.TimePeriodLengthV3)
+	var want descriptor.RouterStatusEntry
+	var wantIndex []byte
+	for _, hsDir := range hsdirFetcher.hsDirs {
+		index := calculateHSDirIndexV3(hsDir.Ed25519Identity, previousSRV[:], 17756,
+			common.TimePeriodLengthV3)
+		if bytes.Compare(index, hsIndex) >= 0 && (wantIndex == nil || bytes.Compare(index, wantIndex) < 0) {
+			want, wantIndex = hsDir, index
+		}
+	}
+
+	if wantIndex != nil && !reflect.DeepEqual(first[0][0], want) {
+		t.Errorf("expected %v got %v", want.Nickname, first[0][0].Nickname)
+	}
+}
+
+func TestCalculateResponsibleHSDirsV3Errors(t *testing.T) {
+	t.Parallel()
+
+	hsdirFetcher := NewHSDirFetcher(&MockController{
+		ReturnedConsensus: &descriptor.Consensus{RouterStatusEntries: routerStatusEntries},
+	},
+		common.NewNopLogger())
+	if err := hsdirFetcher.update(); err != nil {
+		t.Fatalf("failed to update hsdir fetcher: %v", err)
+	}
+
+	_, err := hsdirFetcher.CalculateResponsibleHSDirsV3(make(ed25519.PublicKey, ed25519.PublicKeySize), 17756, true)
+	if want := errors.New("no hsdirs with an ed25519 identity available"); !reflect.DeepEqual(err, want) {
+		t.Errorf("expected %v got %v", want, err)
+	}
+}
+
+func TestCalculateDisasterSRV(t *testing.T) {
+	t.Parallel()
+
+	got := calculateDisasterSRV(17756, common.TimePeriodLengthV3)
+	if len(got) != 32 || bytes.Equal(got, calculateDisasterSRV(17757, common.TimePeriodLengthV3)) {
+		t.Errorf("expected a 32 byte value that changes every time period got %x", got)
+	}
+}
+
+func TestHSDirFetcher_updateConsensusParams(t *testing.T) {
+	t.Parallel()
+
+	controller := &MockController{
+		ReturnedConsensus: &descriptor.Consensus{
+			SharedRandCurrentValue:  []byte("current"),
+			SharedRandPreviousValue: []byte("previous"),
+			Params: map[string]int{
+				"hsdir_n_replicas":   3,
+				"hsdir_spread_store": 5,
+			},
+			RouterStatusEntries: routerStatusEntries,
+		},
+	}
+
+	hsdirFetcher := NewHSDirFetcher(controller, common.NewNopLogger())
+	if err := hsdirFetcher.update(); err != nil {
+		t.Fatalf("failed to update hsdir fetcher: %v", err)
+	}
+
+	if string(hsdirFetcher.currentSRV) != "current" || string(hsdirFetcher.previousSRV) != "previous" {
+		t.Errorf("expected shared random values to be set got %s %s", hsdirFetcher.currentSRV,
+			hsdirFetcher.previousSRV)
+	}
+
+	if hsdirFetcher.nReplicas != 3 || hsdirFetcher.spreadStore != 5 {
+		t.Errorf("expected 3 replicas and spread 5 got %v %v", hsdirFetcher.nReplicas, hsdirFetcher.spreadStore)
+	}
+
+	if hsdirFetcher.PeriodLength() != common.TimePeriodLengthV3 {
+		t.Errorf("expected default period length got %v", hsdirFetcher.PeriodLength())
+	}
+}
+
+func TestHSDirFetcher_updateMicrodescriptors(t *testing.T) {
+	t.Parallel()
+
+	consensusRaw, err := ioutil.ReadFile("../testdata/consensus-microdesc.txt")
+	if err != nil {
+		t.Fatalf("failed to read consensus: %v", err)
+	}
+
+	consensus, err := descriptor.ParseConsensus(string(consensusRaw))
+	if err != nil {
+		t.Fatalf("failed to parse consensus: %v", err)
+	}
+
+	microdescriptorsRaw, err := ioutil.ReadFile("../testdata/microdescriptors.txt")
+	if err != nil {
+		t.Fatalf("failed to read microdescriptors: %v", err)
+	}
+
+	microdescriptors, err := descriptor.ParseMicrodescriptors(string(microdescriptorsRaw))
+	if err != nil {
+		t.Fatalf("failed to parse microdescriptors: %v", err)
+	}
+
+	controller := &MockController{
+		ReturnedConsensus:        consensus,
+		ReturnedMicrodescriptors: microdescriptors,
+	}
+
+	hsdirFetcher := NewHSDirFetcher(controller, common.NewNopLogger())
+	if err := hsdirFetcher.update(); err != nil {
+		t.Fatalf("failed to update hsdir fetcher: %v", err)
+	}
+
+	if len(hsdirFetcher.hsDirs) != 7 {
+		t.Fatalf("expected 7 hsdirs got %v", len(hsdirFetcher.hsDirs))
+	}
+
+	for _, hsDir := range hsdirFetcher.hsDirs {
+		if len(hsDir.Ed25519Identity) != ed25519.PublicKeySize {
+			t.Errorf("expected hsdir %v to have an ed25519 identity", hsDir.Nickname)
+		}
+	}
+
+	responsibleHSDirs, err := hsdirFetcher.CalculateResponsibleHSDirsV3(make(ed25519.PublicKey,
+		ed25519.PublicKeySize), 17756, true)
+	if err != nil {
+		t.Fatalf("failed to calculate responsible hsdirs: %v", err)
+	}
+
+	// 7 hsdirs are only enough for one full replica and 3 of the second
+	if len(responsibleHSDirs) != 2 || len(responsibleHSDirs[0]) != 4 || len(responsibleHSDirs[1]) != 3 {
+		t.Errorf("expected replicas of 4 and 3 hsdirs got %v", responsibleHSDirs)
+	}
+}
+
+func TestHSDirFetcher_SameFamily(t *testing.T) {
+	t.Parallel()
+
+	const (
+		relayA = "6D59170F544BDAB54710E9939D4B070C6AFEF759"
+		relayB = "62FA65A81CCA0B5152305A0368DFCE6A664F33B3"
+		relayC = "AB9A44D2EA9D2BB4D9E8D3A7E5F8A0D0C47A1C11"
+	)
+
+	controller := &MockController{
+		ReturnedConsensus: &descriptor.Consensus{
+			RouterStatusEntries: []descriptor.RouterStatusEntry{
+				{Fingerprint: relayA, MicrodescriptorDigest: "digest-a"},
+				{Fingerprint: relayB, MicrodescriptorDigest: "digest-b"},
+				{Fingerprint: relayC, MicrodescriptorDigest: "digest-c"},
+			},
+		},
+		ReturnedMicrodescriptors: []descriptor.Microdescriptor{
+			{Digest: "digest-a", Family: []string{"$" + relayB + "~relayB", "$" + relayC, "nickname"}},
+			{Digest: "digest-b", Family: []string{"$" + strings.ToLower(relayA)}},
+			{Digest: "digest-c", Family: []string{"$"}},
+		},
+	}
+
+	hsdirFetcher := NewHSDirFetcher(controller, common.NewNopLogger())
+	if err := hsdirFetcher.update(); err != nil {
+		t.Fatalf("failed to update hsdir fetcher: %v", err)
+	}
+
+	testCases := []struct {
+		name         string
+		fingerprintA string
+		fingerprintB string
+
+		expected bool
+	}{
+		{"mutual family", relayA, relayB, true},
+		{"mutual family lowercase", strings.ToLower(relayB), relayA, true},
+		{"one sided family", relayA, relayC, false},
+		{"unknown relay", relayA, "0000000000000000000000000000000000000000", false},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := hsdirFetcher.SameFamily(tt.fingerprintA, tt.fingerprintB); got != tt.expected {
+				t.Errorf("expected %v got %v", tt.expected, got)
+			}
+		})
+	}
+}
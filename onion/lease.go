@@ -0,0 +1,192 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Lease is held by at most one onionspread instance at a time, it is how the instances elect the one that publishes
+type Lease interface {
+	// Acquire takes the lease for holder or renews it for ttl, it returns false while another holder has it
+	Acquire(holder string, ttl time.Duration) (bool, error)
+	// Release gives the lease up if holder has it
+	Release(holder string) error
+}
+
+// leaseRecord is the holder of a lease and when it expires
+type leaseRecord struct {
+	Holder  string    `json:"Holder"`
+	Expires time.Time `json:"Expires"`
+}
+
+// FileLease is a lease kept in a file on a file system shared by the instances. The file is locked with flock while
+// it is read and written, so the file system has to support it, and the clocks of the instances have to be in sync.
+type FileLease struct {
+	path string
+}
+
+// Acquire takes the lease if it is free or expired and renews it if holder already has it
+func (l *FileLease) Acquire(holder string, ttl time.Duration) (bool, error) {
+	acquired := false
+	err := l.update(func(record *leaseRecord) bool {
+		now := time.Now()
+		if record.Holder != "" && record.Holder != holder && now.Before(record.Expires) {
+			return false
+		}
+
+		*record = leaseRecord{Holder: holder, Expires: now.Add(ttl)}
+		acquired = true
+
+		return true
+	})
+
+	return acquired, err
+}
+
+// Release clears the lease if holder has it
+func (l *FileLease) Release(holder string) error {
+	return l.update(func(record *leaseRecord) bool {
+		if record.Holder != holder {
+			return false
+		}
+
+		*record = leaseRecord{}
+
+		return true
+	})
+}
+
+// update calls f with the record of the lease while the file is locked, the record is written back if f returns true
+func (l *FileLease) update(f func(record *leaseRecord) bool) error {
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open lease file: %v", err)
+	}
+	defer file.Close()
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock lease file: %v", err)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("failed to read lease file: %v", err)
+	}
+
+	var record leaseRecord
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("invalid lease file: %v", err)
+		}
+	}
+
+	if !f(&record) {
+		return nil
+	}
+
+	if data, err = json.Marshal(record); err != nil {
+		return err
+	}
+
+	if err = file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write lease file: %v", err)
+	}
+
+	if _, err = file.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("failed to write lease file: %v", err)
+	}
+
+	return file.Sync()
+}
+
+// NewFileLease returns a lease kept in the file at path, the file is created when it doesn't exist
+func NewFileLease(path string) *FileLease {
+	return &FileLease{path: path}
+}
+
+// HTTPLease is a lease kept by an HTTP server. Acquire sends a PUT and Release a DELETE to the URL with the JSON body
+// {"Holder": holder, "TTL": seconds}, the server answers 200 when the lease is granted or released and 409 while
+// another holder has it.
+type HTTPLease struct {
+	url    string
+	client *http.Client
+}
+
+// leaseRequest is the body of the requests of an HTTPLease
+type leaseRequest struct {
+	Holder string  `json:"Holder"`
+	TTL    float64 `json:"TTL"`
+}
+
+// Acquire asks the server for the lease
+func (l *HTTPLease) Acquire(holder string, ttl time.Duration) (bool, error) {
+	status, err := l.send(http.MethodPut, leaseRequest{Holder: holder, TTL: ttl.Seconds()})
+	if err != nil {
+		return false, err
+	}
+
+	switch status {
+	case http.StatusOK, http.StatusNoContent:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("unexpected lease server response %d", status)
+}
+
+// Release tells the server to give the lease up, a conflict means that holder didn't have it
+func (l *HTTPLease) Release(holder string) error {
+	status, err := l.send(http.MethodDelete, leaseRequest{Holder: holder})
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case http.StatusOK, http.StatusNoContent, http.StatusConflict:
+		return nil
+	}
+
+	return fmt.Errorf("unexpected lease server response %d", status)
+}
+
+// send sends the request to the lease server and returns the status code of the response
+func (l *HTTPLease) send(method string, body leaseRequest) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(method, l.url, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach lease server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// the body is drained so the connection is reused for the next renewal
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
+
+// NewHTTPLease returns a lease kept by the server at url, requests that take longer than timeout fail
+func NewHTTPLease(url string, timeout time.Duration) *HTTPLease {
+	return &HTTPLease{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
@@ -0,0 +1,133 @@
+package onion
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLease(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lease := NewFileLease(filepath.Join(dir, "lease"))
+
+	steps := []struct {
+		name    string
+		holder  string
+		release bool
+		ttl     time.Duration
+
+		expected bool
+	}{
+		{"free lease", "a", false, time.Hour, true},
+		{"renewed", "a", false, time.Hour, true},
+		{"held by another holder", "b", false, time.Hour, false},
+		{"released by another holder", "b", true, 0, false},
+		{"still held", "b", false, time.Hour, false},
+		{"released", "a", true, 0, false},
+		{"taken over", "b", false, time.Nanosecond, true},
+		{"expired", "a", false, time.Hour, true},
+	}
+
+	// the steps build on each other so they aren't parallel
+	for _, step := range steps {
+		if step.release {
+			if err := lease.Release(step.holder); err != nil {
+				t.Errorf("%s: %v", step.name, err)
+			}
+			continue
+		}
+
+		time.Sleep(time.Millisecond)
+		acquired, err := lease.Acquire(step.holder, step.ttl)
+		if err != nil {
+			t.Errorf("%s: %v", step.name, err)
+		}
+
+		if acquired != step.expected {
+			t.Errorf("%s: expected acquired %v got %v", step.name, step.expected, acquired)
+		}
+	}
+}
+
+// leaseServer is an HTTP lease server keeping the lease in memory
+type leaseServer struct {
+	holder  string
+	expires time.Time
+	lock    sync.Mutex
+}
+
+func (s *leaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req leaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.holder != "" && s.holder != req.Holder && time.Now().Before(s.expires) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		s.holder = req.Holder
+		s.expires = time.Now().Add(time.Duration(req.TTL * float64(time.Second)))
+	case http.MethodDelete:
+		s.holder = ""
+	}
+}
+
+func TestHTTPLease(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(&leaseServer{})
+	defer server.Close()
+
+	leaseA := NewHTTPLease(server.URL, time.Second)
+	leaseB := NewHTTPLease(server.URL, time.Second)
+
+	if acquired, err := leaseA.Acquire("a", time.Hour); err != nil || !acquired {
+		t.Fatalf("expected a to acquire the lease, got %v %v", acquired, err)
+	}
+
+	if acquired, err := leaseB.Acquire("b", time.Hour); err != nil || acquired {
+		t.Fatalf("expected b not to acquire the lease, got %v %v", acquired, err)
+	}
+
+	if err := leaseB.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leaseA.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if acquired, err := leaseB.Acquire("b", time.Hour); err != nil || !acquired {
+		t.Fatalf("expected b to acquire the lease, got %v %v", acquired, err)
+	}
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	if _, err := NewHTTPLease(broken.URL, time.Second).Acquire("a", time.Hour); err == nil {
+		t.Error("expected an error from a failing lease server")
+	}
+}
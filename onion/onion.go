@@ -5,6 +5,7 @@ import (
 	"crypto/rsa"
 	"errors"
 	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -20,6 +21,54 @@ const (
 	descriptorOverlapPeriod     = 3600
 )
 
+// Balancer is a master onion service that balances a number of backend services
+type Balancer interface {
+	Start(time.Duration) error
+	Stop()
+	Degraded() bool
+}
+
+// OnionOptions holds the optional settings of a master onion service, the zero value leaves them all out. The
+// client authorization and the maximum descriptor age only apply to the services of their version.
+type OnionOptions struct {
+	ClientAuthV2 ClientAuthV2
+	ClientAuthV3 ClientAuthV3
+	// MaxDescriptorAge is how old a backend descriptor of a v2 service may be before the backend is left out
+	MaxDescriptorAge time.Duration
+	// HealthChecker leaves out the backends that are down
+	HealthChecker IHealthChecker
+	// Selector picks the introduction points of the descriptors, round robin if it is nil
+	Selector    descriptor.IntroductionPointSelector
+	RetryPolicy RetryPolicy
+	// Leadership lets only the leader of several instances publish, without it the service always publishes
+	Leadership Leadership
+}
+
+// ClientV2 is a client authorized to use a v2 hidden service
+type ClientV2 struct {
+	Name             string
+	DescriptorCookie []byte
+	// PublicKey and PrivateKey are the client specific service keys used with stealth authorization
+	PublicKey  *rsa.PublicKey
+	PrivateKey *rsa.PrivateKey
+}
+
+// ClientAuthV2 holds the client authorization of a v2 hidden service, a zero Type disables it
+type ClientAuthV2 struct {
+	Type    byte
+	Clients []ClientV2
+}
+
+// serviceIdentity is a key descriptors are published under. With stealth authorization every client has its own
+// key and descriptor cookie, and so its own descriptor IDs
+type serviceIdentity struct {
+	publicKey        *rsa.PublicKey
+	privateKey       *rsa.PrivateKey
+	permanentID      []byte
+	descriptorCookie string
+	clientAuth       *descriptor.ClientAuth
+}
+
 // Onion represents a hidden service that will balance a number of backend services
 type Onion struct {
 	controller      IController
@@ -29,11 +78,35 @@ type Onion struct {
 	permanentID     []byte
 	publicKey       *rsa.PublicKey
 	privateKey      *rsa.PrivateKey
+	identities      []serviceIdentity
 	publishInterval time.Duration
 	lastPublishTime int64
 	logger          *zap.SugaredLogger
 	time            common.ITimeProvider
 
+	// maxDescriptorAge is how old a backend descriptor may be before the backend is left out, zero disables it
+	maxDescriptorAge time.Duration
+	staleBackends    map[string]bool
+
+	// healthChecker is optional, backends it reports as unhealthy are left out
+	healthChecker IHealthChecker
+
+	// acceptedHSDirs are the fingerprints of the hsdirs that accepted the latest descriptors
+	acceptedHSDirs map[string]bool
+
+	// selector decides which backend introduction points are published
+	selector descriptor.IntroductionPointSelector
+
+	// retryPolicy decides how uploads the hsdirs didn't accept are retried
+	retryPolicy RetryPolicy
+
+	// degraded is set by Start while the control connection is down
+	degraded bool
+
+	// leadership decides whether descriptors are published or only the backend descriptors fetched, nil always
+	// publishes
+	leadership Leadership
+
 	once sync.Once
 	stop chan struct{}
 }
@@ -49,31 +122,24 @@ type backendOnions struct {
 // Start starts the onion service ticker
 func (o *Onion) Start(interval time.Duration) error {
 	o.logger.Infof("Onion %s: starting service", o.address)
-	ctx := context.Background()
-
-	ticker := time.NewTicker(interval) // change publish interval to intro fetch interval
-	for {
-		ctx, _ = context.WithTimeout(ctx, time.Second*45)
-		introPointsChanged, err := o.introductionPointsChanged(ctx)
-		if err != nil {
-			o.logger.Errorf("Onion %s: failed to check if introduction points have changed: %v", o.address, err)
-			// continue or just carry on?
-		}
+	runBalancer(o.address, o.controller, o.leadership, len(o.backendOnions.addresses), interval, o.stop,
+		&o.degraded, o.logger, o.introductionPointsChanged, o.publish)
 
-		if introPointsChanged || o.descriptorIDChangingSoon() || o.notPublishedDescriptorRecently() {
-			err = o.balance(ctx) // catch error and log? wait a little while and repeat
-			if err != nil {
-				o.logger.Errorf("Onion %s: failed to balance: %v", o.address, err)
-			}
-		}
+	return nil
+}
 
-		select {
-		case <-o.stop:
-			return nil
-		case <-ticker.C:
-			continue
-		}
+// publish balances the service if the introduction points changed or the descriptors are due
+func (o *Onion) publish(ctx context.Context, changed bool) error {
+	if !changed && !o.descriptorIDChangingSoon() && !o.notPublishedDescriptorRecently() {
+		return nil
 	}
+
+	return o.balance(ctx)
+}
+
+// Degraded returns true while the control connection is down and the service can't be balanced
+func (o *Onion) Degraded() bool {
+	return !o.controller.Connected()
 }
 
 // Stop stops the onion service ticker
@@ -99,22 +165,35 @@ func (o *Onion) balance(ctx context.Context) error {
 
 	o.backendOnions.newDescriptorsAvailable = false
 
+	// the leadership may have been lost while fetching
+	if !leading(o.leadership) {
+		o.logger.Infof("Onion %s: no longer the leader, not publishing", o.address)
+		return nil
+	}
+
 	// generate descriptors and publish them
+	var results []UploadResult
 	switch {
 	case o.backendOnions.totalNumberOfIntroductionPoints > maxIntroPoints:
 		// publish same descriptor to all responsible hsdirs
-		err = o.multiDescriptorGenerateAndPublish(o.backendOnions.descriptors)
+		results, err = o.multiDescriptorGenerateAndPublish(o.backendOnions.descriptors)
 	default:
 		// publish different descriptors to each of the responsible hsdirs
-		err = o.singleDescriptorGenerateAndPublish(o.backendOnions.descriptors)
+		results, err = o.singleDescriptorGenerateAndPublish(o.backendOnions.descriptors)
 	}
 	if err != nil {
 		o.logger.Errorf("Onion %s: %v", o.address, err)
 	}
 
+	o.acceptedHSDirs = recordUploads(o.address, results, o.logger)
+	if len(o.acceptedHSDirs) == 0 {
+		return errors.New("no hsdir accepted the descriptors")
+	}
+
 	o.lastPublishTime = o.time.Now().Unix()
 
-	o.logger.Infof("Onion %s: published descriptors successfully", o.address)
+	o.logger.Infof("Onion %s: published descriptors to %d of %d hsdirs", o.address, len(o.acceptedHSDirs),
+		len(results))
 	return nil
 }
 
@@ -126,11 +205,27 @@ func (o *Onion) fetchBackendDescriptors(ctx context.Context) ([]descriptor.Hidde
 	default:
 	}
 
+	var addresses []string
+	for _, address := range o.backendOnions.addresses {
+		if o.healthChecker != nil && !o.healthChecker.Healthy(address) {
+			o.logger.Debugf("Onion %s: leaving out unhealthy backend %s", o.address, address)
+			continue
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	descs := make([]*descriptor.HiddenServiceDescriptor, len(addresses))
+	errs := make([]error, len(addresses))
+	forEachConcurrently(len(addresses), func(i int) {
+		descs[i], errs[i] = o.controller.FetchHiddenServiceDescriptor(addresses[i], "", ctx)
+	})
+
 	var backendDescriptors []descriptor.HiddenServiceDescriptor
 	var totalNumOfIntroPoints = 0
 
-	for _, address := range o.backendOnions.addresses {
-		var desc, err = o.controller.FetchHiddenServiceDescriptor(address, "", ctx)
+	for i, address := range addresses {
+		desc, err := descs[i], errs[i]
 		if err != nil {
 			o.logger.Errorf("Onion %s: failed to fetch descriptor: %v", o.address, err)
 			continue
@@ -141,6 +236,15 @@ func (o *Onion) fetchBackendDescriptors(ctx context.Context) ([]descriptor.Hidde
 			continue
 		}
 
+		if err = desc.Verify(address, o.time.Now()); err != nil {
+			o.logger.Errorf("Onion %s: rejected descriptor of backend %s: %v", o.address, address, err)
+			continue
+		}
+
+		if o.descriptorStale(address, desc) {
+			continue
+		}
+
 		backendDescriptors = append(backendDescriptors, *desc)
 		totalNumOfIntroPoints += len(desc.IntroductionPoints)
 	}
@@ -153,79 +257,348 @@ func (o *Onion) fetchBackendDescriptors(ctx context.Context) ([]descriptor.Hidde
 	return backendDescriptors, totalNumOfIntroPoints, nil
 }
 
-// singleDescriptorGenerateAndPublish uses the same set of introduction points for all the responsible hsdirs
-func (o *Onion) singleDescriptorGenerateAndPublish(backendDescriptors []descriptor.HiddenServiceDescriptor) error {
-	o.logger.Debugf("Onion %s: publishing a single descriptor to all hsdirs", o.address)
-	var introductionPoints []descriptor.IntroductionPoint
-	for _, desc := range backendDescriptors {
-		introductionPoints = append(introductionPoints, desc.IntroductionPoints...)
+// refreshContext returns the context of fetching the descriptors of the backends, its deadline leaves every fetch
+// its own timeout however long it waits for the others
+func refreshContext(controller IController, backends int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), controller.FetchTimeout(backends))
+}
+
+// forEachConcurrently calls f for the indexes up to n at once and waits for them to return
+func forEachConcurrently(n int, f func(int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
 	}
 
-	now := o.time.Now()
-	var i byte
-	for i = 0; i < replicaSetSize; i++ {
-		balancedDescriptor, err := descriptor.GenerateDescriptorRaw(introductionPoints, now, i, 0,
-			"", o.publicKey, o.privateKey, nil, nil)
-		if err != nil {
-			return fmt.Errorf("failed to generate descriptor: %v", err)
+	wg.Wait()
+}
+
+// upload is a descriptor and the hsdirs it is posted to, without hsdirs tor picks the responsible ones
+type upload struct {
+	descriptor string
+	hsDirs     []string
+}
+
+// publishWithRetries posts the uploads concurrently and re-posts the descriptors to the hsdirs that didn't accept
+// them as the policy allows, until stop is closed or the leadership is lost. It returns the last result of every
+// hsdir. serviceAddress is only given for v3 descriptors.
+func publishWithRetries(controller IController, leadership Leadership, address, serviceAddress string,
+	uploads []upload, policy RetryPolicy, stop <-chan struct{}, logger *zap.SugaredLogger) []UploadResult {
+	var keys []uploadKey
+	results := make(map[uploadKey]UploadResult)
+
+	// indexes are the positions of the uploads in the original uploads, as the failed ones are retried
+	indexes := make([]int, len(uploads))
+	for i := range uploads {
+		indexes[i] = i
+	}
+
+	for attempt := 1; ; attempt++ {
+		// another instance publishes once this one lost the leadership
+		if !leading(leadership) {
+			logger.Infof("Onion %s: no longer the leader, not posting %d uploads", address, len(uploads))
+			break
 		}
 
-		err = o.controller.PostHiddenServiceDescriptor(string(balancedDescriptor), nil, "")
-		if err != nil {
-			return fmt.Errorf("failed to post descriptor: %v", err)
+		uploadResults := make([][]UploadResult, len(uploads))
+		errs := make([]error, len(uploads))
+		forEachConcurrently(len(uploads), func(i int) {
+			uploadResults[i], errs[i] = controller.PostHiddenServiceDescriptor(uploads[i].descriptor,
+				uploads[i].hsDirs, serviceAddress)
+		})
+
+		var failed []upload
+		var failedIndexes []int
+		for i, posted := range uploads {
+			if errs[i] != nil {
+				logger.Errorf("Onion %s: failed to post descriptor: %v", address, errs[i])
+				for _, hsDir := range posted.hsDirs {
+					uploadResults[i] = append(uploadResults[i], UploadResult{HSDir: hsDir, Reason: errs[i].Error()})
+				}
+
+				// without hsdirs nothing is known about which ones failed so the whole upload is retried
+				if len(posted.hsDirs) == 0 {
+					failed = append(failed, posted)
+					failedIndexes = append(failedIndexes, indexes[i])
+				}
+			}
+
+			var failedHSDirs []string
+			for _, result := range uploadResults[i] {
+				key := uploadKey{upload: indexes[i], hsDir: result.HSDir}
+				if _, ok := results[key]; !ok {
+					keys = append(keys, key)
+				}
+				results[key] = result
+
+				if !result.Uploaded {
+					failedHSDirs = append(failedHSDirs, result.HSDir)
+				}
+			}
+
+			if len(failedHSDirs) > 0 {
+				posted.hsDirs = failedHSDirs
+				failed = append(failed, posted)
+				failedIndexes = append(failedIndexes, indexes[i])
+			}
+		}
+
+		if len(failed) == 0 || attempt >= policy.MaxAttempts {
+			break
+		}
+
+		delay := policy.backoff(attempt, rand.Float64())
+		logger.Infof("Onion %s: retrying %d failed uploads in %v", address, len(failed), delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return orderedUploadResults(keys, results)
+		case <-timer.C:
 		}
+
+		uploads, indexes = failed, failedIndexes
 	}
 
-	return nil
+	return orderedUploadResults(keys, results)
 }
 
-// multiDescriptorGenerateAndPublish iterates the introduction points for each responsible hsdirs
-func (o *Onion) multiDescriptorGenerateAndPublish(backendDescriptors []descriptor.HiddenServiceDescriptor) error {
-	o.logger.Debugf("Onion %s: publishing multiple descriptors to all hsdirs", o.address)
+// uploadKey identifies the result of an upload to a hsdir, a hsdir can be given several descriptors
+type uploadKey struct {
+	upload int
+	hsDir  string
+}
+
+// orderedUploadResults returns the results of the uploads in the given order
+func orderedUploadResults(keys []uploadKey, results map[uploadKey]UploadResult) []UploadResult {
+	var ordered []UploadResult
+	for _, key := range keys {
+		ordered = append(ordered, results[key])
+	}
+
+	return ordered
+}
+
+// reportConnection logs when the control connection goes down and comes back, degraded is the state of the
+// previous check. It returns true if the connection is up.
+func reportConnection(controller IController, address string, degraded *bool, logger *zap.SugaredLogger) bool {
+	connected := controller.Connected()
+	switch {
+	case !connected && !*degraded:
+		logger.Warnf("Onion %s: degraded, the control connection is down", address)
+	case connected && *degraded:
+		logger.Infof("Onion %s: the control connection is back", address)
+	}
+
+	*degraded = !connected
+
+	return connected
+}
+
+// runBalancer checks whether the introduction points of the backends changed with refresh on every tick and, while
+// the instance is the leader, has publish balance the service until stop is closed. Nothing is done while the
+// control connection is down. publish is told the descriptors changed once the controller reconnected, as tor may
+// have restarted and lost them, and once the instance was elected, as the previous leader may have published
+// other descriptors or have gone away without publishing.
+func runBalancer(address string, controller IController, leadership Leadership, backends int,
+	interval time.Duration, stop <-chan struct{}, degraded *bool, logger *zap.SugaredLogger,
+	refresh func(context.Context) (bool, error), publish func(context.Context, bool) error) {
+	ticker := time.NewTicker(interval) // change publish interval to intro fetch interval
+	defer ticker.Stop()
+
+	reconnected := controller.Reconnected()
+	elected := whenElected(leadership)
+	republish := false
+	for {
+		// nothing can be fetched or published until the controller reconnected
+		if reportConnection(controller, address, degraded, logger) {
+			ctx, cancel := refreshContext(controller, backends)
+			changed, err := refresh(ctx)
+			cancel()
+			if err != nil {
+				logger.Errorf("Onion %s: failed to check if introduction points have changed: %v", address, err)
+			}
+
+			if !leading(leadership) {
+				logger.Debugf("Onion %s: standing by, not publishing", address)
+			} else {
+				// the backend descriptors are fetched again unless they just changed
+				ctx, cancel := refreshContext(controller, backends)
+				err = publish(ctx, changed || republish)
+				cancel()
+				if err != nil {
+					logger.Errorf("Onion %s: failed to balance: %v", address, err)
+				} else {
+					republish = false
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-reconnected:
+			reconnected = controller.Reconnected()
+			republish = true
+		case <-elected:
+			elected = leadership.Elected()
+			republish = true
+		}
+	}
+}
+
+// recordUploads logs the hsdirs that didn't accept a descriptor and returns the fingerprints of those that did
+func recordUploads(address string, results []UploadResult, logger *zap.SugaredLogger) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, result := range results {
+		if !result.Uploaded {
+			logger.Warnf("Onion %s: hsdir %s didn't accept the descriptor: %s", address, result.HSDir, result.Reason)
+			continue
+		}
+
+		accepted[result.HSDir] = true
+	}
+
+	return accepted
+}
+
+// descriptorStale returns true if the descriptor of the backend was published longer than maxDescriptorAge ago,
+// backends are logged when they become stale and when they publish a fresh descriptor again
+func (o *Onion) descriptorStale(address string, desc *descriptor.HiddenServiceDescriptor) bool {
+	if o.maxDescriptorAge <= 0 {
+		return false
+	}
+
+	age := o.time.Now().Sub(desc.Published)
+	if age > o.maxDescriptorAge {
+		if !o.staleBackends[address] {
+			o.logger.Warnf("Onion %s: dropping backend %s, its descriptor was published %v ago", o.address,
+				address, age)
+			o.staleBackends[address] = true
+		}
+
+		return true
+	}
+
+	if o.staleBackends[address] {
+		o.logger.Infof("Onion %s: backend %s published a fresh descriptor, balancing it again", o.address, address)
+		delete(o.staleBackends, address)
+	}
+
+	return false
+}
+
+// backendIntroductionPoints returns the introduction points of the backends the descriptors belong to
+func backendIntroductionPoints(
+	backendDescriptors []descriptor.HiddenServiceDescriptor) []descriptor.BackendIntroductionPoints {
+	var backends []descriptor.BackendIntroductionPoints
+	for _, desc := range backendDescriptors {
+		// descriptors are verified when fetched so the address is valid
+		address, _ := desc.Address()
+		backends = append(backends, descriptor.NewBackendIntroductionPoints(address, desc.IntroductionPoints))
+	}
+
+	return backends
+}
+
+// introductionPointsOf returns the introduction points of every backend descriptor, the selectors refer to them
+// by index
+func introductionPointsOf(backendDescriptors []descriptor.HiddenServiceDescriptor) [][]descriptor.IntroductionPoint {
 	var introductionPoints [][]descriptor.IntroductionPoint
 	for _, desc := range backendDescriptors {
 		introductionPoints = append(introductionPoints, desc.IntroductionPoints)
 	}
-	introductionPointItr := descriptor.NewIntroductionPointsIterator(introductionPoints)
 
-	// Calculate responsible hs dirs per replica then generate a new deecriptor then publish
+	return introductionPoints
+}
+
+// singleDescriptorGenerateAndPublish uses the same set of introduction points for all the responsible hsdirs and
+// returns the results of the uploads
+func (o *Onion) singleDescriptorGenerateAndPublish(backendDescriptors []descriptor.HiddenServiceDescriptor) (
+	[]UploadResult, error) {
+	o.logger.Debugf("Onion %s: publishing a single descriptor to all hsdirs", o.address)
+	introductionPoints := descriptor.IntroductionPointsAt(introductionPointsOf(backendDescriptors),
+		o.selector.Select(backendIntroductionPoints(backendDescriptors), maxIntroPoints))
+
+	var uploads []upload
 	now := o.time.Now()
-	var i byte
-	for i = 0; i < replicaSetSize; i++ {
-		descID, err := common.CalculateDescriptorID(o.permanentID, now.Unix(), i, 0, "")
-		if err != nil {
-			return fmt.Errorf("failed to calculate descriptor ID: %v", err)
-		}
+	for _, identity := range o.identities {
+		var i byte
+		for i = 0; i < replicaSetSize; i++ {
+			balancedDescriptor, err := descriptor.GenerateDescriptorRaw(introductionPoints, now, i, 0,
+				identity.descriptorCookie, identity.publicKey, identity.privateKey, identity.permanentID, nil,
+				identity.clientAuth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate descriptor: %v", err)
+			}
 
-		responsibleHSDirs, err := o.hsDirFetcher.CalculateResponsibleHSDirs(string(descID))
-		if err != nil {
-			return fmt.Errorf("failed to calculate responsible HSDirs: %v", err)
+			uploads = append(uploads, upload{descriptor: string(balancedDescriptor)})
 		}
+	}
+
+	return publishWithRetries(o.controller, o.leadership, o.address, "", uploads, o.retryPolicy, o.stop,
+		o.logger), nil
+}
 
-		// Publish a different descriptor to each responsible directory
-		for _, hsDir := range responsibleHSDirs {
-			balancedDescriptor, err := descriptor.GenerateDescriptorRaw(introductionPointItr.Next(), now, i,
-				0, "", o.publicKey, o.privateKey, o.permanentID, descID)
+// multiDescriptorGenerateAndPublish iterates the introduction points for each responsible hsdirs, the descriptors
+// are uploaded concurrently and the results of the uploads returned
+func (o *Onion) multiDescriptorGenerateAndPublish(backendDescriptors []descriptor.HiddenServiceDescriptor) (
+	[]UploadResult, error) {
+	o.logger.Debugf("Onion %s: publishing multiple descriptors to all hsdirs", o.address)
+	allIntroductionPoints := introductionPointsOf(backendDescriptors)
+	introductionPointItr := o.selector.Iterator(backendIntroductionPoints(backendDescriptors), maxIntroPoints)
+
+	// Calculate responsible hs dirs per replica then generate a new deecriptor for each of them
+	var uploads []upload
+	now := o.time.Now()
+	for _, identity := range o.identities {
+		var i byte
+		for i = 0; i < replicaSetSize; i++ {
+			descID, err := common.CalculateDescriptorID(identity.permanentID, now.Unix(), i, 0,
+				identity.descriptorCookie)
 			if err != nil {
-				return fmt.Errorf("failed to generate descriptor: %v", err)
+				return nil, fmt.Errorf("failed to calculate descriptor ID: %v", err)
 			}
 
-			err = o.controller.PostHiddenServiceDescriptor(string(balancedDescriptor), []string{hsDir.Fingerprint}, "")
+			responsibleHSDirs, err := o.hsDirFetcher.CalculateResponsibleHSDirs(string(descID))
 			if err != nil {
-				o.logger.Errorf("Onion %s: failed to post descriptor: %v", o.address, err)
+				return nil, fmt.Errorf("failed to calculate responsible HSDirs: %v", err)
+			}
+
+			for _, hsDir := range responsibleHSDirs {
+				introductionPoints := descriptor.IntroductionPointsAt(allIntroductionPoints, introductionPointItr.Next())
+				balancedDescriptor, err := descriptor.GenerateDescriptorRaw(introductionPoints, now, i, 0, identity.descriptorCookie, identity.publicKey, identity.privateKey, identity.permanentID,
+					descID, identity.clientAuth)
+				if err != nil {
+					return nil, fmt.Errorf("failed to generate descriptor: %v", err)
+				}
+
+				uploads = append(uploads, upload{
+					descriptor: string(balancedDescriptor),
+					hsDirs:     []string{hsDir.Fingerprint},
+				})
 			}
 		}
 	}
 
-	return nil
+	return publishWithRetries(o.controller, o.leadership, o.address, "", uploads, o.retryPolicy, o.stop,
+		o.logger), nil
 }
 
 func (o *Onion) descriptorIDChangingSoon() bool {
-	secondsValid := common.DescriptorIDValidUntil(o.permanentID, o.time.Now().Unix())
+	for _, identity := range o.identities {
+		secondsValid := common.DescriptorIDValidUntil(identity.permanentID, o.time.Now().Unix())
 
-	if secondsValid < descriptorOverlapPeriod {
-		o.logger.Debugf("Onion %s: descriptor ID changing soon", o.address)
-		return true
+		if secondsValid < descriptorOverlapPeriod {
+			o.logger.Debugf("Onion %s: descriptor ID changing soon", o.address)
+			return true
+		}
 	}
 
 	return false
@@ -258,6 +631,16 @@ func (o *Onion) introductionPointsChanged(ctx context.Context) (bool, error) {
 		return true, nil
 	}
 
+	// Backends that are left out or come back change the set of descriptors
+	if len(o.backendOnions.descriptors) != len(backendDescriptors) {
+		o.logger.Debugf("Onion %s: number of backend descriptors has changed, so storing new backend descriptors",
+			o.address)
+		o.backendOnions.descriptors = backendDescriptors
+		o.backendOnions.newDescriptorsAvailable = true
+		o.backendOnions.totalNumberOfIntroductionPoints = totalNumOfintoPoints
+		return true, nil
+	}
+
 	for i, descriptor := range backendDescriptors {
 		if o.backendOnions.descriptors[i].IntroductionPointsRaw != descriptor.IntroductionPointsRaw {
 			o.logger.Debugf("Onion %s: introduction points have changed, so storing new backend descriptors", o.address)
@@ -271,26 +654,92 @@ func (o *Onion) introductionPointsChanged(ctx context.Context) (bool, error) {
 	return false, nil
 }
 
+// newServiceIdentities returns the keys descriptors of the service are published under given its client
+// authorization
+func newServiceIdentities(publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey, permanentID []byte,
+	clientAuth ClientAuthV2) ([]serviceIdentity, error) {
+	switch clientAuth.Type {
+	case 0:
+		return []serviceIdentity{{publicKey: publicKey, privateKey: privateKey, permanentID: permanentID}}, nil
+	case descriptor.ClientAuthBasic:
+		var descriptorCookies [][]byte
+		for _, client := range clientAuth.Clients {
+			descriptorCookies = append(descriptorCookies, client.DescriptorCookie)
+		}
+
+		return []serviceIdentity{{
+			publicKey:   publicKey,
+			privateKey:  privateKey,
+			permanentID: permanentID,
+			clientAuth:  &descriptor.ClientAuth{Type: descriptor.ClientAuthBasic, DescriptorCookies: descriptorCookies},
+		}}, nil
+	case descriptor.ClientAuthStealth:
+		var identities []serviceIdentity
+		for _, client := range clientAuth.Clients {
+			if client.PublicKey == nil || client.PrivateKey == nil {
+				return nil, fmt.Errorf("client %s is missing its stealth key", client.Name)
+			}
+
+			clientPermanentID, err := common.CalculatePermanentID(*client.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to calculate permanent ID of client %s: %v", client.Name, err)
+			}
+
+			identities = append(identities, serviceIdentity{
+				publicKey:        client.PublicKey,
+				privateKey:       client.PrivateKey,
+				permanentID:      clientPermanentID,
+				descriptorCookie: string(client.DescriptorCookie),
+				clientAuth: &descriptor.ClientAuth{
+					Type:              descriptor.ClientAuthStealth,
+					DescriptorCookies: [][]byte{client.DescriptorCookie},
+				},
+			})
+		}
+
+		return identities, nil
+	}
+
+	return nil, fmt.Errorf("unknown client authorization type %d", clientAuth.Type)
+}
+
 // NewOnion constructs a new master hidden service that will balance a set of backend services
-func NewOnion(controller IController, backendAddresses []string, publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey, fetcher IHSDirFetcher, logger *zap.SugaredLogger, time common.ITimeProvider, publishInterval time.Duration) (*Onion, error) {
+func NewOnion(controller IController, backendAddresses []string, publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey, fetcher IHSDirFetcher, logger *zap.SugaredLogger, time common.ITimeProvider, publishInterval time.Duration, options OnionOptions) (*Onion, error) {
 	permanentID, err := common.CalculatePermanentID(*publicKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to calculate permanent ID: %v", err)
 	}
 
+	identities, err := newServiceIdentities(publicKey, privateKey, permanentID, options.ClientAuthV2)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := options.Selector
+	if selector == nil {
+		selector = &descriptor.RoundRobinSelector{}
+	}
+
 	return &Onion{
 		controller: controller,
 		address:    common.CalculateOnionAddress(permanentID),
 		backendOnions: backendOnions{
 			addresses: backendAddresses,
 		},
-		publicKey:       publicKey,
-		privateKey:      privateKey,
-		permanentID:     permanentID,
-		publishInterval: publishInterval,
-		stop:            make(chan struct{}),
-		hsDirFetcher:    fetcher,
-		logger:          logger,
-		time:            time,
+		publicKey:        publicKey,
+		privateKey:       privateKey,
+		permanentID:      permanentID,
+		identities:       identities,
+		publishInterval:  publishInterval,
+		maxDescriptorAge: options.MaxDescriptorAge,
+		staleBackends:    make(map[string]bool),
+		healthChecker:    options.HealthChecker,
+		selector:         selector,
+		retryPolicy:      options.RetryPolicy,
+		leadership:       options.Leadership,
+		stop:             make(chan struct{}),
+		hsDirFetcher:     fetcher,
+		logger:           logger,
+		time:             time,
 	}, nil
 }
@@ -2,12 +2,15 @@ package onion
 
 import (
 	"context"
+	"crypto"
 	"crypto/rsa"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -23,6 +26,8 @@ var (
 	backendDescriptor2     *descriptor.HiddenServiceDescriptor
 	backendDescriptorLong1 *descriptor.HiddenServiceDescriptor
 	backendDescriptorLong2 *descriptor.HiddenServiceDescriptor
+	badPrivateKey          *rsa.PrivateKey
+	badPrivateKeyErr       error
 )
 
 func TestMain(m *testing.M) {
@@ -44,6 +49,13 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	// A private key that fails to sign, the precomputed values are cleared so the bad exponent is used
+	pri := *privateKey
+	pri.E = 0
+	pri.Precomputed = rsa.PrecomputedValues{}
+	badPrivateKey = &pri
+	_, badPrivateKeyErr = badPrivateKey.Sign(nil, make([]byte, 20), crypto.Hash(0))
+
 	//Desc 1
 	backendDescriptorRaw, err := ioutil.ReadFile("../testdata/desc.txt")
 	if err != nil {
@@ -102,7 +114,7 @@ func TestDescriptorIDChangingSoon(t *testing.T) {
 	mockTime := &common.MockTimeProvider{}
 	mockTime.Set(time.Date(2015, time.June, 25, 24, 0, 3, 4, time.UTC))
 
-	var onion, err = NewOnion(nil, []string{}, publicKey, privateKey, nil, common.NewNopLogger(), mockTime, 0)
+	var onion, err = NewOnion(nil, []string{}, publicKey, privateKey, nil, common.NewNopLogger(), mockTime, 0, OnionOptions{})
 	if err != nil {
 		t.Fatal("failed to create new onion")
 	}
@@ -115,6 +127,9 @@ func TestDescriptorIDChangingSoon(t *testing.T) {
 func TestNotPublishedDescriptorRecently(t *testing.T) {
 	t.Parallel()
 
+	mockTime := &common.MockTimeProvider{}
+	mockTime.Set(time.Date(2019, time.January, 10, 1, 2, 3, 4, time.UTC))
+
 	testCases := []struct {
 		name            string
 		lastPublishTime int64
@@ -127,12 +142,12 @@ func TestNotPublishedDescriptorRecently(t *testing.T) {
 		},
 		{
 			"published recently",
-			time.Now().Unix() - 3600,
+			mockTime.Now().Unix() - 3600,
 			false,
 		},
 		{
 			"published long ago",
-			time.Now().Unix() - 4000,
+			mockTime.Now().Unix() - 4000,
 			true,
 		},
 	}
@@ -146,7 +161,7 @@ func TestNotPublishedDescriptorRecently(t *testing.T) {
 				lastPublishTime: tt.lastPublishTime,
 				publishInterval: 3600,
 				logger:          common.NewNopLogger(),
-				time:            common.NewTimeProvider(),
+				time:            mockTime,
 			}
 
 			if got := onion.notPublishedDescriptorRecently(); got != tt.want {
@@ -161,29 +176,12 @@ func TestOnion_introductionPointsChanged(t *testing.T) {
 
 	logger := common.NewNopLogger()
 
-	oldDescs := []descriptor.HiddenServiceDescriptor{
-		{
-			DescriptorID:          "oldDesc",
-			IntroductionPointsRaw: "oldIntros",
-			IntroductionPoints: []descriptor.IntroductionPoint{
-				{
-					Identifier: "testID",
-				},
-			},
-		},
-	}
+	// Both descriptors belong to 7ctbljpgkiayaita and are valid for the time period of mockTime
+	mockTime := &common.MockTimeProvider{}
+	mockTime.Set(backendDescriptorLong1.Published)
 
-	newDescs := []descriptor.HiddenServiceDescriptor{
-		{
-			DescriptorID:          "newDesc",
-			IntroductionPointsRaw: "newIntros",
-			IntroductionPoints: []descriptor.IntroductionPoint{
-				{
-					Identifier: "testID",
-				},
-			},
-		},
-	}
+	oldDescs := []descriptor.HiddenServiceDescriptor{*backendDescriptor2}
+	newDescs := []descriptor.HiddenServiceDescriptor{*backendDescriptorLong1}
 
 	testCases := []struct {
 		name  string
@@ -198,21 +196,22 @@ func TestOnion_introductionPointsChanged(t *testing.T) {
 			&Onion{
 				controller: &MockController{
 					FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{
-						"address": &newDescs[0],
+						"7ctbljpgkiayaita": &newDescs[0],
 					},
 				},
 				backendOnions: backendOnions{
-					addresses:   []string{"address"},
+					addresses:   []string{"7ctbljpgkiayaita"},
 					descriptors: oldDescs,
 				},
 				logger: logger,
+				time:   mockTime,
 			},
 			true,
 			nil,
 			backendOnions{
-				addresses:                       []string{"address"},
+				addresses:                       []string{"7ctbljpgkiayaita"},
 				descriptors:                     newDescs,
-				totalNumberOfIntroductionPoints: 1,
+				totalNumberOfIntroductionPoints: len(newDescs[0].IntroductionPoints),
 				newDescriptorsAvailable:         true,
 			},
 		},
@@ -221,41 +220,67 @@ func TestOnion_introductionPointsChanged(t *testing.T) {
 			&Onion{
 				controller: &MockController{
 					FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{
-						"address": &oldDescs[0],
+						"7ctbljpgkiayaita": &oldDescs[0],
 					},
 				},
 				backendOnions: backendOnions{
-					addresses:   []string{"address"},
+					addresses:   []string{"7ctbljpgkiayaita"},
 					descriptors: oldDescs,
 				},
 				logger: logger,
+				time:   mockTime,
 			},
 			false,
 			nil,
 			backendOnions{
-				addresses:   []string{"address"},
+				addresses:   []string{"7ctbljpgkiayaita"},
 				descriptors: oldDescs,
 			},
 		},
+		{
+			"Backend left out",
+			&Onion{
+				controller: &MockController{
+					FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{
+						"7ctbljpgkiayaita": &newDescs[0],
+					},
+				},
+				backendOnions: backendOnions{
+					addresses:   []string{"7ctbljpgkiayaita", "irthspr2nebf7x5i"},
+					descriptors: []descriptor.HiddenServiceDescriptor{newDescs[0], *backendDescriptorLong2},
+				},
+				logger: logger,
+				time:   mockTime,
+			},
+			true,
+			nil,
+			backendOnions{
+				addresses:                       []string{"7ctbljpgkiayaita", "irthspr2nebf7x5i"},
+				descriptors:                     newDescs,
+				totalNumberOfIntroductionPoints: len(newDescs[0].IntroductionPoints),
+				newDescriptorsAvailable:         true,
+			},
+		},
 		{
 			"No descriptors stored previously",
 			&Onion{
 				controller: &MockController{
 					FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{
-						"address": &newDescs[0],
+						"7ctbljpgkiayaita": &newDescs[0],
 					},
 				},
 				backendOnions: backendOnions{
-					addresses: []string{"address"},
+					addresses: []string{"7ctbljpgkiayaita"},
 				},
 				logger: logger,
+				time:   mockTime,
 			},
 			true,
 			nil,
 			backendOnions{
-				addresses:                       []string{"address"},
+				addresses:                       []string{"7ctbljpgkiayaita"},
 				descriptors:                     newDescs,
-				totalNumberOfIntroductionPoints: 1,
+				totalNumberOfIntroductionPoints: len(newDescs[0].IntroductionPoints),
 				newDescriptorsAvailable:         true,
 			},
 		},
@@ -266,14 +291,15 @@ func TestOnion_introductionPointsChanged(t *testing.T) {
 					ReturnedErr: errors.New("test error"),
 				},
 				logger: logger,
+				time:   mockTime,
 				backendOnions: backendOnions{
-					addresses: []string{"address"},
+					addresses: []string{"7ctbljpgkiayaita"},
 				},
 			},
 			false,
 			errors.New("failed to fetch any descriptors"),
 			backendOnions{
-				addresses: []string{"address"},
+				addresses: []string{"7ctbljpgkiayaita"},
 			},
 		},
 	}
@@ -304,6 +330,9 @@ func TestOnion_fetchBackendDescriptors(t *testing.T) {
 
 	logger := common.NewNopLogger()
 
+	mockTime := &common.MockTimeProvider{}
+	mockTime.Set(backendDescriptorLong1.Published)
+
 	testCases := []struct {
 		name       string
 		controller *MockController
@@ -316,60 +345,36 @@ func TestOnion_fetchBackendDescriptors(t *testing.T) {
 			"OK",
 			&MockController{
 				FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{
-					"backend-1": {
-						DescriptorID: "backend-1-desc-id",
-						IntroductionPoints: []descriptor.IntroductionPoint{
-							{
-								Identifier: "8e2uej23ie2",
-							},
-						},
-					},
-					"backend-2": {
-						DescriptorID: "backend-2-desc-id",
-						IntroductionPoints: []descriptor.IntroductionPoint{
-							{
-								Identifier: "2323e323e23",
-							},
-						},
-					},
-					"backend-3": {
-						DescriptorID: "backend-3-desc-id",
-						IntroductionPoints: []descriptor.IntroductionPoint{
-							{
-								Identifier: "982ujn99j92",
-							},
-						},
-					},
+					"7ctbljpgkiayaita": backendDescriptorLong1,
+					"irthspr2nebf7x5i": backendDescriptorLong2,
 				},
 			},
-			[]descriptor.HiddenServiceDescriptor{
-				{
-					DescriptorID: "backend-1-desc-id",
-					IntroductionPoints: []descriptor.IntroductionPoint{
-						{
-							Identifier: "8e2uej23ie2",
-						},
-					},
-				},
-				{
-					DescriptorID: "backend-2-desc-id",
-					IntroductionPoints: []descriptor.IntroductionPoint{
-						{
-							Identifier: "2323e323e23",
-						},
-					},
+			[]descriptor.HiddenServiceDescriptor{*backendDescriptorLong1, *backendDescriptorLong2},
+			nil,
+			len(backendDescriptorLong1.IntroductionPoints) + len(backendDescriptorLong2.IntroductionPoints),
+		},
+		{
+			"descriptor of another service rejected",
+			&MockController{
+				FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{
+					"7ctbljpgkiayaita": backendDescriptorLong1,
+					"irthspr2nebf7x5i": backendDescriptorLong1,
 				},
-				{
-					DescriptorID: "backend-3-desc-id",
-					IntroductionPoints: []descriptor.IntroductionPoint{
-						{
-							Identifier: "982ujn99j92",
-						},
-					},
+			},
+			[]descriptor.HiddenServiceDescriptor{*backendDescriptorLong1},
+			nil,
+			len(backendDescriptorLong1.IntroductionPoints),
+		},
+		{
+			"descriptor of another time period rejected",
+			&MockController{
+				FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{
+					"7ctbljpgkiayaita": backendDescriptor1,
 				},
 			},
 			nil,
-			3,
+			errors.New("failed to fetch any descriptors"),
+			0,
 		},
 		{
 			"fetch failures",
@@ -387,7 +392,7 @@ func TestOnion_fetchBackendDescriptors(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			onion, err := NewOnion(tt.controller, []string{"backend-1", "backend-2", "backend-3"}, publicKey, privateKey, nil, logger, common.NewTimeProvider(), 0)
+			onion, err := NewOnion(tt.controller, []string{"7ctbljpgkiayaita", "irthspr2nebf7x5i"}, publicKey, privateKey, nil, logger, mockTime, 0, OnionOptions{})
 			if err != nil {
 				t.Fatal("failed to create new onion")
 			}
@@ -408,6 +413,123 @@ func TestOnion_fetchBackendDescriptors(t *testing.T) {
 	}
 }
 
+func TestOnion_fetchBackendDescriptorsBlackholed(t *testing.T) {
+	t.Parallel()
+
+	const live = "7ctbljpgkiayaita"
+
+	// tor only answers the fetch of the live backend, the others wait for their fetch timeout while holding the
+	// only slot
+	content := strings.Replace(strings.TrimSuffix(backendDescriptorLong1.Raw, "\n"), "\n", "\r\n", -1)
+	controller, _ := newTorStandIn(t, 1, "HSFETCH "+live, 1, []string{
+		"650+HS_DESC_CONTENT " + live + " " + backendDescriptorLong1.DescriptorID +
+			" $1111111111111111111111111111111111111111\r\n" + content + "\r\n.\r\n650 OK\r\n",
+	})
+	defer controller.Close()
+	controller.fetchTimeout = 100 * time.Millisecond
+
+	mockTime := &common.MockTimeProvider{}
+	mockTime.Set(backendDescriptorLong1.Published)
+
+	backends := []string{live, "aaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbb", "cccccccccccccccc", "dddddddddddddddd"}
+	onion, err := NewOnion(controller, backends, publicKey, privateKey, nil, common.NewNopLogger(), mockTime, 0,
+		OnionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := refreshContext(controller, len(backends))
+	defer cancel()
+
+	descs, introsLen, err := onion.fetchBackendDescriptors(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(descs) != 1 || introsLen != len(backendDescriptorLong1.IntroductionPoints) {
+		t.Errorf("expected the descriptor of %s got %d descriptors with %d introduction points", live, len(descs),
+			introsLen)
+	}
+}
+
+func TestOnion_fetchBackendDescriptorsUnhealthy(t *testing.T) {
+	t.Parallel()
+
+	mockTime := &common.MockTimeProvider{}
+	mockTime.Set(backendDescriptorLong1.Published)
+
+	controller := &MockController{
+		FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{
+			"7ctbljpgkiayaita": backendDescriptorLong1,
+			"irthspr2nebf7x5i": backendDescriptorLong2,
+		},
+	}
+	healthChecker := &MockHealthChecker{unhealthy: map[string]bool{"7ctbljpgkiayaita": true}}
+
+	onion, err := NewOnion(controller, []string{"7ctbljpgkiayaita", "irthspr2nebf7x5i"}, publicKey, privateKey,
+		nil, common.NewNopLogger(), mockTime, 0, OnionOptions{HealthChecker: healthChecker})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descs, _, err := onion.fetchBackendDescriptors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(descs, []descriptor.HiddenServiceDescriptor{*backendDescriptorLong2}) {
+		t.Errorf("expected only the healthy backend descriptor got %d descriptors", len(descs))
+	}
+}
+
+func TestOnion_fetchBackendDescriptorsStale(t *testing.T) {
+	t.Parallel()
+
+	mockTime := &common.MockTimeProvider{}
+	controller := &MockController{
+		FetchedDescriptors: map[string]*descriptor.HiddenServiceDescriptor{
+			"7ctbljpgkiayaita": backendDescriptor2,
+			"irthspr2nebf7x5i": backendDescriptorLong2,
+		},
+	}
+
+	onion, err := NewOnion(controller, []string{"7ctbljpgkiayaita", "irthspr2nebf7x5i"}, publicKey, privateKey,
+		nil, common.NewNopLogger(), mockTime, 0, OnionOptions{MaxDescriptorAge: 2 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// backendDescriptor2 was published 3 hours before backendDescriptorLong2
+	mockTime.Set(backendDescriptorLong2.Published.Add(30 * time.Minute))
+	descs, _, err := onion.fetchBackendDescriptors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(descs, []descriptor.HiddenServiceDescriptor{*backendDescriptorLong2}) {
+		t.Errorf("expected only the fresh descriptor got %d descriptors", len(descs))
+	}
+
+	if !onion.staleBackends["7ctbljpgkiayaita"] {
+		t.Error("expected 7ctbljpgkiayaita to be stale")
+	}
+
+	// The backend publishes a fresh descriptor
+	controller.FetchedDescriptors["7ctbljpgkiayaita"] = backendDescriptorLong1
+	descs, _, err = onion.fetchBackendDescriptors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(descs, []descriptor.HiddenServiceDescriptor{*backendDescriptorLong1, *backendDescriptorLong2}) {
+		t.Errorf("expected both descriptors got %d descriptors", len(descs))
+	}
+
+	if onion.staleBackends["7ctbljpgkiayaita"] {
+		t.Error("expected 7ctbljpgkiayaita to no longer be stale")
+	}
+}
+
 // Add tests with more backend descriptors
 func TestOnion_singleDescriptorGenerateAndPublish(t *testing.T) {
 	t.Parallel()
@@ -514,12 +636,8 @@ func TestOnion_singleDescriptorGenerateAndPublish(t *testing.T) {
 			"failure generating descriptor",
 			&MockController{},
 			[]descriptor.HiddenServiceDescriptor{*backendDescriptor1, *backendDescriptor2},
-			func() *rsa.PrivateKey {
-				pri := *privateKey
-				pri.E = 0
-				return &pri
-			}(),
-			errors.New("failed to generate descriptor: failed to sign descriptor: rsa: internal error"),
+			badPrivateKey,
+			fmt.Errorf("failed to generate descriptor: failed to sign descriptor: %v", badPrivateKeyErr),
 			"",
 		},
 		{
@@ -529,7 +647,7 @@ func TestOnion_singleDescriptorGenerateAndPublish(t *testing.T) {
 			},
 			[]descriptor.HiddenServiceDescriptor{*backendDescriptor1, *backendDescriptor2},
 			privateKey,
-			errors.New("failed to post descriptor: test error"),
+			nil,
 			"",
 		},
 	}
@@ -539,12 +657,12 @@ func TestOnion_singleDescriptorGenerateAndPublish(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			onion, err := NewOnion(tt.controller, []string{}, publicKey, tt.privateKey, nil, logger, common.NewTimeProvider(), 0)
+			onion, err := NewOnion(tt.controller, []string{}, publicKey, tt.privateKey, nil, logger, common.NewTimeProvider(), 0, OnionOptions{})
 			if err != nil {
 				t.Fatal("failed to create new onion")
 			}
 
-			err = onion.singleDescriptorGenerateAndPublish(tt.backendDescriptors)
+			_, err = onion.singleDescriptorGenerateAndPublish(tt.backendDescriptors)
 			if !reflect.DeepEqual(err, tt.expectedErr) {
 				t.Errorf("expected %v got %v", tt.expectedErr, err)
 			}
@@ -1412,12 +1530,8 @@ func TestOnion_multiDescriptorGenerateAndPublish(t *testing.T) {
 			&MockController{},
 			hsdirFetcher,
 			[]descriptor.HiddenServiceDescriptor{*backendDescriptorLong1, *backendDescriptorLong2},
-			func() *rsa.PrivateKey {
-				pri := *privateKey
-				pri.E = 0
-				return &pri
-			}(),
-			errors.New("failed to generate descriptor: failed to sign descriptor: rsa: internal error"),
+			badPrivateKey,
+			fmt.Errorf("failed to generate descriptor: failed to sign descriptor: %v", badPrivateKeyErr),
 			nil,
 		},
 		{
@@ -1449,12 +1563,12 @@ func TestOnion_multiDescriptorGenerateAndPublish(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			onion, err := NewOnion(tt.controller, []string{}, publicKey, tt.privateKey, tt.hsdirFetcher, logger, mockTime, 0)
+			onion, err := NewOnion(tt.controller, []string{}, publicKey, tt.privateKey, tt.hsdirFetcher, logger, mockTime, 0, OnionOptions{})
 			if err != nil {
 				t.Fatal("failed to create new onion")
 			}
 
-			err = onion.multiDescriptorGenerateAndPublish(tt.backendDescriptors)
+			_, err = onion.multiDescriptorGenerateAndPublish(tt.backendDescriptors)
 			if !reflect.DeepEqual(err, tt.expectedErr) {
 				t.Fatalf("expected %v got %v", tt.expectedErr, err)
 			}
@@ -1478,6 +1592,432 @@ func TestOnion_multiDescriptorGenerateAndPublish(t *testing.T) {
 	}
 }
 
+func TestOnion_weightedGenerateAndPublish(t *testing.T) {
+	t.Parallel()
+
+	mockTime := &common.MockTimeProvider{}
+	mockTime.Set(time.Date(2019, time.January, 10, 1, 2, 3, 4, time.UTC))
+
+	backendDescriptors := []descriptor.HiddenServiceDescriptor{*backendDescriptorLong1, *backendDescriptorLong2}
+	long1Identifiers := make(map[string]bool)
+	for _, introductionPoint := range backendDescriptorLong1.IntroductionPoints {
+		long1Identifiers[introductionPoint.Identifier] = true
+	}
+
+	// countIntroductionPoints returns the number of introduction points of long1 and long2 in the descriptors
+	countIntroductionPoints := func(t *testing.T, descriptors ...string) (int, int) {
+		var long1, long2 int
+		for _, desc := range descriptors {
+			parsedDescriptor, err := descriptor.ParseHiddenServiceDescriptor(desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, introductionPoint := range parsedDescriptor.IntroductionPoints {
+				if long1Identifiers[introductionPoint.Identifier] {
+					long1++
+				} else {
+					long2++
+				}
+			}
+		}
+
+		return long1, long2
+	}
+
+	t.Run("single descriptor", func(t *testing.T) {
+		t.Parallel()
+
+		controller := &MockController{}
+		onion, err := NewOnion(controller, []string{}, publicKey, privateKey, nil, common.NewNopLogger(), mockTime, 0,
+			OnionOptions{Selector: descriptor.NewWeightedSelector(map[string]int{"irthspr2nebf7x5i": 4})})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = onion.singleDescriptorGenerateAndPublish(backendDescriptors); err != nil {
+			t.Fatal(err)
+		}
+
+		if long1, long2 := countIntroductionPoints(t, controller.PostedDescriptor); long1 != 2 || long2 != 8 {
+			t.Errorf("expected 2 and 8 introduction points got %d and %d", long1, long2)
+		}
+	})
+
+	t.Run("multiple descriptors", func(t *testing.T) {
+		t.Parallel()
+
+		controller := &MockController{}
+		hsdirFetcher := &MockHSDirFetcher{returnResponsibleHSdirsMap: map[string][]descriptor.RouterStatusEntry{}}
+		onion, err := NewOnion(controller, []string{}, publicKey, privateKey, hsdirFetcher, common.NewNopLogger(),
+			mockTime, 0, OnionOptions{
+				Selector: descriptor.NewWeightedSelector(map[string]int{"7ctbljpgkiayaita": 1, "irthspr2nebf7x5i": 3}),
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var replica byte
+		for replica = 0; replica < replicaSetSize; replica++ {
+			descID, err := common.CalculateDescriptorID(onion.permanentID, mockTime.Now().Unix(), replica, 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < numberOfConsecutiveReplicas; i++ {
+				hsdirFetcher.returnResponsibleHSdirsMap[string(descID)] = append(
+					hsdirFetcher.returnResponsibleHSdirsMap[string(descID)],
+					descriptor.RouterStatusEntry{Fingerprint: fmt.Sprintf("hsdir%d-%d", replica, i)})
+			}
+		}
+
+		if _, err = onion.multiDescriptorGenerateAndPublish(backendDescriptors); err != nil {
+			t.Fatal(err)
+		}
+
+		var posted []string
+		for _, desc := range controller.PostedDescriptors {
+			posted = append(posted, desc)
+		}
+
+		if len(posted) != replicaSetSize*numberOfConsecutiveReplicas {
+			t.Fatalf("expected %d descriptors got %d", replicaSetSize*numberOfConsecutiveReplicas, len(posted))
+		}
+
+		if long1, long2 := countIntroductionPoints(t, posted...); long1 != 15 || long2 != 45 {
+			t.Errorf("expected 15 and 45 introduction points got %d and %d", long1, long2)
+		}
+	})
+}
+
+func TestOnion_balanceUploadResults(t *testing.T) {
+	t.Parallel()
+
+	mockTime := &common.MockTimeProvider{}
+	mockTime.Set(time.Date(2019, time.January, 10, 1, 2, 3, 4, time.UTC))
+
+	testCases := []struct {
+		name            string
+		rejectingHSDirs map[string]bool
+
+		expectedAcceptedHSDirs map[string]bool
+		expectedErr            error
+	}{
+		{
+			"all accepted",
+			nil,
+			map[string]bool{"hsdir0-0": true, "hsdir0-1": true, "hsdir1-0": true, "hsdir1-1": true},
+			nil,
+		},
+		{
+			"some rejected",
+			map[string]bool{"hsdir0-1": true, "hsdir1-0": true},
+			map[string]bool{"hsdir0-0": true, "hsdir1-1": true},
+			nil,
+		},
+		{
+			"all rejected",
+			map[string]bool{"hsdir0-0": true, "hsdir0-1": true, "hsdir1-0": true, "hsdir1-1": true},
+			map[string]bool{},
+			errors.New("no hsdir accepted the descriptors"),
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			controller := &MockController{RejectingHSDirs: tt.rejectingHSDirs}
+			hsdirFetcher := &MockHSDirFetcher{returnResponsibleHSdirsMap: map[string][]descriptor.RouterStatusEntry{}}
+			onion, err := NewOnion(controller, []string{}, publicKey, privateKey, hsdirFetcher, common.NewNopLogger(),
+				mockTime, 0, OnionOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var replica byte
+			for replica = 0; replica < replicaSetSize; replica++ {
+				descID, err := common.CalculateDescriptorID(onion.permanentID, mockTime.Now().Unix(), replica, 0, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for i := 0; i < 2; i++ {
+					hsdirFetcher.returnResponsibleHSdirsMap[string(descID)] = append(
+						hsdirFetcher.returnResponsibleHSdirsMap[string(descID)],
+						descriptor.RouterStatusEntry{Fingerprint: fmt.Sprintf("hsdir%d-%d", replica, i)})
+				}
+			}
+
+			// more introduction points than fit in a descriptor so every hsdir is posted to
+			onion.backendOnions.descriptors = []descriptor.HiddenServiceDescriptor{
+				*backendDescriptorLong1, *backendDescriptorLong2,
+			}
+			onion.backendOnions.totalNumberOfIntroductionPoints = 16
+			onion.backendOnions.newDescriptorsAvailable = true
+
+			if err = onion.balance(context.Background()); !reflect.DeepEqual(err, tt.expectedErr) {
+				t.Errorf("expected %v got %v", tt.expectedErr, err)
+			}
+
+			if !reflect.DeepEqual(onion.acceptedHSDirs, tt.expectedAcceptedHSDirs) {
+				t.Errorf("expected %v got %v", tt.expectedAcceptedHSDirs, onion.acceptedHSDirs)
+			}
+
+			if published := onion.lastPublishTime != 0; published != (tt.expectedErr == nil) {
+				t.Errorf("expected published %v got %v", tt.expectedErr == nil, published)
+			}
+		})
+	}
+}
+
+// expiringLeadership is a Leadership that is lost after the given number of checks
+type expiringLeadership struct {
+	checks int
+	lock   sync.Mutex
+}
+
+func (l *expiringLeadership) Leader() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.checks == 0 {
+		return false
+	}
+
+	l.checks--
+	return true
+}
+
+func (l *expiringLeadership) Elected() <-chan struct{} {
+	return nil
+}
+
+func TestPublishWithRetries(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	uploads := []upload{
+		{descriptor: "descriptor-a", hsDirs: []string{"hsdir-a"}},
+		{descriptor: "descriptor-b", hsDirs: []string{"hsdir-b"}},
+		{descriptor: "descriptor-c", hsDirs: []string{"hsdir-c"}},
+	}
+
+	testCases := []struct {
+		name       string
+		controller *MockController
+		uploads    []upload
+		policy     RetryPolicy
+		stopped    bool
+		leadership Leadership
+
+		expectedResults []UploadResult
+		expectedUploads map[string]int
+	}{
+		{
+			"failed hsdirs retried",
+			&MockController{Rejections: map[string]int{"hsdir-a": 1, "hsdir-b": 5}},
+			uploads,
+			policy,
+			false,
+			nil,
+			[]UploadResult{
+				{HSDir: "hsdir-a", Uploaded: true},
+				{HSDir: "hsdir-b", Reason: "UPLOAD_REJECTED"},
+				{HSDir: "hsdir-c", Uploaded: true},
+			},
+			map[string]int{"hsdir-a": 2, "hsdir-b": 3, "hsdir-c": 1},
+		},
+		{
+			"retries disabled",
+			&MockController{Rejections: map[string]int{"hsdir-a": 1}},
+			uploads,
+			RetryPolicy{},
+			false,
+			nil,
+			[]UploadResult{
+				{HSDir: "hsdir-a", Reason: "UPLOAD_REJECTED"},
+				{HSDir: "hsdir-b", Uploaded: true},
+				{HSDir: "hsdir-c", Uploaded: true},
+			},
+			map[string]int{"hsdir-a": 1, "hsdir-b": 1, "hsdir-c": 1},
+		},
+		{
+			"stopped",
+			&MockController{Rejections: map[string]int{"hsdir-a": 1}},
+			uploads,
+			policy,
+			true,
+			nil,
+			[]UploadResult{
+				{HSDir: "hsdir-a", Reason: "UPLOAD_REJECTED"},
+				{HSDir: "hsdir-b", Uploaded: true},
+				{HSDir: "hsdir-c", Uploaded: true},
+			},
+			map[string]int{"hsdir-a": 1, "hsdir-b": 1, "hsdir-c": 1},
+		},
+		{
+			"hsdir given several descriptors",
+			&MockController{Rejections: map[string]int{"hsdir-a": 1}},
+			[]upload{
+				{descriptor: "descriptor-a", hsDirs: []string{"hsdir-a"}},
+				{descriptor: "descriptor-b", hsDirs: []string{"hsdir-a"}},
+			},
+			policy,
+			false,
+			nil,
+			[]UploadResult{
+				{HSDir: "hsdir-a", Uploaded: true},
+				{HSDir: "hsdir-a", Uploaded: true},
+			},
+			map[string]int{"hsdir-a": 3},
+		},
+		{
+			"hsdirs picked by tor",
+			&MockController{
+				ReturnedUploadResults: []UploadResult{
+					{HSDir: "hsdir-a", Reason: "UPLOAD_REJECTED"},
+					{HSDir: "hsdir-b", Uploaded: true},
+				},
+			},
+			[]upload{{descriptor: "descriptor"}},
+			policy,
+			false,
+			nil,
+			[]UploadResult{
+				{HSDir: "hsdir-a", Uploaded: true},
+				{HSDir: "hsdir-b", Uploaded: true},
+			},
+			map[string]int{"hsdir-a": 1},
+		},
+		{
+			"not the leader",
+			&MockController{},
+			uploads,
+			policy,
+			false,
+			&expiringLeadership{},
+			nil,
+			nil,
+		},
+		{
+			"leadership lost while retrying",
+			&MockController{Rejections: map[string]int{"hsdir-a": 1}},
+			uploads,
+			policy,
+			false,
+			&expiringLeadership{checks: 1},
+			[]UploadResult{
+				{HSDir: "hsdir-a", Reason: "UPLOAD_REJECTED"},
+				{HSDir: "hsdir-b", Uploaded: true},
+				{HSDir: "hsdir-c", Uploaded: true},
+			},
+			map[string]int{"hsdir-a": 1, "hsdir-b": 1, "hsdir-c": 1},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			stop := make(chan struct{})
+			if tt.stopped {
+				close(stop)
+			}
+
+			results := publishWithRetries(tt.controller, tt.leadership, "test", "", tt.uploads, tt.policy, stop,
+				common.NewNopLogger())
+			if !reflect.DeepEqual(results, tt.expectedResults) {
+				t.Errorf("expected %v got %v", tt.expectedResults, results)
+			}
+
+			if !reflect.DeepEqual(tt.controller.Uploads, tt.expectedUploads) {
+				t.Errorf("expected uploads %v got %v", tt.expectedUploads, tt.controller.Uploads)
+			}
+		})
+	}
+}
+
+func TestRunBalancer(t *testing.T) {
+	t.Parallel()
+
+	controller := &MockController{ReconnectedCh: make(chan struct{})}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// the first publish after the controller reconnected fails
+	published := make(chan bool)
+	republishes := 0
+	refresh := func(context.Context) (bool, error) {
+		return false, nil
+	}
+	publish := func(ctx context.Context, changed bool) error {
+		select {
+		case published <- changed:
+		case <-stop:
+		}
+
+		if changed {
+			republishes++
+			if republishes == 1 {
+				return errors.New("test error")
+			}
+		}
+
+		return nil
+	}
+
+	go runBalancer("test", controller, nil, 1, 10*time.Millisecond, stop, new(bool), common.NewNopLogger(),
+		refresh, publish)
+
+	if <-published {
+		t.Fatal("expected the first publish not to be told the descriptors changed")
+	}
+
+	go func() {
+		controller.ReconnectedCh <- struct{}{}
+	}()
+
+	// ticks may come before the reconnect
+	for !<-published {
+	}
+
+	if !<-published {
+		t.Error("expected the descriptors to be published again after the failed publish")
+	}
+
+	if <-published {
+		t.Error("expected the descriptors not to be published again after a successful publish")
+	}
+}
+
+func TestReportConnection(t *testing.T) {
+	t.Parallel()
+
+	controller := &MockController{}
+	degraded := false
+	balancers := []Balancer{&Onion{controller: controller}, &OnionV3{controller: controller}}
+
+	for i, disconnected := range []bool{false, true, true, false} {
+		controller.Disconnected = disconnected
+		if connected := reportConnection(controller, "test", &degraded, common.NewNopLogger()); connected == disconnected {
+			t.Errorf("%d: expected connected %v got %v", i, !disconnected, connected)
+		}
+
+		if degraded != disconnected {
+			t.Errorf("%d: expected degraded %v got %v", i, disconnected, degraded)
+		}
+
+		for _, balancer := range balancers {
+			if balancer.Degraded() != disconnected {
+				t.Errorf("%d: expected %T to be degraded %v", i, balancer, disconnected)
+			}
+		}
+	}
+}
+
 //func TestOnion_GetResponsibleHSDirs(t *testing.T) {
 //	var conn, err = textproto.Dial("tcp", "localhost:9054")
 //	if err != nil {
@@ -1510,3 +2050,119 @@ func TestOnion_multiDescriptorGenerateAndPublish(t *testing.T) {
 //	conn.Close()
 //}
 //
+
+func TestOnion_multiDescriptorGenerateAndPublishStealth(t *testing.T) {
+	t.Parallel()
+
+	clientPublicKey, clientPrivateKey, err := common.LoadKeysFromFile("../testdata/private_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPermanentID, err := common.CalculatePermanentID(*clientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descriptorCookie, err := common.ParseDescriptorCookie("Ri1eSPMJ4Bj8EvRkDyZ9aB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockTime := &common.MockTimeProvider{}
+	mockTime.Set(time.Date(2019, time.January, 10, 1, 2, 3, 4, time.UTC))
+
+	// Descriptor IDs of the client are derived from its own key and descriptor cookie
+	hsdirFetcher := &MockHSDirFetcher{returnResponsibleHSdirsMap: map[string][]descriptor.RouterStatusEntry{}}
+	expectedDescriptorIDs := map[string]string{}
+	var replica byte
+	for replica = 0; replica < replicaSetSize; replica++ {
+		descID, err := common.CalculateDescriptorID(clientPermanentID, mockTime.Now().Unix(), replica, 0,
+			string(descriptorCookie))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fingerprint := fmt.Sprintf("hsdir%d-fingerprint", replica)
+		hsdirFetcher.returnResponsibleHSdirsMap[string(descID)] = []descriptor.RouterStatusEntry{
+			{Fingerprint: fingerprint},
+		}
+		expectedDescriptorIDs[fingerprint] = strings.ToLower(string(descID))
+	}
+
+	clientAuth := ClientAuthV2{
+		Type: descriptor.ClientAuthStealth,
+		Clients: []ClientV2{
+			{
+				Name:             "alice",
+				DescriptorCookie: descriptorCookie,
+				PublicKey:        clientPublicKey,
+				PrivateKey:       clientPrivateKey,
+			},
+		},
+	}
+
+	controller := &MockController{}
+	onion, err := NewOnion(controller, []string{}, publicKey, privateKey, hsdirFetcher, common.NewNopLogger(),
+		mockTime, 0, OnionOptions{ClientAuthV2: clientAuth})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = onion.multiDescriptorGenerateAndPublish(
+		[]descriptor.HiddenServiceDescriptor{*backendDescriptorLong1, *backendDescriptorLong2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(controller.PostedDescriptors) != len(expectedDescriptorIDs) {
+		t.Fatalf("expected %d posted descriptors got %d", len(expectedDescriptorIDs), len(controller.PostedDescriptors))
+	}
+
+	for fingerprint, descriptorID := range expectedDescriptorIDs {
+		desc, err := descriptor.ParseHiddenServiceDescriptor(controller.PostedDescriptors[fingerprint])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if desc.DescriptorID != descriptorID {
+			t.Errorf("expected descriptor ID %s got %s", descriptorID, desc.DescriptorID)
+		}
+
+		if err := desc.DecryptIntroductionPoints(descriptorCookie); err != nil {
+			t.Fatalf("failed to decrypt introduction points: %v", err)
+		}
+
+		if len(desc.IntroductionPoints) != maxIntroPoints {
+			t.Errorf("expected %d introduction points got %d", maxIntroPoints, len(desc.IntroductionPoints))
+		}
+	}
+}
+
+func TestNewServiceIdentities(t *testing.T) {
+	t.Parallel()
+
+	permanentID, err := common.CalculatePermanentID(*publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := [][]byte{make([]byte, 16), make([]byte, 16)}
+	clients := []ClientV2{{Name: "alice", DescriptorCookie: cookies[0]}, {Name: "bob", DescriptorCookie: cookies[1]}}
+
+	identities, err := newServiceIdentities(publicKey, privateKey, permanentID,
+		ClientAuthV2{Type: descriptor.ClientAuthBasic, Clients: clients})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(identities) != 1 || identities[0].descriptorCookie != "" ||
+		!reflect.DeepEqual(identities[0].clientAuth.DescriptorCookies, cookies) {
+		t.Errorf("expected one identity encrypted for both clients got %#v", identities)
+	}
+
+	if _, err := newServiceIdentities(publicKey, privateKey, permanentID,
+		ClientAuthV2{Type: descriptor.ClientAuthStealth, Clients: clients}); err == nil {
+		t.Error("expected stealth clients without keys to fail")
+	}
+}
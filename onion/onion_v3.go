@@ -0,0 +1,400 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+	"github.com/csucu/onionspread/descriptor"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	maxIntroPointsV3 = 20
+)
+
+// ClientAuthV3 holds the client authorization keys of a v3 service
+type ClientAuthV3 struct {
+	// AuthorizedClients are the x25519 public keys of the clients the master descriptor is encrypted for, if empty
+	// anyone knowing the address can use the service
+	AuthorizedClients [][]byte
+	// BackendKeys maps backend onion addresses, without the ".onion" suffix, to the x25519 private key used to
+	// decrypt their descriptors
+	BackendKeys map[string][]byte
+}
+
+// OnionV3 represents a v3 onion service that will balance a number of v3 backend services
+type OnionV3 struct {
+	controller         IController
+	hsDirFetcher       IHSDirFetcher
+	scheduler          *TimePeriodScheduler
+	address            string
+	backendOnions      backendOnionsV3
+	publicKey          ed25519.PublicKey
+	expandedPrivateKey []byte
+	clientAuth         ClientAuthV3
+	publishInterval    time.Duration
+	lastPublishTime    int64
+	lastPublishPeriods []DescriptorPeriodV3
+	logger             *zap.SugaredLogger
+	time               common.ITimeProvider
+
+	// healthChecker is optional, backends it reports as unhealthy are left out
+	healthChecker IHealthChecker
+
+	// acceptedHSDirs are the fingerprints of the hsdirs that accepted the latest descriptors
+	acceptedHSDirs map[string]bool
+
+	// selector decides which backend introduction points are published
+	selector descriptor.IntroductionPointSelector
+
+	// retryPolicy decides how uploads the hsdirs didn't accept are retried
+	retryPolicy RetryPolicy
+
+	// degraded is set by Start while the control connection is down
+	degraded bool
+
+	// leadership decides whether descriptors are published or only the backend descriptors fetched, nil always
+	// publishes
+	leadership Leadership
+
+	once sync.Once
+	stop chan struct{}
+}
+
+// backendOnionsV3 represents the v3 backend onion services that will be used for balancing
+type backendOnionsV3 struct {
+	addresses []string
+	// fetchedAddresses are the addresses of the backends introductionPoints belong to
+	fetchedAddresses                []string
+	introductionPoints              [][]descriptor.IntroductionPointV3
+	totalNumberOfIntroductionPoints int
+	newDescriptorsAvailable         bool
+}
+
+// Start starts the onion service ticker
+func (o *OnionV3) Start(interval time.Duration) error {
+	o.logger.Infof("Onion %s: starting service", o.address)
+	runBalancer(o.address, o.controller, o.leadership, len(o.backendOnions.addresses), interval, o.stop,
+		&o.degraded, o.logger, o.introductionPointsChanged, o.publish)
+
+	return nil
+}
+
+// publish balances the service if the introduction points or the time periods changed or the descriptors are due
+func (o *OnionV3) publish(ctx context.Context, changed bool) error {
+	if !changed && !o.timePeriodsChanged() && !o.notPublishedDescriptorRecently() {
+		return nil
+	}
+
+	return o.balance(ctx)
+}
+
+// Degraded returns true while the control connection is down and the service can't be balanced
+func (o *OnionV3) Degraded() bool {
+	return !o.controller.Connected()
+}
+
+// Stop stops the onion service ticker
+func (o *OnionV3) Stop() {
+	o.once.Do(func() {
+		close(o.stop)
+		o.logger.Infof("Onion %s: stopping service", o.address)
+	})
+}
+
+func (o *OnionV3) balance(ctx context.Context) error {
+	o.logger.Debugf("Onion %s: balancing", o.address)
+
+	var err error
+	if !o.backendOnions.newDescriptorsAvailable {
+		o.logger.Debugf("Onion %s: no new descriptors available", o.address)
+		o.backendOnions.fetchedAddresses, o.backendOnions.introductionPoints,
+			o.backendOnions.totalNumberOfIntroductionPoints, err = o.fetchBackendDescriptors(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	o.backendOnions.newDescriptorsAvailable = false
+
+	var results []UploadResult
+	periods := o.scheduler.Periods()
+	for _, period := range periods {
+		// the leadership may have been lost while fetching or publishing the previous period
+		if !leading(o.leadership) {
+			o.logger.Infof("Onion %s: no longer the leader, not publishing", o.address)
+			return nil
+		}
+
+		periodResults, err := o.generateAndPublish(period)
+		if err != nil {
+			o.logger.Errorf("Onion %s: time period %d: %v", o.address, period.TimePeriod, err)
+		}
+
+		results = append(results, periodResults...)
+	}
+
+	o.acceptedHSDirs = recordUploads(o.address, results, o.logger)
+	if len(o.acceptedHSDirs) == 0 {
+		return errors.New("no hsdir accepted the descriptors")
+	}
+
+	o.lastPublishPeriods = periods
+	o.lastPublishTime = o.time.Now().Unix()
+
+	o.logger.Infof("Onion %s: published descriptors to %d of %d hsdirs", o.address, len(o.acceptedHSDirs),
+		len(results))
+	return nil
+}
+
+// fetchBackendDescriptors fetches and decrypts the descriptors of the backend services, returning the addresses
+// of the backends whose descriptors were fetched and their introduction points
+func (o *OnionV3) fetchBackendDescriptors(ctx context.Context) ([]string, [][]descriptor.IntroductionPointV3, int,
+	error) {
+	o.logger.Debugf("Onion %s: fetching backend descriptors", o.address)
+	select {
+	case <-ctx.Done():
+		return nil, nil, 0, fmt.Errorf("failed to fetch backend descriptors: %v", ctx.Err())
+	default:
+	}
+
+	var addresses []string
+	var identityKeys []ed25519.PublicKey
+	for _, address := range o.backendOnions.addresses {
+		if o.healthChecker != nil && !o.healthChecker.Healthy(address) {
+			o.logger.Debugf("Onion %s: leaving out unhealthy backend %s", o.address, address)
+			continue
+		}
+
+		identityKey, err := common.ParseOnionAddressV3(address)
+		if err != nil {
+			o.logger.Errorf("Onion %s: invalid backend address %s: %v", o.address, address, err)
+			continue
+		}
+
+		addresses = append(addresses, strings.TrimSuffix(strings.ToLower(address), ".onion"))
+		identityKeys = append(identityKeys, identityKey)
+	}
+
+	descs := make([]*descriptor.HiddenServiceDescriptorV3, len(addresses))
+	errs := make([]error, len(addresses))
+	forEachConcurrently(len(addresses), func(i int) {
+		descs[i], errs[i] = o.controller.FetchHiddenServiceDescriptorV3(addresses[i], "", ctx)
+	})
+
+	var fetchedAddresses []string
+	var backendIntroductionPoints [][]descriptor.IntroductionPointV3
+	var totalNumOfIntroPoints = 0
+
+	for i, address := range addresses {
+		identityKey, desc, err := identityKeys[i], descs[i], errs[i]
+		if err != nil {
+			o.logger.Errorf("Onion %s: failed to fetch descriptor: %v", o.address, err)
+			continue
+		}
+
+		if desc == nil {
+			o.logger.Errorf("Onion %s: fetch returned empty descriptor", o.address)
+			continue
+		}
+
+		if err = desc.Verify(identityKey, o.time.Now(), o.scheduler.PeriodLength()); err != nil {
+			o.logger.Errorf("Onion %s: rejected descriptor of backend %s: %v", o.address, address, err)
+			continue
+		}
+
+		introductionPoints, err := desc.IntroductionPoints(identityKey, o.clientAuth.BackendKeys[address])
+		if err != nil {
+			o.logger.Errorf("Onion %s: failed to decrypt descriptor of %s: %v", o.address, address, err)
+			continue
+		}
+
+		fetchedAddresses = append(fetchedAddresses, address)
+		backendIntroductionPoints = append(backendIntroductionPoints, introductionPoints)
+		totalNumOfIntroPoints += len(introductionPoints)
+	}
+
+	if totalNumOfIntroPoints == 0 {
+		o.logger.Errorf("Onion %s: failed to fetch any descriptors", o.address)
+		return nil, nil, 0, errors.New("failed to fetch any descriptors")
+	}
+
+	return fetchedAddresses, backendIntroductionPoints, totalNumOfIntroPoints, nil
+}
+
+// backendIntroductionPoints returns the introduction points of the backends for the selector
+func (o *OnionV3) backendIntroductionPoints() []descriptor.BackendIntroductionPoints {
+	var backends []descriptor.BackendIntroductionPoints
+	for i, introductionPoints := range o.backendOnions.introductionPoints {
+		backends = append(backends, descriptor.NewBackendIntroductionPointsV3(o.backendOnions.fetchedAddresses[i],
+			introductionPoints))
+	}
+
+	return backends
+}
+
+// generateAndPublish publishes descriptors for period to its responsible hsdirs and returns the results of the
+// uploads. If all the introduction points fit in one descriptor it is published to every hsdir, otherwise each
+// hsdir is given a different set
+func (o *OnionV3) generateAndPublish(period DescriptorPeriodV3) ([]UploadResult, error) {
+	periodLength := o.scheduler.PeriodLength()
+	blindedKey, err := common.BlindEd25519PublicKey(o.publicKey, period.TimePeriod, periodLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to blind public key: %v", err)
+	}
+
+	revisionCounter, err := o.scheduler.NextRevisionCounter(o.address, period.TimePeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	responsibleHSDirs, err := o.hsDirFetcher.CalculateResponsibleHSDirsV3(blindedKey, period.TimePeriod, period.First)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate responsible HSDirs: %v", err)
+	}
+
+	var hsDirs []string
+	for _, replica := range responsibleHSDirs {
+		for _, hsDir := range replica {
+			hsDirs = append(hsDirs, hsDir.Fingerprint)
+		}
+	}
+
+	if len(hsDirs) == 0 {
+		return nil, errors.New("no responsible HSDirs")
+	}
+
+	now := o.time.Now()
+	if o.backendOnions.totalNumberOfIntroductionPoints <= maxIntroPointsV3 {
+		o.logger.Debugf("Onion %s: publishing a single descriptor to all hsdirs", o.address)
+		introductionPoints := descriptor.IntroductionPointsV3At(o.backendOnions.introductionPoints,
+			o.selector.Select(o.backendIntroductionPoints(), maxIntroPointsV3))
+
+		balancedDescriptor, err := descriptor.GenerateDescriptorRawV3(introductionPoints, now, period.TimePeriod,
+			periodLength, revisionCounter, o.publicKey, o.expandedPrivateKey, o.clientAuth.AuthorizedClients)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate descriptor: %v", err)
+		}
+
+		return publishWithRetries(o.controller, o.leadership, o.address, o.address,
+			[]upload{{descriptor: string(balancedDescriptor), hsDirs: hsDirs}}, o.retryPolicy, o.stop, o.logger), nil
+	}
+
+	o.logger.Debugf("Onion %s: publishing multiple descriptors to all hsdirs", o.address)
+	introductionPointItr := o.selector.Iterator(o.backendIntroductionPoints(), maxIntroPointsV3)
+	var uploads []upload
+	for _, hsDir := range hsDirs {
+		introductionPoints := descriptor.IntroductionPointsV3At(o.backendOnions.introductionPoints,
+			introductionPointItr.Next())
+		balancedDescriptor, err := descriptor.GenerateDescriptorRawV3(introductionPoints, now,
+			period.TimePeriod, periodLength, revisionCounter, o.publicKey, o.expandedPrivateKey, o.clientAuth.AuthorizedClients)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate descriptor: %v", err)
+		}
+
+		uploads = append(uploads, upload{descriptor: string(balancedDescriptor), hsDirs: []string{hsDir}})
+	}
+
+	return publishWithRetries(o.controller, o.leadership, o.address, o.address, uploads, o.retryPolicy, o.stop,
+		o.logger), nil
+}
+
+// timePeriodsChanged returns true if descriptors have to be published for different time periods than last time
+func (o *OnionV3) timePeriodsChanged() bool {
+	if !reflect.DeepEqual(o.scheduler.Periods(), o.lastPublishPeriods) {
+		o.logger.Debugf("Onion %s: time periods changed", o.address)
+		return true
+	}
+
+	return false
+}
+
+func (o *OnionV3) notPublishedDescriptorRecently() bool {
+	if o.lastPublishTime == 0 {
+		return true
+	}
+
+	if o.time.Now().Unix()-o.lastPublishTime > int64(o.publishInterval/time.Second) {
+		o.logger.Debugf("Onion %s: not published any descriptor in awhile", o.address)
+		return true
+	}
+
+	return false
+}
+
+func (o *OnionV3) introductionPointsChanged(ctx context.Context) (bool, error) {
+	fetchedAddresses, backendIntroductionPoints, totalNumOfIntroPoints, err := o.fetchBackendDescriptors(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if introductionPointsKeyV3(backendIntroductionPoints) == introductionPointsKeyV3(o.backendOnions.introductionPoints) {
+		return false, nil
+	}
+
+	o.logger.Debugf("Onion %s: introduction points have changed, so storing new backend descriptors", o.address)
+	o.backendOnions.fetchedAddresses = fetchedAddresses
+	o.backendOnions.introductionPoints = backendIntroductionPoints
+	o.backendOnions.newDescriptorsAvailable = true
+	o.backendOnions.totalNumberOfIntroductionPoints = totalNumOfIntroPoints
+	return true, nil
+}
+
+// introductionPointsKeyV3 identifies a set of introduction points by their auth keys, which are unique per
+// introduction point. The descriptor text can't be compared as every publish is encrypted differently
+func introductionPointsKeyV3(backendIntroductionPoints [][]descriptor.IntroductionPointV3) string {
+	var key []string
+	for _, introductionPoints := range backendIntroductionPoints {
+		for _, introductionPoint := range introductionPoints {
+			if introductionPoint.AuthKeyCert != nil {
+				key = append(key, string(introductionPoint.AuthKeyCert.CertifiedKey))
+			}
+		}
+		key = append(key, "")
+	}
+
+	return strings.Join(key, "\n")
+}
+
+// NewOnionV3 constructs a new master v3 onion service that will balance a set of backend services.
+// expandedPrivateKey is the 64 byte expanded ed25519 identity key of the service
+func NewOnionV3(controller IController, backendAddresses []string, publicKey ed25519.PublicKey,
+	expandedPrivateKey []byte, fetcher IHSDirFetcher, scheduler *TimePeriodScheduler, logger *zap.SugaredLogger,
+	time common.ITimeProvider, publishInterval time.Duration, options OnionOptions) (*OnionV3, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key length")
+	}
+
+	selector := options.Selector
+	if selector == nil {
+		selector = &descriptor.RoundRobinSelector{}
+	}
+
+	return &OnionV3{
+		controller: controller,
+		address:    common.CalculateOnionAddressV3(publicKey),
+		backendOnions: backendOnionsV3{
+			addresses: backendAddresses,
+		},
+		publicKey:          publicKey,
+		expandedPrivateKey: expandedPrivateKey,
+		clientAuth:         options.ClientAuthV3,
+		publishInterval:    publishInterval,
+		stop:               make(chan struct{}),
+		hsDirFetcher:       fetcher,
+		scheduler:          scheduler,
+		logger:             logger,
+		time:               time,
+		healthChecker:      options.HealthChecker,
+		selector:           selector,
+		retryPolicy:        options.RetryPolicy,
+		leadership:         options.Leadership,
+	}, nil
+}
@@ -0,0 +1,283 @@
+package onion
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+	"github.com/csucu/onionspread/descriptor"
+	"golang.org/x/crypto/ed25519"
+)
+
+const testBackendAddressV3 = "xnbyhg3trrk2ti5y6pufov64vv2qqczmkczza4mnrobbuiyjbyu3tgid"
+
+func loadBackendDescriptorV3(t *testing.T) *descriptor.HiddenServiceDescriptorV3 {
+	descriptorRaw, err := ioutil.ReadFile("../testdata/desc-v3.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := descriptor.ParseHiddenServiceDescriptorV3(string(descriptorRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return desc
+}
+
+func newTestOnionV3(t *testing.T, controller IController, fetcher IHSDirFetcher) (*OnionV3, ed25519.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockTime := &common.MockTimeProvider{}
+	mockTime.Set(time.Date(2018, time.August, 14, 9, 30, 0, 0, time.UTC))
+
+	scheduler, err := NewTimePeriodScheduler("", FixedPeriodLength(common.TimePeriodLengthV3), mockTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onion, err := NewOnionV3(controller, []string{testBackendAddressV3}, publicKey,
+		common.ExpandEd25519PrivateKey(privateKey), fetcher, scheduler, common.NewNopLogger(), mockTime, time.Hour,
+		OnionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return onion, publicKey
+}
+
+func TestOnionV3_fetchBackendDescriptors(t *testing.T) {
+	t.Parallel()
+
+	backendDescriptor := loadBackendDescriptorV3(t)
+
+	tamperedDescriptor, err := descriptor.ParseHiddenServiceDescriptorV3(strings.Replace(backendDescriptor.Raw,
+		"descriptor-lifetime 180", "descriptor-lifetime 181", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		controller *MockController
+
+		expectedIntrosLen int
+		expectedErr       error
+	}{
+		{
+			"OK",
+			&MockController{
+				FetchedDescriptorsV3: map[string]*descriptor.HiddenServiceDescriptorV3{
+					testBackendAddressV3: backendDescriptor,
+				},
+			},
+			3,
+			nil,
+		},
+		{
+			"tampered descriptor rejected",
+			&MockController{
+				FetchedDescriptorsV3: map[string]*descriptor.HiddenServiceDescriptorV3{
+					testBackendAddressV3: tamperedDescriptor,
+				},
+			},
+			0,
+			errors.New("failed to fetch any descriptors"),
+		},
+		{
+			"fetch failures",
+			&MockController{
+				ReturnedErr: errors.New("test error"),
+			},
+			0,
+			errors.New("failed to fetch any descriptors"),
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			onion, _ := newTestOnionV3(t, tt.controller, nil)
+
+			addresses, introductionPoints, total, err := onion.fetchBackendDescriptors(context.Background())
+			if !reflect.DeepEqual(err, tt.expectedErr) {
+				t.Errorf("expected %v got %v", tt.expectedErr, err)
+			}
+
+			if total != tt.expectedIntrosLen {
+				t.Errorf("expected %d introduction points got %d", tt.expectedIntrosLen, total)
+			}
+
+			if tt.expectedErr == nil && len(introductionPoints) != 1 {
+				t.Errorf("expected introduction points of 1 backend got %d", len(introductionPoints))
+			}
+
+			if tt.expectedErr == nil && !reflect.DeepEqual(addresses, []string{testBackendAddressV3}) {
+				t.Errorf("expected addresses %v got %v", []string{testBackendAddressV3}, addresses)
+			}
+		})
+	}
+}
+
+func TestOnionV3_balance(t *testing.T) {
+	t.Parallel()
+
+	backendDescriptor := loadBackendDescriptorV3(t)
+	backendIntroductionPoints, err := backendDescriptor.IntroductionPoints(testBackendIdentityKeyV3(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manyIntroductionPoints [][]descriptor.IntroductionPointV3
+	for i := 0; i < 8; i++ {
+		manyIntroductionPoints = append(manyIntroductionPoints, backendIntroductionPoints)
+	}
+
+	addresses := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	hsDirs := [][]descriptor.RouterStatusEntry{
+		{{Fingerprint: "hsdir-1"}, {Fingerprint: "hsdir-2"}},
+		{{Fingerprint: "hsdir-3"}},
+	}
+
+	testCases := []struct {
+		name               string
+		introductionPoints [][]descriptor.IntroductionPointV3
+		selector           descriptor.IntroductionPointSelector
+
+		expectedIntrosLen int
+	}{
+		{
+			"single descriptor",
+			[][]descriptor.IntroductionPointV3{backendIntroductionPoints},
+			nil,
+			3,
+		},
+		{
+			"multiple descriptors",
+			manyIntroductionPoints,
+			nil,
+			maxIntroPointsV3,
+		},
+		{
+			"single descriptor - weighted",
+			manyIntroductionPoints[:2],
+			descriptor.NewWeightedSelector(map[string]int{"a": 2}),
+			5,
+		},
+		{
+			"multiple descriptors - max per backend",
+			manyIntroductionPoints,
+			descriptor.NewMaxPerBackendSelector(1),
+			8,
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			controller := &MockController{}
+			onion, publicKey := newTestOnionV3(t, controller, &MockHSDirFetcher{returnResponsibleHSDirsV3: hsDirs})
+			if tt.selector != nil {
+				onion.selector = tt.selector
+			}
+
+			total := 0
+			for _, introductionPoints := range tt.introductionPoints {
+				total += len(introductionPoints)
+			}
+			onion.backendOnions.fetchedAddresses = addresses[:len(tt.introductionPoints)]
+			onion.backendOnions.introductionPoints = tt.introductionPoints
+			onion.backendOnions.totalNumberOfIntroductionPoints = total
+			onion.backendOnions.newDescriptorsAvailable = true
+
+			if err := onion.balance(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(controller.PostedDescriptors) != 3 {
+				t.Fatalf("expected descriptors posted to 3 hsdirs got %d", len(controller.PostedDescriptors))
+			}
+
+			for hsDir, posted := range controller.PostedDescriptors {
+				if controller.PostedAddresses[hsDir] != onion.address {
+					t.Errorf("expected address %s got %s", onion.address, controller.PostedAddresses[hsDir])
+				}
+
+				desc, err := descriptor.ParseHiddenServiceDescriptorV3(posted)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				introductionPoints, err := desc.IntroductionPoints(publicKey, nil)
+				if err != nil {
+					t.Fatalf("failed to decrypt descriptor posted to %s: %v", hsDir, err)
+				}
+
+				if len(introductionPoints) != tt.expectedIntrosLen {
+					t.Errorf("expected %d introduction points got %d", tt.expectedIntrosLen, len(introductionPoints))
+				}
+			}
+
+			if !reflect.DeepEqual(onion.lastPublishPeriods, onion.scheduler.Periods()) {
+				t.Errorf("expected periods %v got %v", onion.scheduler.Periods(), onion.lastPublishPeriods)
+			}
+
+			if onion.timePeriodsChanged() {
+				t.Error("expected time periods to be unchanged after publishing")
+			}
+		})
+	}
+}
+
+func TestOnionV3_introductionPointsChanged(t *testing.T) {
+	t.Parallel()
+
+	controller := &MockController{
+		FetchedDescriptorsV3: map[string]*descriptor.HiddenServiceDescriptorV3{
+			testBackendAddressV3: loadBackendDescriptorV3(t),
+		},
+	}
+	onion, _ := newTestOnionV3(t, controller, nil)
+
+	changed, err := onion.introductionPointsChanged(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !changed || !onion.backendOnions.newDescriptorsAvailable {
+		t.Error("expected introduction points to have changed on first fetch")
+	}
+
+	onion.backendOnions.newDescriptorsAvailable = false
+	changed, err = onion.introductionPointsChanged(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed || onion.backendOnions.newDescriptorsAvailable {
+		t.Error("expected introduction points to be unchanged")
+	}
+}
+
+func testBackendIdentityKeyV3(t *testing.T) ed25519.PublicKey {
+	identityKey, err := common.ParseOnionAddressV3(testBackendAddressV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return identityKey
+}
@@ -0,0 +1,39 @@
+package onion
+
+import "time"
+
+// RetryPolicy decides how the uploads of descriptors to hsdirs that didn't accept them are retried
+type RetryPolicy struct {
+	// MaxAttempts is how often a descriptor is uploaded to an hsdir at most, less than 2 disables retries
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, it doubles with every retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the fraction by which the delays are randomly shortened or lengthened, between 0 and 1
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the retry policy used when a service doesn't configure one
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 30 * time.Second,
+		MaxBackoff:     5 * time.Minute,
+		Jitter:         0.2,
+	}
+}
+
+// backoff returns the delay before the given retry, starting at 1. random is a number in [0, 1) that picks the
+// jitter.
+func (p RetryPolicy) backoff(retry int, random float64) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	return time.Duration(float64(delay) * (1 - p.Jitter + 2*p.Jitter*random))
+}
@@ -0,0 +1,43 @@
+package onion
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 10 * time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.5,
+	}
+
+	testCases := []struct {
+		name   string
+		retry  int
+		random float64
+
+		expected time.Duration
+	}{
+		{"first retry", 1, 0.5, 10 * time.Second},
+		{"second retry", 2, 0.5, 20 * time.Second},
+		{"third retry", 3, 0.5, 40 * time.Second},
+		{"capped", 4, 0.5, time.Minute},
+		{"shortest jitter", 2, 0, 10 * time.Second},
+		{"longest jitter", 2, 1, 30 * time.Second},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := policy.backoff(tt.retry, tt.random); got != tt.expected {
+				t.Errorf("expected %v got %v", tt.expected, got)
+			}
+		})
+	}
+}
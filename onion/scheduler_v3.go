@@ -0,0 +1,178 @@
+package onion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+)
+
+// DescriptorPeriodV3 is a time period a v3 descriptor is published for. The first descriptor of the overlap is
+// placed on the hash ring with the previous shared random value and the second with the current one
+type DescriptorPeriodV3 struct {
+	TimePeriod int64
+	First      bool
+}
+
+// PeriodLengthSource returns the length of a v3 time period in minutes, the HSDirFetcher takes it from the
+// consensus so descriptors are blinded for the same periods they are placed on the hash ring for
+type PeriodLengthSource interface {
+	PeriodLength() int64
+}
+
+// FixedPeriodLength is a PeriodLengthSource that always returns the same length
+type FixedPeriodLength int64
+
+// PeriodLength returns the length
+func (l FixedPeriodLength) PeriodLength() int64 {
+	return int64(l)
+}
+
+// TimePeriodScheduler decides which v3 time periods descriptors are published for and hands out revision
+// counters that are strictly increasing per service and time period. Counters are persisted to a state file, if
+// one is set, so they keep increasing across restarts. It is safe for concurrent use.
+type TimePeriodScheduler struct {
+	periodLength PeriodLengthSource
+	statePath    string
+	time         common.ITimeProvider
+
+	// revisionCounters maps an onion address to the last revision counter used for each time period
+	revisionCounters map[string]map[string]uint64
+	mux              sync.Mutex
+}
+
+// Periods returns the time periods descriptors should currently be published for. Between the start of a
+// time period and the next shared random value (12:00 to 00:00 UTC) services publish for the previous and
+// current periods, otherwise for the current and next ones
+func (s *TimePeriodScheduler) Periods() []DescriptorPeriodV3 {
+	now := s.time.Now().UTC()
+	periodLength := s.PeriodLength()
+	current := common.TimePeriodV3(now, periodLength)
+
+	first := current
+	if s.betweenTimePeriodAndSRV(now, current, periodLength) {
+		first = current - 1
+	}
+
+	return []DescriptorPeriodV3{
+		{TimePeriod: first, First: true},
+		{TimePeriod: first + 1, First: false},
+	}
+}
+
+// PeriodLength returns the length of a time period in minutes
+func (s *TimePeriodScheduler) PeriodLength() int64 {
+	return s.periodLength.PeriodLength()
+}
+
+// betweenTimePeriodAndSRV returns true if a new time period has started but the shared random protocol run,
+// which starts at 00:00 UTC, hasn't yet
+func (s *TimePeriodScheduler) betweenTimePeriodAndSRV(now time.Time, current, periodLength int64) bool {
+	timePeriodStart := common.TimePeriodStartV3(current, periodLength)
+	nextSRVStart := timePeriodStart.Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+	return now.Before(nextSRVStart)
+}
+
+// NextRevisionCounter returns the revision counter for the next descriptor of address in timePeriod. Counters
+// are derived from the seconds since the start of the period before timePeriod, so they keep increasing even if
+// the state is lost, and are bumped past the last used counter if the clock went backwards
+func (s *TimePeriodScheduler) NextRevisionCounter(address string, timePeriod int64) (uint64, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var revisionCounter uint64
+	start := common.TimePeriodStartV3(timePeriod-1, s.PeriodLength())
+	if elapsed := s.time.Now().Sub(start); elapsed > 0 {
+		revisionCounter = uint64(elapsed / time.Second)
+	}
+
+	periods, ok := s.revisionCounters[address]
+	if !ok {
+		periods = make(map[string]uint64)
+		s.revisionCounters[address] = periods
+	}
+
+	key := strconv.FormatInt(timePeriod, 10)
+	if last, ok := periods[key]; ok && revisionCounter <= last {
+		revisionCounter = last + 1
+	}
+	periods[key] = revisionCounter
+
+	// Counters of periods that are no longer published are not needed anymore
+	for period := range periods {
+		if p, err := strconv.ParseInt(period, 10, 64); err == nil && p < timePeriod-2 {
+			delete(periods, period)
+		}
+	}
+
+	if err := s.save(); err != nil {
+		return 0, fmt.Errorf("failed to save revision counters: %v", err)
+	}
+
+	return revisionCounter, nil
+}
+
+// load reads the revision counters from the state file
+func (s *TimePeriodScheduler) load() error {
+	if s.statePath == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &s.revisionCounters)
+}
+
+// save writes the revision counters to the state file, the file is replaced atomically so a crash can't leave
+// it half written
+func (s *TimePeriodScheduler) save() error {
+	if s.statePath == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.revisionCounters)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.statePath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.statePath)
+}
+
+// NewTimePeriodScheduler returns a new TimePeriodScheduler, statePath may be empty to keep counters in memory only
+func NewTimePeriodScheduler(statePath string, periodLength PeriodLengthSource, time common.ITimeProvider) (
+	*TimePeriodScheduler, error) {
+	scheduler := &TimePeriodScheduler{
+		periodLength:     periodLength,
+		statePath:        statePath,
+		time:             time,
+		revisionCounters: make(map[string]map[string]uint64),
+	}
+
+	if err := scheduler.load(); err != nil {
+		return nil, fmt.Errorf("failed to load revision counters: %v", err)
+	}
+
+	if scheduler.revisionCounters == nil {
+		scheduler.revisionCounters = make(map[string]map[string]uint64)
+	}
+
+	return scheduler, nil
+}
@@ -0,0 +1,154 @@
+package onion
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/csucu/onionspread/common"
+	"github.com/csucu/onionspread/descriptor"
+)
+
+func TestTimePeriodScheduler_Periods(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		time time.Time
+		want []DescriptorPeriodV3
+	}{
+		{
+			"between srv and time period",
+			time.Date(2016, 4, 13, 11, 0, 0, 0, time.UTC),
+			[]DescriptorPeriodV3{{16903, true}, {16904, false}},
+		},
+		{
+			"between time period and srv",
+			time.Date(2016, 4, 13, 13, 0, 0, 0, time.UTC),
+			[]DescriptorPeriodV3{{16903, true}, {16904, false}},
+		},
+		{
+			"after new srv",
+			time.Date(2016, 4, 14, 0, 30, 0, 0, time.UTC),
+			[]DescriptorPeriodV3{{16904, true}, {16905, false}},
+		},
+	}
+
+	for _, tt := range testCases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			timeProvider := &common.MockTimeProvider{}
+			timeProvider.Set(tt.time)
+
+			scheduler, err := NewTimePeriodScheduler("", FixedPeriodLength(common.TimePeriodLengthV3), timeProvider)
+			if err != nil {
+				t.Fatalf("failed to create scheduler: %v", err)
+			}
+
+			if got := scheduler.Periods(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want %v got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTimePeriodScheduler_consensusPeriodLength(t *testing.T) {
+	t.Parallel()
+
+	hsdirFetcher := NewHSDirFetcher(&MockController{
+		ReturnedConsensus: &descriptor.Consensus{
+			Params:              map[string]int{"hsdir-interval": 60},
+			RouterStatusEntries: routerStatusEntries,
+		},
+	}, common.NewNopLogger())
+	if err := hsdirFetcher.update(); err != nil {
+		t.Fatalf("failed to update hsdir fetcher: %v", err)
+	}
+
+	timeProvider := &common.MockTimeProvider{}
+	timeProvider.Set(time.Date(2016, 4, 13, 11, 0, 0, 0, time.UTC))
+
+	scheduler, err := NewTimePeriodScheduler("", hsdirFetcher, timeProvider)
+	if err != nil {
+		t.Fatalf("failed to create scheduler: %v", err)
+	}
+
+	if scheduler.PeriodLength() != 60 {
+		t.Errorf("expected the period length of the consensus got %v", scheduler.PeriodLength())
+	}
+
+	want := []DescriptorPeriodV3{{405694, true}, {405695, false}}
+	if got := scheduler.Periods(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v got %v", want, got)
+	}
+}
+
+func TestTimePeriodScheduler_NextRevisionCounter(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "onionspread")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	statePath := filepath.Join(dir, "state.json")
+	timeProvider := &common.MockTimeProvider{}
+	timeProvider.Set(time.Date(2016, 4, 13, 13, 0, 0, 0, time.UTC))
+
+	scheduler, err := NewTimePeriodScheduler(statePath, FixedPeriodLength(common.TimePeriodLengthV3), timeProvider)
+	if err != nil {
+		t.Fatalf("failed to create scheduler: %v", err)
+	}
+
+	// an hour into period 16904, so 25 hours after the start of 16903
+	first, err := scheduler.NextRevisionCounter("address", 16904)
+	if err != nil {
+		t.Fatalf("failed to get revision counter: %v", err)
+	}
+
+	if first != 25*3600 {
+		t.Errorf("want %v got %v", 25*3600, first)
+	}
+
+	// same time again
+	second, err := scheduler.NextRevisionCounter("address", 16904)
+	if err != nil {
+		t.Fatalf("failed to get revision counter: %v", err)
+	}
+
+	if second <= first {
+		t.Errorf("want revision counter greater than %v got %v", first, second)
+	}
+
+	// clock goes backwards and onionspread restarts
+	timeProvider.Set(time.Date(2016, 4, 13, 12, 30, 0, 0, time.UTC))
+	scheduler, err = NewTimePeriodScheduler(statePath, FixedPeriodLength(common.TimePeriodLengthV3), timeProvider)
+	if err != nil {
+		t.Fatalf("failed to create scheduler: %v", err)
+	}
+
+	third, err := scheduler.NextRevisionCounter("address", 16904)
+	if err != nil {
+		t.Fatalf("failed to get revision counter: %v", err)
+	}
+
+	if third <= second {
+		t.Errorf("want revision counter greater than %v got %v", second, third)
+	}
+
+	// other services and periods are independent
+	other, err := scheduler.NextRevisionCounter("other", 16904)
+	if err != nil {
+		t.Fatalf("failed to get revision counter: %v", err)
+	}
+
+	if other != 24*3600+1800 {
+		t.Errorf("want %v got %v", 24*3600+1800, other)
+	}
+}